@@ -6,18 +6,46 @@ import (
 	"os"
 	"strings"
 
+	"github.com/brenoafb/tinycompiler/pkg/asm"
 	"github.com/brenoafb/tinycompiler/pkg/compiler"
+	"github.com/brenoafb/tinycompiler/pkg/driver"
 	"github.com/brenoafb/tinycompiler/pkg/expr"
 	"github.com/brenoafb/tinycompiler/pkg/parser"
 	pp "github.com/brenoafb/tinycompiler/pkg/preprocess"
 )
 
 var (
-	input  = flag.String("i", "", "input file")
-	output = flag.String("o", "output.s", "file to write assembly output to")
-	nopp   = flag.Bool("np", false, "don't pre-process input")
+	input    = flag.String("i", "", "input file")
+	output   = flag.String("o", "output.s", "file to write assembly output to")
+	nopp     = flag.Bool("np", false, "don't pre-process input")
+	safety   = flag.Int("safety", compiler.SafetyFull, "runtime checks: 0 (none), 1 (memory accesses) or 2 (all)")
+	ifaceOut = flag.String("iface-out", "", "file to write the interface of the unit to")
+	irOut    = flag.String("ir-out", "", "file to write the intermediate representation of the unit to")
+	syntax   = flag.String("syntax", "att", "assembler syntax of the output: att or intel")
+	nopeep   = flag.Bool("nopeephole", false, "don't optimise the assembly output")
+	noregs   = flag.Bool("noregalloc", false, "keep all temporaries in the stack frame")
+	inline   = flag.Int("inline", pp.DefaultInlineSize, "size of the largest procedure inlined, negative to disable")
+	ifaces   stringList
+	path     stringList
 )
 
+func init() {
+	flag.Var(&ifaces, "iface", "interface file of another unit, can be repeated; calls to procedures they do not export are errors")
+	flag.Var(&path, "I", "directory searched for imported modules, can be repeated")
+}
+
+// stringList collects the values of a repeated flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -53,7 +81,8 @@ func main() {
 		}
 		e = es[0]
 	} else {
-		e, err = pp.Preprocess(es, name)
+		modules := driver.Resolver{Path: path}
+		e, err = pp.PreprocessWith(es, name, pp.Options{Resolve: modules.For(*input), InlineSize: *inline})
 		if err != nil {
 			panic(fmt.Errorf("preprocessor error: %w", err))
 		}
@@ -68,9 +97,58 @@ func main() {
 	defer f.Close()
 
 	c := compiler.NewCompiler(f)
+	c.Safety = *safety
+	c.Peephole = !*nopeep
+	c.Registers = !*noregs
+	c.Syntax, err = asm.ParseSyntax(*syntax)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(ifaces) > 0 {
+		imported := []compiler.Interface{}
+		for _, path := range ifaces {
+			content, err := os.ReadFile(path)
+			if err != nil {
+				panic(fmt.Errorf("error reading interface: %w", err))
+			}
+			i, err := driver.ParseInterface(string(content))
+			if err != nil {
+				panic(fmt.Errorf("%s: %w", path, err))
+			}
+			imported = append(imported, i)
+		}
+		c.Imports, err = driver.Imports(imported)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	err = c.Compile(e)
 
 	if err != nil {
 		panic(err)
 	}
+
+	if *irOut != "" {
+		u, err := c.Lower(e)
+		if err != nil {
+			panic(err)
+		}
+		err = os.WriteFile(*irOut, []byte(u.String()), 0o644)
+		if err != nil {
+			panic(fmt.Errorf("cannot write intermediate representation: %w", err))
+		}
+	}
+
+	if *ifaceOut != "" {
+		i, err := compiler.InterfaceOf(e)
+		if err != nil {
+			panic(err)
+		}
+		err = os.WriteFile(*ifaceOut, []byte(driver.FormatInterface(i)), 0o644)
+		if err != nil {
+			panic(fmt.Errorf("cannot write interface file: %w", err))
+		}
+	}
 }
@@ -4,12 +4,17 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/brenoafb/tinycompiler/pkg/parser"
+	pp "github.com/brenoafb/tinycompiler/pkg/preprocess"
 )
 
 var (
-	input = flag.String("i", "", "input file")
+	input      = flag.String("i", "", "input file")
+	output     = flag.String("o", "", "file to write formatted output to")
+	write      = flag.Bool("w", false, "write result to the input file instead of stdout")
+	migrateLet = flag.Bool("migrate-let", false, "rewrite let forms from the original syntax to the standard one, leaving the rest of the file as it is")
 )
 
 func main() {
@@ -32,11 +37,41 @@ func main() {
 		panic(fmt.Errorf("tokenizer error: %w", err))
 	}
 
-	e, err := parser.Parse(tokens)
+	es, err := parser.Parse(tokens)
 
 	if err != nil {
 		panic(fmt.Errorf("parser error: %w", err))
 	}
 
-	fmt.Println(e.String())
+	var sb strings.Builder
+	if *migrateLet {
+		// only the let forms are rewritten, keeping the layout of the file
+		if err := pp.CheckLets(es); err != nil {
+			panic(fmt.Errorf("cannot migrate let forms: %w", err))
+		}
+		migrated, err := pp.MigrateLetSource(code)
+		if err != nil {
+			panic(fmt.Errorf("cannot migrate let forms: %w", err))
+		}
+		sb.WriteString(migrated)
+	} else {
+		for _, e := range es {
+			sb.WriteString(e.String())
+		}
+	}
+
+	path := *output
+	if *write {
+		path = *input
+	}
+
+	if path == "" {
+		fmt.Print(sb.String())
+		return
+	}
+
+	err = os.WriteFile(path, []byte(sb.String()), 0644)
+	if err != nil {
+		panic(fmt.Errorf("error writing file: %w", err))
+	}
 }
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/brenoafb/tinycompiler/pkg/compiler"
+	"github.com/brenoafb/tinycompiler/pkg/driver"
+)
+
+type builder struct {
+	output         string
+	preprocessOnly bool
+	assemblyOnly   bool
+	objectOnly     bool
+	safety         int
+	noPeephole     bool
+	noRegisters    bool
+	inlineSize     int
+	jobs           int
+	cc             []string
+	runtime        string
+	stdlib         string
+	modules        driver.Resolver
+	// cache is nil when caching is disabled
+	cache *driver.Cache
+}
+
+// unit is a Lisp file to be compiled
+type unit struct {
+	path string
+	// name and iface are known once the interface is gathered
+	name  string
+	iface compiler.Interface
+}
+
+func (b *builder) build(files []string) error {
+	if len(files) == 0 {
+		return fmt.Errorf("no input files")
+	}
+
+	modes := 0
+	for _, m := range []bool{b.preprocessOnly, b.assemblyOnly, b.objectOnly} {
+		if m {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return fmt.Errorf("only one of -E, -S and -c can be given")
+	}
+
+	units := []unit{}
+	others := []string{}
+	ifaces := []string{}
+	seen := make(map[string]struct{})
+	for _, f := range files {
+		if _, ok := seen[filepath.Clean(f)]; ok {
+			return fmt.Errorf("%s given more than once", f)
+		}
+		seen[filepath.Clean(f)] = struct{}{}
+
+		switch filepath.Ext(f) {
+		case ".lisp":
+			units = append(units, unit{path: f})
+		case ".s", ".o":
+			// compiled units come with their interface
+			others = append(others, f)
+			iface := strings.TrimSuffix(f, filepath.Ext(f)) + driver.InterfaceExt
+			ifaces = append(ifaces, iface)
+			seen[filepath.Clean(iface)] = struct{}{}
+		case driver.InterfaceExt:
+			ifaces = append(ifaces, f)
+		default:
+			return fmt.Errorf("%s: unknown file type", f)
+		}
+	}
+
+	if modes > 0 {
+		if len(others) > 0 {
+			return fmt.Errorf("only Lisp and interface files can be given with -E, -S or -c")
+		}
+		if b.output != "" && len(units) > 1 {
+			return fmt.Errorf("-o cannot be given with -E, -S or -c and several input files")
+		}
+	}
+
+	if b.preprocessOnly {
+		return b.preprocess(units)
+	}
+
+	// imported modules and the standard library are only compiled
+	// into programs, but their procedures are known to every unit
+	compiled := units
+	units, ifaces, others, err := b.findModules(units, ifaces, others, seen, modes == 0)
+	if err != nil {
+		return err
+	}
+	if modes == 0 {
+		compiled = units
+	}
+	if b.stdlib != "" {
+		if _, err := os.Stat(b.stdlib); err != nil {
+			return fmt.Errorf("standard library not found, set it with -stdlib or TINYC_STDLIB: %w", err)
+		}
+		units = append(units, unit{path: b.stdlib})
+		if modes == 0 {
+			compiled = units
+		}
+	}
+
+	imported, err := b.readInterfaces(ifaces)
+	if err != nil {
+		return err
+	}
+
+	err = driver.ForEach(len(units), b.jobs, func(i int) error {
+		return b.gatherInterface(&units[i])
+	})
+	if err != nil {
+		return err
+	}
+
+	paths := make(map[string]string)
+	for _, u := range units {
+		if other, ok := paths[u.name]; ok {
+			if u.name == driver.EntryName {
+				return fmt.Errorf("%s and %s both have top-level expressions", other, u.path)
+			}
+			return fmt.Errorf("%s and %s both compile to unit %s", other, u.path, u.name)
+		}
+		paths[u.name] = u.path
+	}
+
+	// each unit imports every other one
+	imports := make([]map[string]compiler.Signature, len(compiled))
+	for i := range compiled {
+		others := append([]compiler.Interface{}, imported...)
+		for j, u := range units {
+			if j != i {
+				others = append(others, u.iface)
+			}
+		}
+		imports[i], err = driver.Imports(others)
+		if err != nil {
+			return err
+		}
+	}
+
+	if b.assemblyOnly {
+		return driver.ForEach(len(compiled), b.jobs, func(i int) error {
+			u := units[i]
+			if err := b.compile(u, imports[i], b.outputFor(u, ".s")); err != nil {
+				return err
+			}
+			return b.writeInterface(u, ".s")
+		})
+	}
+
+	if err := b.checkCC(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(b.runtime); err != nil {
+		return fmt.Errorf("runtime not found, set it with -runtime or TINYC_RUNTIME: %w", err)
+	}
+
+	tmp, err := os.MkdirTemp("", "tinyc")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	asm := func(i int) string {
+		return filepath.Join(tmp, fmt.Sprintf("%d-%s.s", i, units[i].name))
+	}
+
+	if b.objectOnly {
+		return driver.ForEach(len(compiled), b.jobs, func(i int) error {
+			u := units[i]
+			if err := b.compile(u, imports[i], asm(i)); err != nil {
+				return err
+			}
+			if err := b.runCC("-c", asm(i), "-o", b.outputFor(u, ".o")); err != nil {
+				return err
+			}
+			return b.writeInterface(u, ".o")
+		})
+	}
+
+	err = driver.ForEach(len(compiled), b.jobs, func(i int) error {
+		return b.compile(units[i], imports[i], asm(i))
+	})
+	if err != nil {
+		return err
+	}
+
+	// the runtime initialises units in the order they are linked
+	linking := []linked{}
+	for i := range compiled {
+		linking = append(linking, linked{path: asm(i), name: units[i].name, imports: units[i].iface.Imports})
+	}
+	interfaces := make(map[string]compiler.Interface)
+	for i, path := range ifaces {
+		interfaces[filepath.Clean(path)] = imported[i]
+	}
+	for _, other := range others {
+		iface := interfaces[filepath.Clean(strings.TrimSuffix(other, filepath.Ext(other))+driver.InterfaceExt)]
+		linking = append(linking, linked{path: other, name: iface.Name, imports: iface.Imports})
+	}
+	args := append([]string{b.runtime}, linkOrder(linking)...)
+
+	output := b.output
+	if output == "" {
+		output = "a.out"
+	}
+
+	return b.runCC(append(args, "-o", output)...)
+}
+
+// linked is a file linked into a program, compiled from the unit name
+// importing the given modules
+type linked struct {
+	path    string
+	name    string
+	imports []string
+}
+
+// linkOrder returns the paths of files, placing the units they import
+// before them so that the global variables of imported modules are
+// initialised first. Files are otherwise kept in order.
+func linkOrder(files []linked) []string {
+	units := make(map[string]int)
+	for i, f := range files {
+		if f.name != "" {
+			units[f.name] = i
+		}
+	}
+
+	order := make([]string, 0, len(files))
+	visited := make([]bool, len(files))
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		// marked first, so that import cycles end here
+		visited[i] = true
+		for _, name := range files[i].imports {
+			if j, ok := units[name]; ok {
+				visit(j)
+			}
+		}
+		order = append(order, files[i].path)
+	}
+	for i := range files {
+		visit(i)
+	}
+	return order
+}
+
+// findModules adds the modules imported by units and interface
+// files that are not given to the build, found by b.modules, and
+// the modules they import in turn. Modules compiled separately
+// are linked when link is set.
+func (b *builder) findModules(
+	units []unit,
+	ifaces []string,
+	others []string,
+	seen map[string]struct{},
+	link bool,
+) ([]unit, []string, []string, error) {
+	pending := []string{}
+	for _, u := range units {
+		pending = append(pending, u.path)
+	}
+	pending = append(pending, ifaces...)
+
+	for len(pending) > 0 {
+		path := pending[0]
+		pending = pending[1:]
+
+		imports, err := importsOf(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		for _, name := range imports {
+			found, err := b.modules.Find(name, filepath.Dir(path))
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("%s: %w", path, err)
+			}
+			found = filepath.Clean(found)
+			if _, ok := seen[found]; ok {
+				continue
+			}
+			seen[found] = struct{}{}
+			pending = append(pending, found)
+
+			if filepath.Ext(found) != driver.InterfaceExt {
+				units = append(units, unit{path: found})
+				continue
+			}
+
+			ifaces = append(ifaces, found)
+			object := strings.TrimSuffix(found, driver.InterfaceExt) + ".o"
+			if _, ok := seen[object]; !ok && link {
+				if _, err := os.Stat(object); err == nil {
+					seen[object] = struct{}{}
+					others = append(others, object)
+				}
+			}
+		}
+	}
+	return units, ifaces, others, nil
+}
+
+// importsOf returns the modules imported by a Lisp or interface file
+func importsOf(path string) ([]string, error) {
+	src, err := os.ReadFile(path)
+	if err != nil && filepath.Ext(path) == driver.InterfaceExt {
+		return nil, fmt.Errorf("error reading interface: %w", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == driver.InterfaceExt {
+		i, err := driver.ParseInterface(string(src))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return i.Imports, nil
+	}
+	imports, err := driver.ModuleImports(string(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return imports, nil
+}
+
+// outputFor returns the file written for u when stopping early,
+// which is named after it and placed in the current directory
+func (b *builder) outputFor(u unit, ext string) string {
+	if b.output != "" {
+		return b.output
+	}
+	base := filepath.Base(u.path)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + ext
+}
+
+func (b *builder) preprocess(units []unit) error {
+	results := make([]string, len(units))
+	err := driver.ForEach(len(units), b.jobs, func(i int) error {
+		src, err := os.ReadFile(units[i].path)
+		if err != nil {
+			return err
+		}
+		key, err := b.cacheKey("preprocess", units[i], src)
+		if err != nil {
+			return err
+		}
+		if data, ok := b.cacheGet(key); ok {
+			results[i] = string(data)
+			return nil
+		}
+		e, err := driver.Preprocess(string(src), units[i].path, b.options(nil))
+		if err != nil {
+			return fmt.Errorf("%s: %w", units[i].path, err)
+		}
+		results[i] = e.String()
+		b.cachePut(key, []byte(results[i]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	for _, r := range results {
+		out.WriteString(r)
+		out.WriteString("\n")
+	}
+
+	if b.output == "" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return err
+	}
+	return os.WriteFile(b.output, out.Bytes(), 0o644)
+}
+
+func (b *builder) readInterfaces(paths []string) ([]compiler.Interface, error) {
+	ifaces := make([]compiler.Interface, 0, len(paths))
+	for _, path := range paths {
+		src, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading interface: %w", err)
+		}
+		i, err := driver.ParseInterface(string(src))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		ifaces = append(ifaces, i)
+	}
+	return ifaces, nil
+}
+
+// gatherInterface finds the procedures exported by u
+func (b *builder) gatherInterface(u *unit) error {
+	src, err := os.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+
+	key, err := b.cacheKey("interface", *u, src)
+	if err != nil {
+		return err
+	}
+	if data, ok := b.cacheGet(key); ok {
+		u.iface, err = driver.ParseInterface(string(data))
+		if err == nil {
+			u.name = u.iface.Name
+			return nil
+		}
+	}
+
+	u.iface, err = driver.InterfaceOf(string(src), u.path, b.modules)
+	if err != nil {
+		return fmt.Errorf("%s: %w", u.path, err)
+	}
+	u.name = u.iface.Name
+	b.cachePut(key, []byte(driver.FormatInterface(u.iface)))
+
+	return nil
+}
+
+// writeInterface writes the interface of u next to
+// its output with the given extension
+func (b *builder) writeInterface(u unit, ext string) error {
+	path := strings.TrimSuffix(b.outputFor(u, ext), ext) + driver.InterfaceExt
+	return os.WriteFile(path, []byte(driver.FormatInterface(u.iface)), 0o644)
+}
+
+// compile writes the assembly of u to the file at path
+func (b *builder) compile(u unit, imports map[string]compiler.Signature, path string) error {
+	src, err := os.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+
+	// calls are checked against the imported procedures,
+	// so the result depends on them
+	importsText := driver.FormatInterface(compiler.Interface{Name: "imports", Exports: imports})
+	key, err := b.cacheKey("compile", u, src, importsText)
+	if err != nil {
+		return err
+	}
+	if data, ok := b.cacheGet(key); ok {
+		return os.WriteFile(path, data, 0o644)
+	}
+
+	var out bytes.Buffer
+	if err := driver.Compile(&out, string(src), u.path, b.options(imports)); err != nil {
+		return fmt.Errorf("%s: %w", u.path, err)
+	}
+	b.cachePut(key, out.Bytes())
+
+	return os.WriteFile(path, out.Bytes(), 0o644)
+}
+
+// options returns the options compiling units with the given imports
+func (b *builder) options(imports map[string]compiler.Signature) driver.Options {
+	return driver.Options{
+		Safety:      b.safety,
+		NoPeephole:  b.noPeephole,
+		NoRegisters: b.noRegisters,
+		InlineSize:  b.inlineSize,
+		Imports:     imports,
+		Modules:     b.modules,
+	}
+}
+
+// cacheKey returns the key of the result of the given step for u,
+// covering everything the result depends on
+func (b *builder) cacheKey(step string, u unit, src []byte, extra ...string) (string, error) {
+	// names are qualified with the modules exporting them,
+	// and references to global variables differ from calls
+	imports, err := driver.ModuleImports(string(src))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", u.path, err)
+	}
+	for _, name := range imports {
+		m, err := b.modules.Module(name, filepath.Dir(u.path))
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", u.path, err)
+		}
+		extra = append(extra, fmt.Sprintf("%s: %s; %s", name, strings.Join(m.Exports, " "), strings.Join(m.Globals, " ")))
+	}
+
+	return driver.Key(append([]string{
+		compilerVersion(),
+		step,
+		// the name of the unit depends on the name of its file
+		filepath.Base(u.path),
+		fmt.Sprintf("safety=%d", b.safety),
+		fmt.Sprintf("peephole=%t", !b.noPeephole),
+		fmt.Sprintf("registers=%t", !b.noRegisters),
+		fmt.Sprintf("inline=%d", b.inlineSize),
+		string(src),
+	}, extra...)...), nil
+}
+
+func (b *builder) cacheGet(key string) ([]byte, bool) {
+	if b.cache == nil {
+		return nil, false
+	}
+	return b.cache.Get(key)
+}
+
+func (b *builder) cachePut(key string, data []byte) {
+	if b.cache == nil {
+		return
+	}
+	// the cache only saves work, so failing to fill it is not an error
+	_ = b.cache.Put(key, data)
+}
+
+func (b *builder) checkCC() error {
+	if len(b.cc) == 0 {
+		return fmt.Errorf("no C compiler configured")
+	}
+	if _, err := exec.LookPath(b.cc[0]); err != nil {
+		return fmt.Errorf("C compiler not found, set it with -cc or TINYC_CC: %w", err)
+	}
+	return nil
+}
+
+func (b *builder) runCC(args ...string) error {
+	cmd := exec.Command(b.cc[0], append(b.cc[1:len(b.cc):len(b.cc)], args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", strings.Join(cmd.Args, " "), err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    []linked
+		expected []string
+	}{
+		{
+			name: "imported after importer",
+			files: []linked{
+				{path: "main.s", name: "lisp_entry", imports: []string{"b"}},
+				{path: "b.s", name: "b", imports: []string{"a"}},
+				{path: "a.s", name: "a"},
+			},
+			expected: []string{"a.s", "b.s", "main.s"},
+		},
+		{
+			name: "independent files kept in order",
+			files: []linked{
+				{path: "b.s", name: "b"},
+				{path: "a.s", name: "a"},
+				{path: "stdlib.s", name: "stdlib"},
+			},
+			expected: []string{"b.s", "a.s", "stdlib.s"},
+		},
+		{
+			name: "objects without interface",
+			files: []linked{
+				{path: "main.s", name: "lisp_entry", imports: []string{"lib"}},
+				{path: "extra.o"},
+				{path: "lib.o", name: "lib"},
+			},
+			expected: []string{"lib.o", "main.s", "extra.o"},
+		},
+		{
+			name: "import cycle",
+			files: []linked{
+				{path: "a.s", name: "a", imports: []string{"b"}},
+				{path: "b.s", name: "b", imports: []string{"a"}},
+			},
+			expected: []string{"b.s", "a.s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, linkOrder(tt.files))
+		})
+	}
+}
+
+// buildAndRun builds a program from files, written to a temporary
+// directory, with main as the file given to tinyc, and returns its
+// output when run in that directory. t is skipped when there is no C compiler for i386 or the
+// program cannot be run.
+func buildAndRun(t *testing.T, files map[string]string, main string) string {
+	cc := strings.Fields(envOr("TINYC_CC", "zig cc -target x86-linux-musl"))
+	if _, err := exec.LookPath(cc[0]); err != nil {
+		t.Skipf("no C compiler for i386: %v", err)
+	}
+	runtime, err := filepath.Abs("../../runtime.c")
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	for name, src := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644))
+	}
+
+	prog := filepath.Join(dir, "prog")
+	b := builder{jobs: 1, cc: cc, runtime: runtime, output: prog}
+	require.NoError(t, b.build([]string{filepath.Join(dir, main)}))
+
+	cmd := exec.Command(prog)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Skipf("cannot run i386 programs: %v", err)
+	}
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestBuildInitialisesImportsFirst(t *testing.T) {
+	// main only imports b, so a is found last, but the global
+	// of b is computed from the one of a
+	out := buildAndRun(t, map[string]string{
+		"main.lisp": "(module main (import b)) derived",
+		"b.lisp":    "(module b (export derived) (import a)) (define derived (+ (get-base) 1))",
+		"a.lisp":    "(module a (export get-base)) (define base (cons 41 ())) (defun get-base () (car base))",
+	}, "main.lisp")
+	require.Equal(t, "42\n", out)
+}
+
+func TestBuildDefinitionsOnly(t *testing.T) {
+	// a program without top-level expressions has no entry point,
+	// and each unit is initialised once
+	out := buildAndRun(t, map[string]string{
+		"main.lisp": `(define x (display "hello"))`,
+	}, "main.lisp")
+	require.Equal(t, "hello", out)
+
+	// unless it is named after the entry point, which is then not
+	// an initialiser
+	out = buildAndRun(t, map[string]string{
+		"lisp_entry.lisp": `(define x (display "hello"))`,
+	}, "lisp_entry.lisp")
+	require.Equal(t, "hello()\n", out)
+}
+
+func TestBuildReadLongLine(t *testing.T) {
+	// the line does not fit in the heap, and the next one is read
+	out := buildAndRun(t, map[string]string{
+		"main.lisp": `(let* ((in (open-input-file "long.txt")) (long (read-line in)))
+  (display (error-object? long))
+  (read-line in))`,
+		"long.txt": strings.Repeat("x", 2<<20) + "\nok\n",
+	}, "main.lisp")
+	require.Equal(t, "#tok\n", out)
+}
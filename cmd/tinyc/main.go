@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/brenoafb/tinycompiler/pkg/compiler"
+	"github.com/brenoafb/tinycompiler/pkg/driver"
+	pp "github.com/brenoafb/tinycompiler/pkg/preprocess"
+)
+
+const usage = `usage: tinyc build [flags] files...
+       tinyc clean-cache
+
+Files ending in .lisp are compiled, and files ending in .s or .o are
+passed to the C compiler as they are, along with the interface file
+ending in .lispi next to them. The Lisp file with top-level expressions
+is the entry point of the program.
+
+Modules imported by the Lisp files and not given are looked for in
+the directory of the importing file, then in the directories given
+with -I and in $TINYC_PATH. Those found as source are compiled, and
+those found as interface files are linked with the object file next
+to them, if any.
+
+Calls to procedures that no unit nor interface file exports, or with
+the wrong number of arguments, are errors.
+
+The runtime and the standard library are looked for next to the tinyc
+executable, then in the share/tinyc directory of its prefix and in the
+working directory, unless given with -runtime and -stdlib.
+
+Compiled files are cached in $TINYC_CACHE, or the tinyc directory of
+the user cache directory, and clean-cache removes them.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "build":
+		err = build(os.Args[2:])
+	case "clean-cache":
+		err = cleanCache()
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		report(err)
+		os.Exit(1)
+	}
+}
+
+func build(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		fs.PrintDefaults()
+	}
+
+	b := builder{}
+	fs.StringVar(&b.output, "o", "", "output file")
+	fs.BoolVar(&b.preprocessOnly, "E", false, "stop after preprocessing, writing the result to the output file or stdout")
+	fs.BoolVar(&b.assemblyOnly, "S", false, "stop after compiling, writing an assembly file for each input")
+	fs.BoolVar(&b.objectOnly, "c", false, "stop after assembling, writing an object file for each input")
+	fs.IntVar(&b.jobs, "j", runtime.NumCPU(), "number of files compiled concurrently")
+	fs.IntVar(&b.safety, "safety", compiler.SafetyFull, "runtime checks: 0 (none), 1 (memory accesses) or 2 (all)")
+	fs.BoolVar(&b.noPeephole, "nopeephole", false, "don't optimise the generated assembly, for debugging")
+	fs.BoolVar(&b.noRegisters, "noregalloc", false, "keep all temporaries in the stack frame, for debugging")
+	fs.IntVar(&b.inlineSize, "inline", pp.DefaultInlineSize, "size of the largest procedure inlined, negative to disable")
+	cc := fs.String("cc", envOr("TINYC_CC", "zig cc -target x86-linux-musl"), "C compiler used to assemble and link, with its arguments")
+	fs.StringVar(&b.runtime, "runtime", envOr("TINYC_RUNTIME", installed("runtime.c")), "runtime source file")
+	fs.StringVar(&b.stdlib, "stdlib", envOr("TINYC_STDLIB", installed("stdlib.lisp")), "standard library linked with programs, empty to disable")
+	var path stringList
+	fs.Var(&path, "I", "directory searched for imported modules, can be repeated")
+	noCache := fs.Bool("nocache", false, "neither use nor fill the build cache")
+	stats := fs.Bool("stats", false, "print cache hits and misses")
+
+	files := parseArgs(fs, args)
+	b.cc = strings.Fields(*cc)
+	b.modules.Path = append(path, filepath.SplitList(os.Getenv("TINYC_PATH"))...)
+
+	if !*noCache {
+		dir, err := driver.DefaultCacheDir()
+		if err != nil {
+			return err
+		}
+		b.cache = driver.NewCache(dir)
+	}
+
+	err := b.build(files)
+
+	if *stats && b.cache != nil {
+		hits, misses := b.cache.Stats()
+		fmt.Fprintf(os.Stderr, "tinyc: cache: %d hits, %d misses\n", hits, misses)
+	}
+
+	return err
+}
+
+func cleanCache() error {
+	dir, err := driver.DefaultCacheDir()
+	if err != nil {
+		return err
+	}
+	return driver.NewCache(dir).Clean()
+}
+
+// report prints err, with one line for each of the errors
+// of the files compiled concurrently
+func report(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			report(err)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "tinyc: %s\n", err)
+}
+
+// parseArgs parses the flags in args, which may be interleaved
+// with the input files, and returns the input files
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	files := []string{}
+	for {
+		// ExitOnError is set, so errors never reach here
+		_ = fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return files
+		}
+		files = append(files, args[0])
+		args = args[1:]
+	}
+}
+
+// stringList collects the values of a repeated flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func envOr(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+// installed returns the path of a file installed with tinyc, next to
+// the executable or in the share/tinyc directory of its prefix, or
+// else the name of the file in the working directory
+func installed(name string) string {
+	exe, err := os.Executable()
+	if err != nil {
+		return name
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	dir := filepath.Dir(exe)
+	for _, path := range []string{
+		filepath.Join(dir, name),
+		filepath.Join(dir, "..", "share", "tinyc", name),
+	} {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return name
+}
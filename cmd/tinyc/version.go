@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	versionOnce sync.Once
+	version     string
+)
+
+// compilerVersion identifies this build of tinyc, so that
+// cache entries written by other builds are never used.
+// It is the hash of the executable, or its build information
+// when the executable cannot be read.
+func compilerVersion() string {
+	versionOnce.Do(func() {
+		if path, err := os.Executable(); err == nil {
+			if data, err := os.ReadFile(path); err == nil {
+				sum := sha256.Sum256(data)
+				version = hex.EncodeToString(sum[:])
+				return
+			}
+		}
+		if info, ok := debug.ReadBuildInfo(); ok {
+			version = info.String()
+		}
+	})
+	return version
+}
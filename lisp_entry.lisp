@@ -1,2 +1,2 @@
-(let (a 13)
+(let ((a 13))
   ((lambda (x) (+ x a)) 37))
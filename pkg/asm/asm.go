@@ -0,0 +1,220 @@
+// Package asm represents i386 assembly programs as lists of typed
+// instructions, labels and directives, which are only rendered as text,
+// in AT&T or Intel syntax, when printed.
+package asm
+
+// Reg is a register
+type Reg int
+
+const (
+	NoReg Reg = iota
+	EAX
+	EBX
+	ECX
+	EDX
+	ESI
+	EDI
+	EBP
+	ESP
+	// the low bytes of EAX and EDX
+	AL
+	DL
+)
+
+var regNames = [...]string{"", "eax", "ebx", "ecx", "edx", "esi", "edi", "ebp", "esp", "al", "dl"}
+
+func (r Reg) String() string {
+	return regNames[r]
+}
+
+// Operand is an operand of an instruction: a Reg, an Imm, an Addr,
+// a Symbol or a Mem
+type Operand interface {
+	isOperand()
+}
+
+// Imm is an immediate value, written in hex when Hex is set
+type Imm struct {
+	Value int
+	Hex   bool
+}
+
+// Int returns the immediate value x, written in decimal
+func Int(x int) Imm {
+	return Imm{Value: x}
+}
+
+// Hex returns the immediate value x, written in hex
+func Hex(x int) Imm {
+	return Imm{Value: x, Hex: true}
+}
+
+// Addr is the address of a symbol, used as an immediate value
+type Addr string
+
+// Symbol is a symbol used as the target of a jump or a call
+type Symbol string
+
+// Mem is the memory operand at Sym + Disp + Base + Index*Scale,
+// where any of the parts may be absent
+type Mem struct {
+	Sym   string
+	Disp  int
+	Base  Reg
+	Index Reg
+	Scale int
+}
+
+// At returns the memory operand at disp + base
+func At(disp int, base Reg) Mem {
+	return Mem{Disp: disp, Base: base}
+}
+
+// Indexed returns the memory operand at disp + base + index*scale
+func Indexed(disp int, base, index Reg, scale int) Mem {
+	return Mem{Disp: disp, Base: base, Index: index, Scale: scale}
+}
+
+// Var returns the memory operand at symbol sym
+func Var(sym string) Mem {
+	return Mem{Sym: sym}
+}
+
+func (Reg) isOperand()    {}
+func (Imm) isOperand()    {}
+func (Addr) isOperand()   {}
+func (Symbol) isOperand() {}
+func (Mem) isOperand()    {}
+
+// Op is the operation of an instruction
+type Op int
+
+const (
+	Movl Op = iota
+	// zero extends a byte
+	Movzbl
+	Leal
+	Addl
+	Subl
+	Andl
+	Orl
+	Orb
+	Sall
+	Sarl
+	Negl
+	Decl
+	Cmpl
+	Testl
+	Pushl
+	Popl
+	Call
+	Ret
+	Jmp
+	// jumps if the condition of the instruction holds
+	Jcc
+	// sets a byte to whether the condition of the instruction holds
+	Setcc
+)
+
+// mnemonics holds the AT&T and Intel mnemonics of each op.
+// Those of Jcc and Setcc are followed by their condition.
+var mnemonics = [...][2]string{
+	Movl:   {"movl", "mov"},
+	Movzbl: {"movzbl", "movzx"},
+	Leal:   {"leal", "lea"},
+	Addl:   {"addl", "add"},
+	Subl:   {"subl", "sub"},
+	Andl:   {"andl", "and"},
+	Orl:    {"orl", "or"},
+	Orb:    {"orb", "or"},
+	Sall:   {"sall", "sal"},
+	Sarl:   {"sarl", "sar"},
+	Negl:   {"negl", "neg"},
+	Decl:   {"decl", "dec"},
+	Cmpl:   {"cmpl", "cmp"},
+	Testl:  {"testl", "test"},
+	Pushl:  {"pushl", "push"},
+	Popl:   {"popl", "pop"},
+	Call:   {"call", "call"},
+	Ret:    {"ret", "ret"},
+	Jmp:    {"jmp", "jmp"},
+	Jcc:    {"j", "j"},
+	Setcc:  {"set", "set"},
+}
+
+// Cond is the condition of a conditional jump or set
+type Cond int
+
+const (
+	E Cond = iota
+	NE
+	// signed comparisons
+	L
+	LE
+	G
+	GE
+	// unsigned comparisons
+	B
+	BE
+	A
+	AE
+)
+
+var condNames = [...]string{"e", "ne", "l", "le", "g", "ge", "b", "be", "a", "ae"}
+
+func (c Cond) String() string {
+	return condNames[c]
+}
+
+// Negate returns the condition holding when c does not
+func (c Cond) Negate() Cond {
+	return [...]Cond{NE, E, GE, G, LE, L, AE, A, BE, B}[c]
+}
+
+// Line is a line of a program: an Instr, a Label or a Directive
+type Line interface {
+	isLine()
+}
+
+// Instr is an instruction, whose operands are given in AT&T order,
+// i.e. with the destination last
+type Instr struct {
+	Op   Op
+	Cond Cond
+	Args []Operand
+}
+
+// I returns the instruction applying op to args
+func I(op Op, args ...Operand) Instr {
+	return Instr{Op: op, Args: args}
+}
+
+// J returns the jump to target taken when cond holds
+func J(cond Cond, target string) Instr {
+	return Instr{Op: Jcc, Cond: cond, Args: []Operand{Symbol(target)}}
+}
+
+// Set returns the instruction setting the byte register r
+// to whether cond holds
+func Set(cond Cond, r Reg) Instr {
+	return Instr{Op: Setcc, Cond: cond, Args: []Operand{r}}
+}
+
+// Label defines a symbol at its position in the program
+type Label string
+
+// Directive is an assembler directive, such as .text or .long,
+// whose arguments are written as they are
+type Directive struct {
+	Name string
+	Args []string
+}
+
+// D returns the directive .name with the given arguments
+func D(name string, args ...string) Directive {
+	return Directive{Name: name, Args: args}
+}
+
+func (Instr) isLine()     {}
+func (Label) isLine()     {}
+func (Directive) isLine() {}
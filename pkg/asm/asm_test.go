@@ -0,0 +1,258 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		line  Line
+		att   string
+		intel string
+	}{
+		{
+			line:  I(Movl, EAX, ESI),
+			att:   "movl %eax, %esi",
+			intel: "mov esi, eax",
+		},
+		{
+			line:  I(Movl, Int(168), EAX),
+			att:   "movl $168, %eax",
+			intel: "mov eax, 168",
+		},
+		{
+			line:  I(Cmpl, Hex(0x1f), At(-4, ESP)),
+			att:   "cmpl $0x1f, -4(%esp)",
+			intel: "cmp dword ptr [esp-4], 0x1f",
+		},
+		{
+			line:  I(Movl, Addr("f0"), At(0, ESI)),
+			att:   "movl $f0, (%esi)",
+			intel: "mov dword ptr [esi], offset f0",
+		},
+		{
+			line:  I(Movl, Indexed(0, ESP, EDX, 4), EBX),
+			att:   "movl (%esp,%edx,4), %ebx",
+			intel: "mov ebx, dword ptr [esp+edx*4]",
+		},
+		{
+			line:  I(Movl, Indexed(2, EBX, EAX, 1), EAX),
+			att:   "movl 2(%ebx,%eax), %eax",
+			intel: "mov eax, dword ptr [ebx+eax+2]",
+		},
+		{
+			line:  I(Movl, ESI, Var("lisp_heap")),
+			att:   "movl %esi, lisp_heap",
+			intel: "mov dword ptr [lisp_heap], esi",
+		},
+		{
+			line:  I(Leal, At(8, EAX), EBX),
+			att:   "leal 8(%eax), %ebx",
+			intel: "lea ebx, [eax+8]",
+		},
+		{
+			line:  I(Movzbl, AL, EAX),
+			att:   "movzbl %al, %eax",
+			intel: "movzx eax, al",
+		},
+		{
+			line:  Set(BE, AL),
+			att:   "setbe %al",
+			intel: "setbe al",
+		},
+		{
+			line:  J(AE, "L1"),
+			att:   "jae L1",
+			intel: "jae L1",
+		},
+		{
+			line:  I(Call, Symbol("lisp_write")),
+			att:   "call lisp_write",
+			intel: "call lisp_write",
+		},
+		{
+			line:  I(Call, EBX),
+			att:   "call *%ebx",
+			intel: "call ebx",
+		},
+		{
+			line:  I(Ret),
+			att:   "ret",
+			intel: "ret",
+		},
+		{
+			line:  Label("L0"),
+			att:   "L0:",
+			intel: "L0:",
+		},
+		{
+			line:  D("section", "lisp_init", `"aw"`),
+			att:   "\t.section\tlisp_init, \"aw\"",
+			intel: "\t.section\tlisp_init, \"aw\"",
+		},
+		{
+			line:  D("text"),
+			att:   "\t.text",
+			intel: "\t.text",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.att, func(t *testing.T) {
+			require.Equal(t, tt.att, Format(tt.line, ATT))
+			require.Equal(t, tt.intel, Format(tt.line, Intel))
+		})
+	}
+}
+
+func TestPrint(t *testing.T) {
+	lines := []Line{
+		D("text"),
+		Label("f"),
+		I(Movl, Int(4), EAX),
+		I(Ret),
+	}
+
+	w := &bytes.Buffer{}
+	require.NoError(t, Print(w, ATT, lines))
+	require.Equal(t, "\t.text\nf:\nmovl $4, %eax\nret\n", w.String())
+
+	w.Reset()
+	require.NoError(t, Print(w, Intel, lines))
+	require.Equal(t, "\t.intel_syntax noprefix\n\t.text\nf:\nmov eax, 4\nret\n", w.String())
+}
+
+func TestNegate(t *testing.T) {
+	for c := E; c <= AE; c++ {
+		require.NotEqual(t, c, c.Negate())
+		require.Equal(t, c, c.Negate().Negate())
+	}
+}
+
+func TestParseSyntax(t *testing.T) {
+	s, err := ParseSyntax("intel")
+	require.NoError(t, err)
+	require.Equal(t, Intel, s)
+
+	_, err = ParseSyntax("masm")
+	require.ErrorContains(t, err, "unknown assembler syntax 'masm'")
+}
+
+// text prints lines in AT&T syntax
+func text(lines []Line) string {
+	w := &bytes.Buffer{}
+	_ = Print(w, ATT, lines)
+	return w.String()
+}
+
+func TestOptimise(t *testing.T) {
+	slot := At(-4, ESP)
+
+	tests := []struct {
+		name     string
+		lines    []Line
+		expected string
+	}{
+		{
+			name:     "load after store",
+			lines:    []Line{I(Movl, EAX, slot), I(Movl, slot, EAX), I(Addl, Int(4), EAX)},
+			expected: "movl %eax, -4(%esp)\naddl $4, %eax\n",
+		},
+		{
+			name:     "load into another register after store",
+			lines:    []Line{I(Movl, EAX, slot), I(Movl, slot, EBX), I(Addl, EBX, EAX)},
+			expected: "movl %eax, -4(%esp)\nmovl %eax, %ebx\naddl %ebx, %eax\n",
+		},
+		{
+			name:     "load after move to a register",
+			lines:    []Line{I(Movl, EAX, ECX), I(Movl, ECX, EAX), I(Ret)},
+			expected: "movl %eax, %ecx\nret\n",
+		},
+		{
+			name:     "move of a register into itself",
+			lines:    []Line{I(Movl, EAX, EAX), I(Movl, EAX, EBX), I(Ret)},
+			expected: "movl %eax, %ebx\nret\n",
+		},
+		{
+			name:     "store after load",
+			lines:    []Line{I(Movl, slot, EAX), I(Movl, EAX, slot), I(Call, Symbol("f"))},
+			expected: "movl -4(%esp), %eax\ncall f\n",
+		},
+		{
+			name:     "store after load through the loaded register",
+			lines:    []Line{I(Movl, At(0, EAX), EAX), I(Movl, EAX, At(0, EAX)), I(Ret)},
+			expected: "movl (%eax), %eax\nmovl %eax, (%eax)\nret\n",
+		},
+		{
+			name:     "overwritten store",
+			lines:    []Line{I(Movl, EAX, Var("x")), I(Movl, Int(4), Var("x")), I(Call, Symbol("f"))},
+			expected: "movl $4, x\ncall f\n",
+		},
+		{
+			name: "reload after test",
+			lines: []Line{
+				I(Movl, slot, EAX), I(Testl, Int(3), EAX), J(NE, "L1"),
+				I(Movl, slot, EAX), I(Addl, Int(8), EAX),
+			},
+			expected: "movl -4(%esp), %eax\ntestl $3, %eax\njne L1\naddl $8, %eax\n",
+		},
+		{
+			name: "reload through a changed base",
+			lines: []Line{
+				I(Movl, At(-1, EAX), EAX), I(Testl, Int(3), EAX), I(Movl, At(-1, EAX), EAX),
+			},
+			expected: "movl -1(%eax), %eax\ntestl $3, %eax\nmovl -1(%eax), %eax\n",
+		},
+		{
+			name:     "store before returning",
+			lines:    []Line{I(Movl, EAX, slot), I(Ret)},
+			expected: "ret\n",
+		},
+		{
+			name: "boolean tested by a jump",
+			lines: []Line{
+				I(Cmpl, slot, EAX),
+				I(Movl, Int(0), EAX), Set(L, AL), I(Sall, Int(7), EAX), I(Orl, Hex(0x1f), EAX),
+				I(Cmpl, Hex(0x1f), EAX), J(E, "L0"),
+			},
+			expected: "cmpl -4(%esp), %eax\njge L0\n",
+		},
+		{
+			name: "boolean stored",
+			lines: []Line{
+				I(Movl, Int(0), EAX), Set(E, AL), I(Sall, Int(7), EAX), I(Orl, Hex(0x1f), EAX),
+				I(Movl, EAX, slot), I(Cmpl, Hex(0x1f), slot), J(E, "L0"),
+			},
+			expected: "movl $0, %eax\nsete %al\nsall $7, %eax\norl $0x1f, %eax\nmovl %eax, -4(%esp)\ncmpl $0x1f, -4(%esp)\nje L0\n",
+		},
+		{
+			name:     "constant shifts",
+			lines:    []Line{I(Movl, Int(168), EAX), I(Sall, Int(6), EAX), I(Orl, Hex(0xf), EAX), I(Ret)},
+			expected: "movl $0x2a0f, %eax\nret\n",
+		},
+		{
+			name:     "constant arithmetic wrapping around",
+			lines:    []Line{I(Movl, Int(0x7ffffffc), EAX), I(Addl, Int(4), EAX), I(Ret)},
+			expected: "movl $-2147483648, %eax\nret\n",
+		},
+		{
+			name:     "constant operation setting tested flags",
+			lines:    []Line{I(Movl, Int(4), EBX), I(Subl, Int(4), EBX), J(E, "L0")},
+			expected: "movl $4, %ebx\nsubl $4, %ebx\nje L0\n",
+		},
+		{
+			name:     "jump to the next line",
+			lines:    []Line{I(Jmp, Symbol("L0")), Label("L0"), I(Ret)},
+			expected: "L0:\nret\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, text(Optimise(tt.lines)))
+		})
+	}
+}
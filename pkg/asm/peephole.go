@@ -0,0 +1,306 @@
+package asm
+
+// Optimise applies peephole rewrites to a program until none applies.
+// Each rule replaces a short run of consecutive instructions by an
+// equivalent one: redundant loads and stores are removed, booleans
+// only tested by a conditional jump are fused into it, operations
+// on constants are folded and jumps to the next line are removed.
+//
+// Optimise relies on a property of the code generated by the compiler:
+// %eax does not hold a value past a conditional jump testing a boolean
+// computed into it.
+func Optimise(lines []Line) []Line {
+	out := append([]Line{}, lines...)
+	for i := 0; i < len(out); {
+		n, ok := rewrite(out, i)
+		if !ok {
+			i++
+			continue
+		}
+		out = n
+		// the replacement may complete a run starting before it
+		i -= maxRuleSize
+		if i < 0 {
+			i = 0
+		}
+	}
+	return out
+}
+
+// rewrite applies the first rule matching the lines at i
+func rewrite(lines []Line, i int) ([]Line, bool) {
+	for _, r := range rules {
+		if i+r.size > len(lines) {
+			continue
+		}
+		ins, ok := instrs(lines[i : i+r.size])
+		if !ok {
+			continue
+		}
+		repl, ok := r.apply(ins, lines[i+r.size:])
+		if !ok {
+			continue
+		}
+		n := make([]Line, 0, len(lines)-r.size+len(repl))
+		n = append(n, lines[:i]...)
+		n = append(n, repl...)
+		return append(n, lines[i+r.size:]...), true
+	}
+	return lines, false
+}
+
+// instrs returns lines as instructions, if they all are
+func instrs(lines []Line) ([]Instr, bool) {
+	ins := make([]Instr, len(lines))
+	for i, l := range lines {
+		in, ok := l.(Instr)
+		if !ok {
+			return nil, false
+		}
+		ins[i] = in
+	}
+	return ins, true
+}
+
+// rule rewrites a run of size instructions, given the lines after them
+type rule struct {
+	size  int
+	apply func(ins []Instr, after []Line) ([]Line, bool)
+}
+
+const maxRuleSize = 6
+
+var rules = []rule{
+	// movl R, R
+	// the register already holds the value
+	{size: 1, apply: func(ins []Instr, _ []Line) ([]Line, bool) {
+		mv := ins[0]
+		if mv.Op != Movl || !isReg(mv.Args[0]) || mv.Args[0] != mv.Args[1] {
+			return nil, false
+		}
+		return []Line{}, true
+	}},
+	// movl R, X; movl X, R2
+	// the value loaded from memory or another register is still in R
+	{size: 2, apply: func(ins []Instr, _ []Line) ([]Line, bool) {
+		st, ld := ins[0], ins[1]
+		if st.Op != Movl || ld.Op != Movl || !isReg(st.Args[0]) || !(isMem(st.Args[1]) || isReg(st.Args[1])) {
+			return nil, false
+		}
+		// a move of a register into itself would be rewritten to itself
+		if st.Args[0] == st.Args[1] {
+			return nil, false
+		}
+		if ld.Args[0] != st.Args[1] || !isReg(ld.Args[1]) {
+			return nil, false
+		}
+		if ld.Args[1] == st.Args[0] {
+			return []Line{st}, true
+		}
+		return []Line{st, I(Movl, st.Args[0], ld.Args[1])}, true
+	}},
+	// movl M, R; movl R, M
+	// the value stored is already in M
+	{size: 2, apply: func(ins []Instr, _ []Line) ([]Line, bool) {
+		ld, st := ins[0], ins[1]
+		if ld.Op != Movl || st.Op != Movl || !isMem(ld.Args[0]) || !isReg(ld.Args[1]) {
+			return nil, false
+		}
+		if st.Args[0] != ld.Args[1] || st.Args[1] != ld.Args[0] {
+			return nil, false
+		}
+		// the address of M must not change when R is loaded
+		m, r := ld.Args[0].(Mem), ld.Args[1].(Reg)
+		if m.Base == r || m.Index == r {
+			return nil, false
+		}
+		return []Line{ld}, true
+	}},
+	// movl X, M; movl Y, M
+	// the first value stored is overwritten before it is read
+	{size: 2, apply: func(ins []Instr, _ []Line) ([]Line, bool) {
+		a, b := ins[0], ins[1]
+		if a.Op != Movl || b.Op != Movl || !isMem(a.Args[1]) || a.Args[1] != b.Args[1] || isMem(b.Args[0]) {
+			return nil, false
+		}
+		return []Line{b}, true
+	}},
+	reload(3),
+	reload(4),
+	// movl X, d(%esp); ret
+	// the stack below the stack pointer is not read after returning
+	{size: 2, apply: func(ins []Instr, _ []Line) ([]Line, bool) {
+		st, ret := ins[0], ins[1]
+		if st.Op != Movl || ret.Op != Ret {
+			return nil, false
+		}
+		m, ok := st.Args[1].(Mem)
+		if !ok || m.Sym != "" || m.Base != ESP || m.Index != NoReg || m.Disp >= 0 {
+			return nil, false
+		}
+		return []Line{ret}, true
+	}},
+	// movl $0, %eax; setcc %al; sall $7, %eax; orl $0x1f, %eax;
+	// cmpl $0x1f, %eax; je L
+	// the jump is taken when the condition does not hold
+	{size: 6, apply: func(ins []Instr, _ []Line) ([]Line, bool) {
+		cond, ok := boolean(ins[:4])
+		if !ok {
+			return nil, false
+		}
+		cmp, j := ins[4], ins[5]
+		if cmp.Op != Cmpl || !isImm(cmp.Args[0], falseValue) || cmp.Args[1] != EAX || j.Op != Jcc {
+			return nil, false
+		}
+		switch j.Cond {
+		case E:
+			return []Line{Instr{Op: Jcc, Cond: cond.Negate(), Args: j.Args}}, true
+		case NE:
+			return []Line{Instr{Op: Jcc, Cond: cond, Args: j.Args}}, true
+		}
+		return nil, false
+	}},
+	// movl $x, R; op $y, R
+	// the result is a constant, provided the flags set by op
+	// are not read
+	{size: 2, apply: func(ins []Instr, after []Line) ([]Line, bool) {
+		mov, in := ins[0], ins[1]
+		if mov.Op != Movl || !isReg(mov.Args[1]) || len(in.Args) != 2 || in.Args[1] != mov.Args[1] {
+			return nil, false
+		}
+		x, ok := mov.Args[0].(Imm)
+		if !ok {
+			return nil, false
+		}
+		y, ok := in.Args[0].(Imm)
+		if !ok {
+			return nil, false
+		}
+		v, ok := fold(in.Op, int32(x.Value), int32(y.Value))
+		if !ok || readsFlags(after) {
+			return nil, false
+		}
+		return []Line{I(Movl, Imm{Value: int(v), Hex: x.Hex || y.Hex}, mov.Args[1])}, true
+	}},
+	// jmp L; L:
+	{size: 1, apply: func(ins []Instr, after []Line) ([]Line, bool) {
+		j := ins[0]
+		if j.Op != Jmp || len(after) == 0 {
+			return nil, false
+		}
+		target, ok := j.Args[0].(Symbol)
+		if !ok {
+			return nil, false
+		}
+		if l, ok := after[0].(Label); ok && string(l) == string(target) {
+			return []Line{}, true
+		}
+		return nil, false
+	}},
+}
+
+// reload returns the rule for runs of size instructions moving
+// between M and R, testing R or M, and loading M into R again.
+// R still holds the value of M, as tests and jumps write neither.
+func reload(size int) rule {
+	return rule{size: size, apply: func(ins []Instr, _ []Line) ([]Line, bool) {
+		first, last := ins[0], ins[size-1]
+		if first.Op != Movl || last.Op != Movl || !isMem(last.Args[0]) || !isReg(last.Args[1]) {
+			return nil, false
+		}
+		m, r := last.Args[0].(Mem), last.Args[1].(Reg)
+		if !(first.Args[0] == m && first.Args[1] == r) && !(first.Args[0] == r && first.Args[1] == m) {
+			return nil, false
+		}
+		// the address of M must not change when R is loaded
+		if m.Base == r || m.Index == r {
+			return nil, false
+		}
+		for _, in := range ins[1 : size-1] {
+			if in.Op != Cmpl && in.Op != Testl && in.Op != Jcc {
+				return nil, false
+			}
+		}
+		lines := make([]Line, 0, size-1)
+		for _, in := range ins[:size-1] {
+			lines = append(lines, in)
+		}
+		return lines, true
+	}}
+}
+
+// falseValue is the tagged representation of #f
+const falseValue = 0x1f
+
+// boolean returns the condition turned into a boolean in %eax by the
+// instructions movl $0, %eax; setcc %al; sall $7, %eax; orl $0x1f, %eax
+func boolean(ins []Instr) (Cond, bool) {
+	if ins[0].Op != Movl || !isImm(ins[0].Args[0], 0) || ins[0].Args[1] != EAX {
+		return 0, false
+	}
+	if ins[1].Op != Setcc || ins[1].Args[0] != AL {
+		return 0, false
+	}
+	if ins[2].Op != Sall || !isImm(ins[2].Args[0], 7) || ins[2].Args[1] != EAX {
+		return 0, false
+	}
+	if ins[3].Op != Orl || !isImm(ins[3].Args[0], falseValue) || ins[3].Args[1] != EAX {
+		return 0, false
+	}
+	return ins[1].Cond, true
+}
+
+// fold returns the value of a register holding x after
+// applying op with the immediate operand y
+func fold(op Op, x, y int32) (int32, bool) {
+	switch op {
+	case Addl:
+		return x + y, true
+	case Subl:
+		return x - y, true
+	case Andl:
+		return x & y, true
+	case Orl:
+		return x | y, true
+	case Sall:
+		return x << (y & 31), true
+	case Sarl:
+		return x >> (y & 31), true
+	}
+	return 0, false
+}
+
+// readsFlags reports whether the flags may be read by the
+// lines before being set again. Labels and jumps are
+// assumed to read them, as their other paths are unknown.
+func readsFlags(lines []Line) bool {
+	for _, l := range lines {
+		in, ok := l.(Instr)
+		if !ok {
+			return true
+		}
+		switch in.Op {
+		case Jcc, Setcc, Jmp:
+			return true
+		case Addl, Subl, Andl, Orl, Orb, Sall, Sarl, Negl, Decl, Cmpl, Testl, Call, Ret:
+			return false
+		}
+	}
+	return false
+}
+
+func isReg(o Operand) bool {
+	_, ok := o.(Reg)
+	return ok
+}
+
+func isMem(o Operand) bool {
+	_, ok := o.(Mem)
+	return ok
+}
+
+// isImm reports whether o is the immediate value x
+func isImm(o Operand, x int) bool {
+	i, ok := o.(Imm)
+	return ok && i.Value == x
+}
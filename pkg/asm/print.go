@@ -0,0 +1,207 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Syntax is the syntax programs are printed in
+type Syntax int
+
+const (
+	ATT Syntax = iota
+	Intel
+)
+
+func (s Syntax) String() string {
+	if s == Intel {
+		return "intel"
+	}
+	return "att"
+}
+
+// ParseSyntax returns the syntax with the given name, att or intel
+func ParseSyntax(name string) (Syntax, error) {
+	switch name {
+	case "att":
+		return ATT, nil
+	case "intel":
+		return Intel, nil
+	}
+	return ATT, fmt.Errorf("unknown assembler syntax '%s', expected att or intel", name)
+}
+
+// Print writes a program in the given syntax, one line at a time
+func Print(w io.Writer, syntax Syntax, lines []Line) error {
+	if syntax == Intel {
+		if _, err := fmt.Fprintln(w, "\t.intel_syntax noprefix"); err != nil {
+			return err
+		}
+	}
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, Format(l, syntax)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Format returns the text of a line in the given syntax
+func Format(l Line, syntax Syntax) string {
+	switch l := l.(type) {
+	case Instr:
+		if syntax == Intel {
+			return l.intel()
+		}
+		return l.att()
+	case Label:
+		return string(l) + ":"
+	case Directive:
+		if len(l.Args) == 0 {
+			return "\t." + l.Name
+		}
+		return "\t." + l.Name + "\t" + strings.Join(l.Args, ", ")
+	default:
+		return fmt.Sprintf("unknown line %v", l)
+	}
+}
+
+func (in Instr) String() string {
+	return in.att()
+}
+
+func (in Instr) mnemonic(syntax Syntax) string {
+	m := mnemonics[in.Op][syntax]
+	if in.Op == Jcc || in.Op == Setcc {
+		m += in.Cond.String()
+	}
+	return m
+}
+
+// indirect reports whether the operand of the instruction
+// holds the address it transfers control to
+func (in Instr) indirect(o Operand) bool {
+	if in.Op != Call && in.Op != Jmp {
+		return false
+	}
+	_, ok := o.(Symbol)
+	return !ok
+}
+
+func (in Instr) att() string {
+	args := make([]string, 0, len(in.Args))
+	for _, o := range in.Args {
+		s := attOperand(o)
+		if in.indirect(o) {
+			s = "*" + s
+		}
+		args = append(args, s)
+	}
+	if len(args) == 0 {
+		return in.mnemonic(ATT)
+	}
+	return in.mnemonic(ATT) + " " + strings.Join(args, ", ")
+}
+
+func attOperand(o Operand) string {
+	switch o := o.(type) {
+	case Reg:
+		return "%" + o.String()
+	case Imm:
+		return "$" + o.String()
+	case Addr:
+		return "$" + string(o)
+	case Symbol:
+		return string(o)
+	case Mem:
+		var s string
+		switch {
+		case o.Sym != "" && o.Disp != 0:
+			s = fmt.Sprintf("%s%+d", o.Sym, o.Disp)
+		case o.Sym != "":
+			s = o.Sym
+		case o.Disp != 0 || (o.Base == NoReg && o.Index == NoReg):
+			s = fmt.Sprintf("%d", o.Disp)
+		}
+		if o.Index != NoReg && o.Scale == 1 {
+			return fmt.Sprintf("%s(%%%s,%%%s)", s, o.Base, o.Index)
+		}
+		if o.Index != NoReg {
+			return fmt.Sprintf("%s(%%%s,%%%s,%d)", s, o.Base, o.Index, o.Scale)
+		}
+		if o.Base != NoReg {
+			return fmt.Sprintf("%s(%%%s)", s, o.Base)
+		}
+		return s
+	default:
+		return fmt.Sprintf("unknown operand %v", o)
+	}
+}
+
+func (i Imm) String() string {
+	if i.Hex {
+		return fmt.Sprintf("%#x", i.Value)
+	}
+	return fmt.Sprintf("%d", i.Value)
+}
+
+func (in Instr) intel() string {
+	args := make([]string, 0, len(in.Args))
+	// Intel syntax gives the destination first
+	for i := len(in.Args) - 1; i >= 0; i-- {
+		args = append(args, intelOperand(in.Args[i], in.size(i)))
+	}
+	if len(args) == 0 {
+		return in.mnemonic(Intel)
+	}
+	return in.mnemonic(Intel) + " " + strings.Join(args, ", ")
+}
+
+// size returns the size of the memory operand at index i,
+// as written in Intel syntax
+func (in Instr) size(i int) string {
+	switch {
+	case in.Op == Leal:
+		return ""
+	case in.Op == Orb || in.Op == Setcc || (in.Op == Movzbl && i == 0):
+		return "byte ptr "
+	}
+	return "dword ptr "
+}
+
+func intelOperand(o Operand, size string) string {
+	switch o := o.(type) {
+	case Reg:
+		return o.String()
+	case Imm:
+		return o.String()
+	case Addr:
+		return "offset " + string(o)
+	case Symbol:
+		return string(o)
+	case Mem:
+		parts := []string{}
+		if o.Sym != "" {
+			parts = append(parts, o.Sym)
+		}
+		if o.Base != NoReg {
+			parts = append(parts, o.Base.String())
+		}
+		if o.Index != NoReg && o.Scale == 1 {
+			parts = append(parts, o.Index.String())
+		} else if o.Index != NoReg {
+			parts = append(parts, fmt.Sprintf("%s*%d", o.Index, o.Scale))
+		}
+		s := strings.Join(parts, "+")
+		switch {
+		case s == "":
+			s = fmt.Sprintf("%d", o.Disp)
+		case o.Disp != 0:
+			s += fmt.Sprintf("%+d", o.Disp)
+		}
+		return size + "[" + s + "]"
+	default:
+		return fmt.Sprintf("unknown operand %v", o)
+	}
+}
@@ -1,575 +1,297 @@
 package compiler
 
 import (
-	"fmt"
-
-	"github.com/brenoafb/tinycompiler/pkg/expr"
+	"github.com/brenoafb/tinycompiler/pkg/asm"
+	"github.com/brenoafb/tinycompiler/pkg/ir"
 )
 
-type builtin func(c *Compiler, elems []expr.E) error
+// primitive emits the code of a primitive operation,
+// leaving its result in %eax
+type primitive func(c *Compiler, args []ir.Value)
 
-var builtins map[string]builtin
+var primitives map[string]primitive
 
 func init() {
-	builtins = map[string]builtin{
-		// special forms
-		"progn": func(c *Compiler, elems []expr.E) error {
-			for i, expr := range elems[1:] {
-				err := c.compileExpr(expr)
-				if err != nil {
-					return fmt.Errorf(
-						"error compiling progn expression at index %d: %w",
-						i,
-						err,
-					)
-				}
-			}
-			return nil
+	primitives = map[string]primitive{
+		"add1": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyFull, "add1", fixnumType, args[0])
+			c.ins(asm.Addl, asm.Int(4), asm.EAX)
 		},
-		"define": func(c *Compiler, elems []expr.E) error {
-			return fmt.Errorf("'define' is not supported")
+		"+": func(c *Compiler, args []ir.Value) {
+			c.checkOperands(SafetyFull, "+", fixnumType, args...)
+			c.load(args[0], asm.EAX)
+			c.ins(asm.Addl, c.operand(args[1]), asm.EAX)
 		},
-		"let": func(c *Compiler, elems []expr.E) error {
-			// (let <bindings...> <body>)
-			if len(elems) < 3 {
-				panic("invalid let form")
-			}
-			si := c.si
-			bindings := elems[1 : len(elems)-1]
-			body := elems[len(elems)-1]
-
-			// each binding has form
-			// (<variable> <body>)
-			for i, binding := range bindings {
-				if binding.Typ != expr.ExprList && binding.Typ != expr.ExprNil {
-					return fmt.Errorf(
-						"error compiling let binding: element at index %d is not list",
-						i,
-					)
-				}
-				xs := binding.List
-				if xs[0].Typ != expr.ExprIdent {
-					return fmt.Errorf(
-						"error compiling let binding: variable at index %d is not identifier",
-
-						i,
-					)
-				}
-				v := xs[0].Ident
-				b := xs[1]
-				err := c.compileExpr(b)
-				if err != nil {
-					return fmt.Errorf("error compiling let binding: %w", err)
-				}
-				idx := c.si
-				c.push()
-				c.env[v] = location{
-					location: stack,
-					offset:   idx,
-				}
-			}
-
-			err := c.compileExpr(body)
-			if err != nil {
-				return fmt.Errorf("error compiling let binding body: %w", err)
-			}
-
-			c.si = si
-
-			return nil
+		"-": func(c *Compiler, args []ir.Value) {
+			c.checkOperands(SafetyFull, "-", fixnumType, args...)
+			c.load(args[0], asm.EAX)
+			c.ins(asm.Subl, c.operand(args[1]), asm.EAX)
 		},
-
-		"if": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 4 {
-				return fmt.Errorf("malformed 'if' expression")
-			}
-			test := elems[1]
-			conseq := elems[2]
-			alt := elems[3]
-
-			l0 := c.genLabel()
-			l1 := c.genLabel()
-
-			err := c.compileExpr(test)
-			if err != nil {
-				return fmt.Errorf("error compiling test in if expression: %w", err)
-			}
-			c.emit("cmpl $0x%x, %%eax", immFalse)
-			c.emit("je %s", l0)
-
-			err = c.compileExpr(conseq)
-			if err != nil {
-				return fmt.Errorf("error compiling conseq in if expression: %w", err)
-			}
-
-			c.emit("jmp %s", l1)
-			c.emit("%s:", l0)
-
-			err = c.compileExpr(alt)
-			if err != nil {
-				return fmt.Errorf("error compiling alt in if expression: %w", err)
-			}
-
-			c.emit("%s:", l1)
-
-			return nil
+		"zero?": func(c *Compiler, args []ir.Value) {
+			c.compare(args[0], ir.Imm(0), asm.E)
 		},
-		"code": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 4 {
-				return fmt.Errorf("'code' form must contain 3 parameters")
-			}
-
-			if elems[1].Typ != expr.ExprList && elems[1].Typ != expr.ExprNil {
-				return fmt.Errorf("malformed 'code' form")
-			}
-
-			arglist := elems[1].List
-
-			if elems[2].Typ != expr.ExprList && elems[2].Typ != expr.ExprNil {
-				return fmt.Errorf("malformed 'code' form")
-			}
-
-			freevars := elems[2].List
-			body := elems[3]
-
-			// assign stack location for each argument
-			for i, arg := range arglist {
-				if arg.Typ != expr.ExprIdent {
-					return fmt.Errorf("malformed 'code' form")
-				}
-				c.env[arg.Ident] = location{
-					location: stack,
-					offset:   -wordsize * (i + 1),
-				}
-			}
-
-			// adjust the stack so that we point on top
-			// of the arguments
-			c.si = -wordsize * (len(arglist) + 1)
-
-			// assign closure location for each free variable
-			for i, arg := range freevars {
-				if arg.Typ != expr.ExprIdent {
-					return fmt.Errorf("malformed 'code' form")
-				}
-				c.env[arg.Ident] = location{
-					location: closure,
-					offset:   wordsize * (i + 1),
-				}
-			}
-
-			err := c.compileExpr(body)
-			if err != nil {
-				return fmt.Errorf("error compiling body in 'code' form: %w", err)
-			}
-
-			c.emit("ret")
-			c.clearEnv()
-			c.si = -wordsize
-			return nil
+		"eq?": func(c *Compiler, args []ir.Value) {
+			c.compare(args[0], args[1], asm.E)
 		},
-
-		"labelcall": func(c *Compiler, elems []expr.E) error {
-			if len(elems) < 2 {
-				return fmt.Errorf("labelcall form must contain at least 1 parameter")
-			}
-
-			if elems[1].Typ != expr.ExprIdent {
-				return fmt.Errorf("malformed 'labelcall' form")
-			}
-
-			l := elems[1].Ident
-			spSlot := c.si + wordsize
-			siBefore := c.si
-			// skip one slot for the return address
-			c.si -= wordsize
-			for i, arg := range elems[2:] {
-				err := c.compileExpr(arg)
-				if err != nil {
-					return fmt.Errorf("error compiling argument at index %d in labelcall: %w", i, err)
-				}
-				c.push()
-			}
-			// handle call and return
-			// call subtracts wordsize from esp, so we need to adjust it first
-			// to make sure we don't overwrite local variables
-			c.emit("addl $%d, %%esp", spSlot)
-			c.emit("call %s", l)
-			// restore esp
-			c.emit("addl $%d, %%esp", -spSlot)
-			c.si = siBefore
-
-			return nil
+		"null?": func(c *Compiler, args []ir.Value) {
+			c.compare(args[0], ir.Imm(emptyList), asm.E)
 		},
-
-		"funcall": func(c *Compiler, elems []expr.E) error {
-			if len(elems) < 2 {
-				return fmt.Errorf("funcall form must contain at least 1 parameter")
-			}
-
-			f := elems[1]
-
-			spSlot := c.si
-			siBefore := c.si
-			// skip two slots for the return address and closure pointer
-			c.si -= 2 * wordsize
-			for i, arg := range elems[2:] {
-				err := c.compileExpr(arg)
-				if err != nil {
-					return fmt.Errorf("error compiling argument at index %d in funcall: %w", i, err)
-				}
-				c.push()
-			}
-
-			// save closure pointer
-			c.emit("movl %%edi, %d(%%esp)", siBefore)
-
-			err := c.compileExpr(f)
-			if err != nil {
-				return fmt.Errorf("error compiling function in funcall: %w", err)
-			}
-
-			// move new closure into closure pointer
-			c.emit("movl %%eax, %%edi")
-			// clear tag
-			c.emit("andl $-8, %%edi")
-
-			// handle call and return
-			c.emit("movl 0(%%edi), %%ebx")
-			c.emit("addl $%d, %%esp", spSlot)
-			c.emit("call *%%ebx")
-			c.emit("addl $%d, %%esp", -spSlot)
-			c.si = siBefore
-
-			return nil
+		"eof-object?": func(c *Compiler, args []ir.Value) {
+			c.compare(args[0], ir.Imm(eofObject), asm.E)
 		},
+		"port?":         typePredicate(portType),
+		"error-object?": typePredicate(errorType),
 
-		"closure": func(c *Compiler, elems []expr.E) error {
-			if len(elems) < 2 {
-				return fmt.Errorf("closure form must contain at least 1 parameter")
-			}
-
-			if elems[1].Typ != expr.ExprIdent {
-				return fmt.Errorf("malformed 'closure' form")
-			}
-
-			l := elems[1].Ident
-			c.emit("movl $%s, 0(%%esi)", l)
-			for i, freevar := range elems[2:] {
-				// TODO copy free variable value directly instead
-				// of moving to eax then to heap
-				err := c.compileExpr(freevar)
-				if err != nil {
-					return fmt.Errorf(
-						"error compiling free variable in closure form at index %d: %w",
-						i,
-						err,
-					)
-				}
-
-				c.emit("movl %%eax, %d(%%esi)", wordsize*(i+1))
-			}
-
-			length := len(elems) - 1
-
-			c.emit("movl $%d, %%ebx", length)
-			// eax = esi | 6
-			c.emit("movl %%esi, %%eax")
-			c.emit("orl $6, %%eax") // 6 = closure tag
-			// align size to next object boundary
-			c.emit("addl $11, %%ebx")
-			c.emit("andl $-8, %%ebx")
-			// advance alloc ptr
-			c.emit("addl %%ebx, %%esi")
-			return nil
+		"integer->char": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyFull, "integer->char", fixnumType, args[0])
+			c.ins(asm.Sall, asm.Int(charShift-fixnumShift), asm.EAX)
+			c.ins(asm.Orl, asm.Hex(charTag), asm.EAX)
 		},
-		"lambda": func(c *Compiler, elems []expr.E) error {
-			// 'lambda' shoudln't show up in preprocessed code,
-			// but we leave it here so that variable capture
-			// analysis is performed correctly
-			return fmt.Errorf("lambda is not implemented")
-		},
-		// built in functions
-		// TODO add string support e.g. (string s1)
-		"string-ref": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 2 {
-				return fmt.Errorf("string-ref: must have one argument")
-			}
-			if elems[1].Typ != expr.ExprIdent {
-				return fmt.Errorf("string-ref: argument must be label")
-			}
-			label := elems[1].Ident
-			c.emit("movl $%s, %%eax", label)
-			// TODO push to heap and align esi pointer
-			// see make-vector for reference
-			// TODO set the length as the first word
-			// tag with a string tag
-
-			// eax = esi | 3
-			c.emit("orl $3, %%eax") // 2 = string tag
-			return nil
+		"char->integer": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyFull, "char->integer", charType, args[0])
+			c.ins(asm.Sarl, asm.Int(charShift-fixnumShift), asm.EAX)
 		},
-		"string-init": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 2 {
-				return fmt.Errorf("string-init: must have one argument")
-			}
-			if elems[1].Typ != expr.ExprString {
-				return fmt.Errorf("string-init: argument must be string")
-			}
 
-			// output the string as is for now
-			c.emit(".ascii \"%s\"", elems[1].Str)
-			return nil
+		// characters are compared in their tagged representation,
+		// which preserves their order
+		"char=?":  charCompare("char=?", asm.E),
+		"char<?":  charCompare("char<?", asm.L),
+		"char>?":  charCompare("char>?", asm.G),
+		"char<=?": charCompare("char<=?", asm.LE),
+		"char>=?": charCompare("char>=?", asm.GE),
+
+		"char-upcase":   charCaseConversion("char-upcase", 'a', 'z', -0x20),
+		"char-downcase": charCaseConversion("char-downcase", 'A', 'Z', 0x20),
+
+		"char-alphabetic?": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyFull, "char-alphabetic?", charType, args[0])
+			// fold to lower case, then check the range
+			c.ins(asm.Orl, asm.Hex(0x20<<charShift), asm.EAX)
+			c.charRangeTest('a', 'z')
+			c.setBool(asm.BE)
 		},
-		"add1": func(c *Compiler, elems []expr.E) error {
-			x := elems[1]
-			err := c.compileExpr(x)
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "add1", err)
-			}
-			c.emit("addl $4, %%eax")
-			return nil
+		"char-numeric?": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyFull, "char-numeric?", charType, args[0])
+			c.charRangeTest('0', '9')
+			c.setBool(asm.BE)
 		},
-		"ccall": func(c *Compiler, elems []expr.E) error {
-			if len(elems) < 2{
-				return fmt.Errorf("ccall must have at least one argument")
-			}
-			return fmt.Errorf("ccall: not implemented")
+		"char-whitespace?": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyFull, "char-whitespace?", charType, args[0])
+			// space, or one of \t \n \v \f \r
+			c.ins(asm.Cmpl, asm.Hex(charValue(' ')), asm.EAX)
+			c.emit(asm.Set(asm.E, asm.DL))
+			c.charRangeTest('\t', '\r')
+			c.emit(asm.Set(asm.BE, asm.AL))
+			c.ins(asm.Orb, asm.DL, asm.AL)
+			c.ins(asm.Movzbl, asm.AL, asm.EAX)
+			c.ins(asm.Sall, asm.Int(7), asm.EAX)
+			c.ins(asm.Orl, asm.Hex(boolTag), asm.EAX)
 		},
-		"integer->char": func(c *Compiler, elems []expr.E) error {
-			x := elems[1]
-			err := c.compileExpr(x)
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "integer->char", err)
-			}
-			c.emit("sall $%d, %%eax", charShift-fixnumShift)
-			c.emit("orl $0x%x, %%eax", charTag)
-			return nil
-		},
-		"char->integer": func(c *Compiler, elems []expr.E) error {
-			x := elems[1]
-			err := c.compileExpr(x)
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "char->integer", err)
-			}
-			c.emit("sarl $%d, %%eax", charShift-fixnumShift)
-			return nil
-		},
-
-		"null?": func(c *Compiler, elems []expr.E) error {
-			x := elems[1]
-			err := c.compileExpr(x)
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "zero?", err)
-			}
-			c.emit("cmpl $0x%x, %%eax", emptyList)
-			c.emit("movl $0, %%eax")
-			c.emit("sete %%al")
-			c.emit("sall $7, %%eax")
-			c.emit("orl $0x%x, %%eax", boolTag)
 
-			return nil
+		"cons": func(c *Compiler, args []ir.Value) {
+			c.put(args[0], asm.At(0, asm.ESI))
+			c.put(args[1], asm.At(wordsize, asm.ESI))
+			c.allocate(pairType.tag, 2*wordsize)
 		},
-		"zero?": func(c *Compiler, elems []expr.E) error {
-			x := elems[1]
-			err := c.compileExpr(x)
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "zero?", err)
-			}
-			c.emit("cmpl $0, %%eax")
-			c.emit("movl $0, %%eax")
-			c.emit("sete %%al")
-			c.emit("sall $7, %%eax")
-			c.emit("orl $0x%x, %%eax", boolTag)
-
-			return nil
+		"car": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyMemory, "car", pairType, args[0])
+			c.ins(asm.Movl, asm.At(-1, asm.EAX), asm.EAX)
 		},
-		"+": func(c *Compiler, elems []expr.E) error {
-			x := elems[1]
-			y := elems[2]
-			err := c.compileExpr(y)
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "+", err)
-			}
-			c.push()
-			err = c.compileExpr(x)
-			c.si += wordsize
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "+", err)
-			}
-			c.emit("addl %d(%%esp), %%eax", c.si)
-
-			return nil
+		"cdr": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyMemory, "cdr", pairType, args[0])
+			c.ins(asm.Movl, asm.At(wordsize-1, asm.EAX), asm.EAX)
 		},
-		"-": func(c *Compiler, elems []expr.E) error {
-			x := elems[1]
-			y := elems[2]
-			err := c.compileExpr(y)
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "+", err)
-			}
-			c.push()
-			err = c.compileExpr(x)
-			c.si += wordsize
-			if err != nil {
-				return fmt.Errorf("error compiling '%s' application: %w", "+", err)
-			}
-			c.emit("subl %d(%%esp), %%eax", c.si)
-
-			return nil
+		"set-car!": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyMemory, "set-car!", pairType, args[0])
+			c.ins(asm.Movl, asm.EAX, asm.EBX)
+			c.load(args[1], asm.EAX)
+			c.ins(asm.Movl, asm.EAX, asm.At(-1, asm.EBX))
+			c.ins(asm.Movl, asm.EBX, asm.EAX)
 		},
-
-		"cons": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 3 {
-				return fmt.Errorf("malformed cons expression")
-			}
-			x := elems[1]
-			y := elems[2]
-
-			err := c.compileExpr(x)
-			if err != nil {
-				return fmt.Errorf("error compiling cons expression: %w", err)
-			}
-			c.emit("movl %%eax, %d(%%esi)", 0*wordsize)
-
-			err = c.compileExpr(y)
-			if err != nil {
-				return fmt.Errorf("error compiling cons expression: %w", err)
-			}
-			c.emit("movl %%eax, %d(%%esi)", 1*wordsize)
-
-			c.emit("movl %%esi, %%eax")
-			c.emit("orl $1, %%eax")
-
-			c.emit("addl $%d, %%esi", 2*wordsize)
-
-			return nil
+		"set-cdr!": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyMemory, "set-cdr!", pairType, args[0])
+			c.ins(asm.Movl, asm.EAX, asm.EBX)
+			c.load(args[1], asm.EAX)
+			c.ins(asm.Movl, asm.EAX, asm.At(wordsize-1, asm.EBX))
+			c.ins(asm.Movl, asm.EBX, asm.EAX)
 		},
 
-		"car": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 2 {
-				return fmt.Errorf("malformed car expression")
-			}
-			err := c.compileExpr(elems[1])
-			if err != nil {
-				return fmt.Errorf("error compiling car expression: %w", err)
-			}
-
-			c.emit("movl -1(%%eax), %%eax")
-			return nil
+		// boxes are used by the preprocessor to implement letrec*
+		// they are represented as pairs with an empty cdr
+		"box": func(c *Compiler, args []ir.Value) {
+			c.put(args[0], asm.At(0, asm.ESI))
+			c.put(ir.Imm(emptyList), asm.At(wordsize, asm.ESI))
+			c.allocate(pairType.tag, 2*wordsize)
 		},
-
-		"cdr": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 2 {
-				return fmt.Errorf("malformed cdr expression")
-			}
-			err := c.compileExpr(elems[1])
-			if err != nil {
-				return fmt.Errorf("error compiling car expression: %w", err)
-			}
-
-			c.emit("movl %d(%%eax), %%eax", wordsize-1)
-			return nil
+		"unbox": func(c *Compiler, args []ir.Value) {
+			c.load(args[0], asm.EAX)
+			c.ins(asm.Movl, asm.At(-1, asm.EAX), asm.EAX)
+		},
+		"set-box!": func(c *Compiler, args []ir.Value) {
+			c.load(args[0], asm.EBX)
+			c.load(args[1], asm.EAX)
+			c.ins(asm.Movl, asm.EAX, asm.At(-1, asm.EBX))
 		},
 
-		"make-vector": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 2 {
-				return fmt.Errorf("malformed make-vector expression")
-			}
-
-			err := c.compileExpr(elems[1])
-
-			if err != nil {
-				return fmt.Errorf("error compiling make-vector call: %w", err)
-			}
-
+		"make-vector": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyMemory, "make-vector", fixnumType, args[0])
 			// set length
-			c.emit("movl %%eax, 0(%%esi)")
+			c.ins(asm.Movl, asm.EAX, asm.At(0, asm.ESI))
 			// save length
-			c.emit("movl %%eax, %%ebx")
+			c.ins(asm.Movl, asm.EAX, asm.EBX)
 			// eax = esi | 2
-			c.emit("movl %%esi, %%eax")
-			c.emit("orl $2, %%eax") // 2 = vector tag
+			c.ins(asm.Movl, asm.ESI, asm.EAX)
+			c.ins(asm.Orl, asm.Int(vectorType.tag), asm.EAX)
 			// align size to next object boundary
-			c.emit("addl $11, %%ebx")
-			c.emit("andl $-8, %%ebx")
+			c.ins(asm.Addl, asm.Int(11), asm.EBX)
+			c.ins(asm.Andl, asm.Int(-8), asm.EBX)
 			// advance alloc ptr
-			c.emit("addl %%ebx, %%esi")
-			return nil
+			c.ins(asm.Addl, asm.EBX, asm.ESI)
 		},
-
-		"vector-ref": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 3 {
-				return fmt.Errorf("vector-ref requires 2 parameters")
-			}
-
-			vector := elems[1]
-			idx := elems[2]
-
-			err := c.compileExpr(vector)
-			if err != nil {
-				return fmt.Errorf("error compiling vector expr in vector-ref call: %w", err)
-			}
-
-			// save vector ptr
-			vectorIdx := c.si
-			c.push()
-
-			err = c.compileExpr(idx)
-			if err != nil {
-				return fmt.Errorf("error compiling index expr in vector-ref call: %w", err)
+		"vector": func(c *Compiler, args []ir.Value) {
+			c.ins(asm.Movl, asm.Int(len(args)<<fixnumShift), asm.At(0, asm.ESI))
+			for i, v := range args {
+				c.put(v, asm.At(wordsize*(i+1), asm.ESI))
 			}
-
-			c.emit("addl $1, %%eax")
-			c.emit("movl %d(%%esp), %%ebx", vectorIdx)
-			c.emit("addl %%ebx, %%eax")
-			c.emit("movl 0(%%eax), %%eax")
-
-			return nil
+			c.allocate(vectorType.tag, wordsize*(len(args)+1))
+		},
+		"vector-ref": func(c *Compiler, args []ir.Value) {
+			c.checkVectorIndex("vector-ref", args[0], args[1])
+			// elements follow the length word, and the index,
+			// a fixnum, is also their offset
+			c.load(args[1], asm.EAX)
+			c.load(args[0], asm.EBX)
+			c.ins(asm.Movl, asm.Indexed(wordsize-vectorType.tag, asm.EBX, asm.EAX, 1), asm.EAX)
+		},
+		"vector-set!": func(c *Compiler, args []ir.Value) {
+			c.checkVectorIndex("vector-set!", args[0], args[1])
+			// compute destination pointer
+			c.load(args[1], asm.EBX)
+			c.ins(asm.Addl, c.operand(args[0]), asm.EBX)
+			c.load(args[2], asm.EAX)
+			c.ins(asm.Movl, asm.EAX, asm.At(wordsize-vectorType.tag, asm.EBX))
+			c.load(args[0], asm.EAX)
+		},
+		"vector-length": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyMemory, "vector-length", vectorType, args[0])
+			// the length is stored as a fixnum
+			c.ins(asm.Movl, asm.At(-vectorType.tag, asm.EAX), asm.EAX)
+		},
+		"vector-fill!": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyMemory, "vector-fill!", vectorType, args[0])
+			c.ins(asm.Movl, asm.EAX, asm.EBX)
+			c.load(args[1], asm.EAX)
+
+			loop := c.genLabel()
+			done := c.genLabel()
+
+			// ecx = remaining elements * wordsize
+			c.ins(asm.Movl, asm.At(-vectorType.tag, asm.EBX), asm.ECX)
+			c.emit(asm.Label(loop))
+			c.ins(asm.Testl, asm.ECX, asm.ECX)
+			c.emit(asm.J(asm.E, done))
+			c.ins(asm.Movl, asm.EAX, asm.Indexed(-vectorType.tag, asm.EBX, asm.ECX, 1))
+			c.ins(asm.Subl, asm.Int(wordsize), asm.ECX)
+			c.ins(asm.Jmp, asm.Symbol(loop))
+			c.emit(asm.Label(done))
+			c.ins(asm.Movl, asm.EBX, asm.EAX)
+		},
+		"vector->list": func(c *Compiler, args []ir.Value) {
+			c.loadChecked(SafetyMemory, "vector->list", vectorType, args[0])
+
+			loop := c.genLabel()
+			done := c.genLabel()
+
+			c.ins(asm.Movl, asm.EAX, asm.EBX)
+			// ecx = remaining elements * wordsize
+			c.ins(asm.Movl, asm.At(-vectorType.tag, asm.EBX), asm.ECX)
+			c.ins(asm.Movl, asm.Hex(emptyList), asm.EAX)
+			// cons the elements from last to first
+			c.emit(asm.Label(loop))
+			c.ins(asm.Testl, asm.ECX, asm.ECX)
+			c.emit(asm.J(asm.E, done))
+			c.ins(asm.Movl, asm.Indexed(-vectorType.tag, asm.EBX, asm.ECX, 1), asm.EDX)
+			c.ins(asm.Movl, asm.EDX, asm.At(0, asm.ESI))
+			c.ins(asm.Movl, asm.EAX, asm.At(wordsize, asm.ESI))
+			c.ins(asm.Movl, asm.ESI, asm.EAX)
+			c.ins(asm.Orl, asm.Int(1), asm.EAX)
+			c.ins(asm.Addl, asm.Int(2*wordsize), asm.ESI)
+			c.ins(asm.Subl, asm.Int(wordsize), asm.ECX)
+			c.ins(asm.Jmp, asm.Symbol(loop))
+			c.emit(asm.Label(done))
 		},
 
-		"vector-set!": func(c *Compiler, elems []expr.E) error {
-			if len(elems) != 4 {
-				return fmt.Errorf("vector-set requires 3 parameters")
-			}
-
-			vector := elems[1]
-			idx := elems[2]
-			obj := elems[3]
-
-			err := c.compileExpr(vector)
-			if err != nil {
-				return fmt.Errorf("error compiling vector expr in vector-set! call: %w", err)
-			}
-
-			// save vector ptr
-			vectorIdx := c.si
-			c.push()
-
-			err = c.compileExpr(idx)
-			if err != nil {
-				return fmt.Errorf("error compiling index expr in vector-set! call: %w", err)
-			}
+		// console I/O is implemented by the runtime
+		"write-char": runtimeCall("write-char", "lisp_write_char", charType),
+		"display":    runtimeCall("display", "lisp_display", anyType),
+		"write":      runtimeCall("write", "lisp_write", anyType),
+		"newline":    runtimeCall("newline", "lisp_newline"),
+		"read-char":  runtimeCall("read-char", "lisp_read_char"),
+		"peek-char":  runtimeCall("peek-char", "lisp_peek_char"),
+
+		// ports are indices into the port table of the runtime.
+		// Failing operations return an error object.
+		"open-input-file":      runtimeCall("open-input-file", "lisp_open_input_file", stringType),
+		"open-output-file":     runtimeCall("open-output-file", "lisp_open_output_file", stringType),
+		"close-port":           runtimeCall("close-port", "lisp_close_port", portType),
+		"read-line":            runtimeCall("read-line", "lisp_read_line", portType),
+		"write-string":         runtimeCall("write-string", "lisp_write_string", stringType, portType),
+		"error-object-message": runtimeCall("error-object-message", "lisp_error_object_message", errorType),
+
+		"command-line": runtimeCall("command-line", "lisp_command_line"),
+		"exit":         runtimeCall("exit", "lisp_exit", anyType),
+	}
+}
 
-			// save idx
-			idxIdx := c.si
-			c.push()
+// runtimeCall returns a primitive calling the given runtime function,
+// checking that its arguments have the given types
+func runtimeCall(op, routine string, params ...valueType) primitive {
+	return func(c *Compiler, args []ir.Value) {
+		for i, t := range params {
+			if t == anyType {
+				continue
+			}
+			level := SafetyFull
+			if t.mask == 7 {
+				// pointers are dereferenced by the runtime
+				level = SafetyMemory
+			}
+			c.checkOperands(level, op, t, args[i])
+		}
+		c.callRuntime(routine, args...)
+	}
+}
 
-			err = c.compileExpr(obj)
-			if err != nil {
-				return fmt.Errorf("error compiling object expr in vector-set! call: %w", err)
-			}
+// typePredicate returns a primitive checking whether
+// its argument is of the given type
+func typePredicate(t valueType) primitive {
+	return func(c *Compiler, args []ir.Value) {
+		c.load(args[0], asm.EAX)
+		c.ins(asm.Andl, asm.Hex(t.mask), asm.EAX)
+		c.ins(asm.Cmpl, asm.Hex(t.tag), asm.EAX)
+		c.setBool(asm.E)
+	}
+}
 
-			// compute destination pointer
-			c.emit("movl %d(%%esp), %%ebx", idxIdx)
-			c.emit("addl $1, %%ebx")
-			c.emit("addl %d(%%esp), %%ebx", vectorIdx)
-			// move object into slot
-			c.emit("movl %%eax, 0(%%ebx)")
-			// set eax to vector pointer
-			c.emit("movl %d(%%esp), %%eax", vectorIdx)
+// charCompare returns a primitive comparing two characters,
+// setting the result by the given condition
+func charCompare(op string, cond asm.Cond) primitive {
+	return func(c *Compiler, args []ir.Value) {
+		c.checkOperands(SafetyFull, op, charType, args...)
+		c.compare(args[0], args[1], cond)
+	}
+}
 
-			return nil
-		},
+// charCaseConversion returns a primitive adding delta to
+// characters between lo and hi, and leaving others unchanged
+func charCaseConversion(op string, lo, hi rune, delta int) primitive {
+	return func(c *Compiler, args []ir.Value) {
+		c.loadChecked(SafetyFull, op, charType, args[0])
+
+		skip := c.genLabel()
+		c.charRangeTest(lo, hi)
+		c.emit(asm.J(asm.A, skip))
+		c.ins(asm.Addl, asm.Int(delta<<charShift), asm.EAX)
+		c.emit(asm.Label(skip))
 	}
 }
@@ -3,8 +3,12 @@ package compiler
 import (
 	"fmt"
 	"io"
+	"strings"
+	"unicode"
 
+	"github.com/brenoafb/tinycompiler/pkg/asm"
 	"github.com/brenoafb/tinycompiler/pkg/expr"
+	"github.com/brenoafb/tinycompiler/pkg/ir"
 )
 
 const (
@@ -16,307 +20,727 @@ const (
 	boolTag     = 0x1f
 	immFalse    = 0x1f
 	immTrue     = 0x9f
+	eofObject   = 0x3f
+	portShift   = 8
+	portTag     = 0x4f
 	wordsize    = 4
 )
 
 type Compiler struct {
-	W            io.Writer
-	si           int
-	env          map[string]location
-	labelCounter int
-}
-
-type memlocation int
-
-const (
-	stack memlocation = iota
-	closure
-	heap
-)
-
-type location struct {
-	location memlocation
-	offset   int
+	W io.Writer
+	// Safety selects which runtime checks are emitted
+	Safety int
+	// Syntax is the assembler syntax the program is written in
+	Syntax asm.Syntax
+	// Peephole enables the peephole optimiser
+	Peephole bool
+	// Registers enables keeping temporaries in registers
+	Registers bool
+	// Imports holds the procedures exported by other units.
+	// Calls to procedures neither defined by the unit nor imported
+	// are errors, unless Imports is nil, in which case they are
+	// left for the linker to resolve.
+	Imports       map[string]Signature
+	procedures    map[string]Signature
+	labelCounter  int
+	errorRoutines []errorRoutine
+	// the state of the procedure being emitted: the unit
+	// it belongs to and the assembler labels of its labels
+	unit   *ir.Unit
+	proc   *ir.Proc
+	labels map[ir.Label]string
+	// the temporaries only used by the conditional jump or
+	// the return following them, which are left in %eax for it
+	kept map[ir.Temp]bool
+	// the registers holding temporaries, the others
+	// being kept in their slots
+	regs map[ir.Temp]asm.Reg
+	// the program, which is only written out once complete
+	out []asm.Line
 }
 
 func NewCompiler(w io.Writer) *Compiler {
 	return &Compiler{
-		W:   w,
-		si:  -wordsize,
-		env: make(map[string]location),
+		W:         w,
+		Safety:    SafetyFull,
+		Peephole:  true,
+		Registers: true,
 	}
 }
 
+// Compile translates a preprocessed compilation unit into assembly
 func (c *Compiler) Compile(e expr.E) error {
-	// we expect input to have format
-	// (ident (<exported definitions>)
-	//        (<constants>)
-	//        (<internal procedures>)
-	//   <body>)
-	if e.Typ != expr.ExprList {
-		return fmt.Errorf("input is no in expected format")
+	if err := c.validateSafety(); err != nil {
+		return err
 	}
 
-	elems := e.List
+	u, err := c.Lower(e)
+	if err != nil {
+		return err
+	}
 
-	if len(elems) < 5 {
-		return fmt.Errorf("top-level form must contain at least 5 elements")
+	if err := ir.Verify(u); err != nil {
+		return fmt.Errorf("invalid intermediate representation: %w", err)
 	}
 
-	if elems[0].Typ != expr.ExprIdent {
-		// return fmt.Errorf(
-		// 	"malformed top-level form: name is not ident",
-		// )
+	c.emitUnit(u)
+	return c.print()
+}
 
-		panic(fmt.Errorf(
-			"malformed top-level form: name is not ident",
-		))
+// print writes out the program, optimised unless disabled
+func (c *Compiler) print() error {
+	if c.Peephole {
+		c.out = asm.Optimise(c.out)
 	}
+	return asm.Print(c.W, c.Syntax, c.out)
+}
 
-	topLevelName := elems[0].Ident
+// emitUnit emits the data and the code of a unit
+func (c *Compiler) emitUnit(u *ir.Unit) {
+	c.unit = u
+	topLevelName := unitLabel(u.Name)
 
-	if elems[1].Typ != expr.ExprList && elems[1].Typ != expr.ExprNil {
-		return fmt.Errorf(
-			"malformed top-level form: constants entry is not list",
-		)
+	c.emit(asm.D("data"), asm.D("align", "8"))
+
+	for _, d := range u.Data {
+		name := mangle(d.Name)
+		if d.Exported {
+			c.emit(asm.D("global", name))
+		}
+		// constants are tagged pointers
+		c.emit(asm.D("align", "8"), asm.Label(name))
+
+		switch d.Kind {
+		case ir.GlobalData:
+			// set when the unit is initialised
+			c.emit(asm.D("long", "0"))
+		case ir.StringData:
+			// the length as a fixnum followed by the characters,
+			// with a terminating NUL for the runtime.
+			// The assembler interprets escape sequences,
+			// so the length is computed from local labels.
+			c.emit(
+				asm.D("long", fmt.Sprintf("(2f - 1f) << %d", fixnumShift)),
+				asm.Label("1"),
+				asm.D("ascii", fmt.Sprintf("\"%s\"", d.Str)),
+				asm.Label("2"),
+				asm.D("byte", "0"),
+			)
+		}
 	}
 
-	exports := elems[1].List
+	// procedures used as values refer to static closures
+	// unless they capture variables
+	for _, p := range u.Procs {
+		if p.Free > 0 {
+			continue
+		}
+		if p.Exported {
+			c.emit(asm.D("global", closureLabel(mangle(p.Name))))
+		}
+		c.emitStaticClosure(mangle(p.Name))
+	}
 
-	if elems[2].Typ != expr.ExprList && elems[2].Typ != expr.ExprNil {
-		return fmt.Errorf(
-			"malformed top-level form: constants entry is not list",
+	if u.Initialiser {
+		// the runtime calls every unit registered
+		// in this section before the entry point
+		c.emit(
+			asm.D("section", "lisp_init", "\"aw\""),
+			asm.D("align", "4"),
+			asm.D("long", topLevelName),
 		)
 	}
 
-	cvars := elems[2].List
+	c.emit(asm.D("text"), asm.D("p2align", "2"), asm.D("global", topLevelName))
+	for _, p := range u.Procs {
+		if p.Exported {
+			c.emit(asm.D("global", mangle(p.Name)))
+		}
+	}
 
-	if elems[3].Typ != expr.ExprList && elems[3].Typ != expr.ExprNil {
-		return fmt.Errorf(
-			"malformed top-level form: procedures entry is not list",
-		)
+	for _, p := range u.Procs {
+		c.emitProc(p)
 	}
+	c.emitProc(u.Entry)
 
-	lvars := elems[3].List
+	c.emitErrorRoutines()
+}
 
-	c.emit("\t.data")
-	c.emit("\t.align\t8")
+// emitProc emits the label and the code of a procedure
+func (c *Compiler) emitProc(p *ir.Proc) {
+	if p.Entry {
+		c.emit(asm.Label(unitLabel(p.Name)))
+	} else {
+		c.emit(asm.Label(mangle(p.Name)))
+	}
+	c.emitCode(p)
+}
 
-	for i, cvar := range cvars {
-		if cvar.Typ != expr.ExprList && cvar.Typ != expr.ExprNil {
-			return fmt.Errorf(
-				"malformed top-level form: cvar at index %d is not list",
-				i,
-			)
-		}
-		pair := cvar.List
-		if len(pair) != 2 {
-			return fmt.Errorf("bad cvar in label form at index %d", i)
+// emitCode emits the code of a procedure. Its temporaries are kept
+// in registers or in the stack frame, below the return address:
+// those holding the arguments where the caller stored them, and the
+// others after them. Entry points save the registers the C calling
+// convention preserves past their temporaries.
+func (c *Compiler) emitCode(p *ir.Proc) {
+	c.proc = p
+	c.labels = make(map[ir.Label]string)
+	c.kept = make(map[ir.Temp]bool)
+	if c.Peephole {
+		c.kept = keptTemps(p)
+	}
+	c.regs = make(map[ir.Temp]asm.Reg)
+	if c.Registers {
+		c.regs = c.allocateRegisters(p)
+	}
+
+	if p.Entry {
+		for i, r := range calleeSaved {
+			c.ins(asm.Movl, r, asm.At(slot(ir.Temp(p.Temps+i)), asm.ESP))
 		}
+	}
 
-		if pair[0].Typ != expr.ExprIdent {
-			return fmt.Errorf(
-				"malformed '_main' form: identifier at index %d is not identifier",
-				i,
-			)
+	if p.Entry {
+		// the runtime keeps the heap pointer in lisp_heap
+		c.ins(asm.Movl, asm.Var("lisp_heap"), asm.ESI)
+	} else {
+		c.checkArity(p.Params, p.Variadic)
+		if p.Variadic {
+			// the excess arguments are collected into a list
+			// which takes the place of the first one
+			c.collectRest(p.Params)
 		}
+	}
 
-		name := pair[0].Ident
-		cvarBody := pair[1]
+	for t := 0; t < p.ParamTemps(); t++ {
+		if r, ok := c.regs[ir.Temp(t)]; ok {
+			c.ins(asm.Movl, asm.At(slot(ir.Temp(t)), asm.ESP), r)
+		}
+	}
 
-		c.emit("%s:", name)
+	for _, in := range p.Code {
+		c.emitInstr(in)
+	}
+}
 
-		err := c.compileExpr(cvarBody)
-		if err != nil {
-			return fmt.Errorf("error compiling body in _main form: %w", err)
+func (c *Compiler) emitInstr(in ir.Instr) {
+	switch in.Op {
+	case ir.Move:
+		switch dst := c.operand(ir.T(in.Dst)).(type) {
+		case asm.Reg:
+			c.load(in.Args[0], dst)
+		case asm.Mem:
+			c.put(in.Args[0], dst)
+		}
+		return
+	case ir.Prim:
+		primitives[in.Name](c, in.Args)
+	case ir.Call:
+		c.emitCall(in)
+	case ir.CallClosure:
+		c.emitCallClosure(in)
+	case ir.MakeClosure:
+		c.emitClosure(in)
+	case ir.LoadFree:
+		c.ins(asm.Movl, asm.At(wordsize*(in.Index+1), asm.EDI), asm.EAX)
+	case ir.LoadGlobal:
+		c.ins(asm.Movl, asm.Var(mangle(in.Name)), asm.EAX)
+	case ir.StoreGlobal:
+		c.put(in.Args[0], asm.Var(mangle(in.Name)))
+	case ir.Address:
+		c.ins(asm.Movl, asm.Addr(mangle(in.Name)), asm.EAX)
+		c.ins(asm.Orl, asm.Int(in.Index), asm.EAX)
+	case ir.Jump:
+		c.ins(asm.Jmp, asm.Symbol(c.label(in.Target)))
+	case ir.JumpIfFalse:
+		v := in.Args[0]
+		if !v.IsTemp() {
+			// the test is known
+			if v.Imm == immFalse {
+				c.ins(asm.Jmp, asm.Symbol(c.label(in.Target)))
+			}
+			return
+		}
+		if c.kept[v.Temp] {
+			c.ins(asm.Cmpl, asm.Hex(immFalse), asm.EAX)
+		} else {
+			c.ins(asm.Cmpl, asm.Hex(immFalse), c.operand(v))
+		}
+		c.emit(asm.J(asm.E, c.label(in.Target)))
+	case ir.Mark:
+		c.emit(asm.Label(c.label(in.Target)))
+	case ir.Return:
+		if v := in.Args[0]; !v.IsTemp() || !c.kept[v.Temp] {
+			c.load(v, asm.EAX)
 		}
+		if c.proc.Entry {
+			c.ins(asm.Movl, asm.ESI, asm.Var("lisp_heap"))
+			for i, r := range calleeSaved {
+				c.ins(asm.Movl, asm.At(slot(ir.Temp(c.proc.Temps+i)), asm.ESP), r)
+			}
+		}
+		c.ins(asm.Ret)
 	}
 
-	gatheredExports := make(map[string]expr.E)
+	if in.HasDst() && !c.kept[in.Dst] {
+		c.store(in.Dst)
+	}
+}
 
-	for i, export := range exports {
-		if export.Typ != expr.ExprList && export.Typ != expr.ExprNil {
-			return fmt.Errorf(
-				"malformed top-level form: export at index %d is not list",
-				i,
-			)
-		}
-		tuple := export.List
-		if len(tuple) != 2 {
-			return fmt.Errorf("bad export in label form at index %d", i)
+// keptTemps returns the temporaries of p computed into %eax and
+// only used by the conditional jump or the return right after them,
+// which can find them there instead of in their slot or register.
+// The peephole optimiser then fuses the jump with the comparison
+// producing a boolean.
+func keptTemps(p *ir.Proc) map[ir.Temp]bool {
+	uses := make(map[ir.Temp]int)
+	for _, in := range p.Code {
+		for _, v := range in.Args {
+			if v.IsTemp() {
+				uses[v.Temp]++
+			}
 		}
+	}
 
-		if tuple[0].Typ != expr.ExprIdent {
-			return fmt.Errorf(
-				"malformed 'label' form: identifier at index %d is not identifier",
-				i,
-			)
+	kept := make(map[ir.Temp]bool)
+	for i := 0; i+1 < len(p.Code); i++ {
+		in, next := p.Code[i], p.Code[i+1]
+		// moves do not go through %eax
+		if !in.HasDst() || in.Op == ir.Move || (next.Op != ir.JumpIfFalse && next.Op != ir.Return) {
+			continue
+		}
+		if next.Args[0] == ir.T(in.Dst) && uses[in.Dst] == 1 {
+			kept[in.Dst] = true
 		}
+	}
+	return kept
+}
 
-		name := tuple[0].Ident
-		body := tuple[1]
+// emitCall emits a call to a procedure known by its label.
+// The arguments are stored past the frame, after a slot for the
+// return address, where they become the start of the callee's frame.
+func (c *Compiler) emitCall(in ir.Instr) {
+	ret := c.top()
+	for i, v := range in.Args {
+		c.put(v, asm.At(ret-wordsize*(i+1), asm.ESP))
+	}
+	// handle call and return
+	// call subtracts wordsize from esp, so we need to adjust it first
+	// to make sure we don't overwrite local variables
+	// pass the argument count
+	c.ins(asm.Movl, asm.Int(len(in.Args)), asm.ECX)
+	c.ins(asm.Addl, asm.Int(ret+wordsize), asm.ESP)
+	c.ins(asm.Call, asm.Symbol(mangle(in.Name)))
+	// restore esp
+	c.ins(asm.Addl, asm.Int(-(ret + wordsize)), asm.ESP)
+}
 
-		gatheredExports[name] = body
+// emitCallClosure emits a call to a closure, which becomes the closure
+// pointer of the callee. The caller's closure pointer is saved past
+// the frame, before the slot of the return address.
+func (c *Compiler) emitCallClosure(in ir.Instr) {
+	saved := c.top()
+	ret := saved - wordsize
+	for i, v := range in.Args[1:] {
+		c.put(v, asm.At(ret-wordsize*(i+1), asm.ESP))
 	}
 
-	c.emit("\t.text")
-	c.emit("\t.p2align\t2")
-	c.emit("\t.global %s", topLevelName)
-	for name := range gatheredExports {
-		c.emit("\t.global %s", name)
+	c.loadChecked(SafetyMemory, "funcall", closureType, in.Args[0])
+
+	// save closure pointer
+	c.ins(asm.Movl, asm.EDI, asm.At(saved, asm.ESP))
+
+	// move new closure into closure pointer
+	c.ins(asm.Movl, asm.EAX, asm.EDI)
+	// clear tag
+	c.ins(asm.Andl, asm.Int(-8), asm.EDI)
+
+	// handle call and return
+	c.ins(asm.Movl, asm.At(0, asm.EDI), asm.EBX)
+	// pass the argument count
+	c.ins(asm.Movl, asm.Int(len(in.Args)-1), asm.ECX)
+	c.ins(asm.Addl, asm.Int(saved), asm.ESP)
+	c.ins(asm.Call, asm.EBX)
+	c.ins(asm.Addl, asm.Int(-saved), asm.ESP)
+	// restore closure pointer
+	c.ins(asm.Movl, asm.At(saved, asm.ESP), asm.EDI)
+}
+
+// emitClosure emits the closure of a procedure, which is a record
+// holding its label followed by the values of its free variables.
+// Procedures without free variables have static closures.
+func (c *Compiler) emitClosure(in ir.Instr) {
+	l := mangle(in.Name)
+	if len(in.Args) == 0 {
+		c.ins(asm.Movl, asm.Addr(closureLabel(l)), asm.EAX)
+		c.ins(asm.Orl, asm.Int(closureType.tag), asm.EAX)
+		return
 	}
 
-	for name, body := range gatheredExports {
-		c.emit("%s:", name)
+	c.ins(asm.Movl, asm.Addr(l), asm.At(0, asm.ESI))
+	for i, v := range in.Args {
+		c.put(v, asm.At(wordsize*(i+1), asm.ESI))
+	}
+	c.allocate(closureType.tag, wordsize*(len(in.Args)+1))
+}
 
-		err := c.compileExpr(body)
-		if err != nil {
-			return fmt.Errorf("error compiling export body: %w", err)
-		}
+// allocate tags the object of the given size at the heap pointer
+// into %eax, and advances the heap pointer past it
+func (c *Compiler) allocate(tag int, size int) {
+	c.ins(asm.Movl, asm.ESI, asm.EAX)
+	c.ins(asm.Orl, asm.Int(tag), asm.EAX)
+	// align size to next object boundary
+	c.ins(asm.Addl, asm.Int((size+7)&^7), asm.ESI)
+}
+
+// slot returns the offset from the stack pointer of the slot of t
+func slot(t ir.Temp) int {
+	return -wordsize * (int(t) + 1)
+}
+
+// top returns the offset of the first slot past the frame
+func (c *Compiler) top() int {
+	n := c.proc.Temps
+	if c.proc.Entry {
+		n += len(calleeSaved)
 	}
+	return -wordsize * (n + 1)
+}
 
-	for i, lvar := range lvars {
-		if lvar.Typ != expr.ExprList && lvar.Typ != expr.ExprNil {
-			return fmt.Errorf(
-				"malformed '_main' form: lvar at index %d is not list",
-				i,
-			)
-		}
-		pair := lvar.List
-		if len(pair) != 2 {
-			return fmt.Errorf("bad lvar in label form at index %d", i)
-		}
+// immediate returns the assembler operand of a tagged value,
+// writing fixnums in decimal and other values in hex
+func immediate(x int) asm.Imm {
+	if x&3 == fixnumTag {
+		return asm.Int(x)
+	}
+	return asm.Hex(x)
+}
 
-		if pair[0].Typ != expr.ExprIdent {
-			return fmt.Errorf(
-				"malformed '_main' form: identifier at index %d is not identifier",
-				i,
-			)
-		}
+// operand returns the assembler operand of a value
+func (c *Compiler) operand(v ir.Value) asm.Operand {
+	if !v.IsTemp() {
+		return immediate(v.Imm)
+	}
+	if r, ok := c.regs[v.Temp]; ok {
+		return r
+	}
+	return asm.At(slot(v.Temp), asm.ESP)
+}
 
-		name := pair[0].Ident
-		lvarBody := pair[1]
+// load moves a value into a register, unless it is already there
+func (c *Compiler) load(v ir.Value, reg asm.Reg) {
+	if o := c.operand(v); o != reg {
+		c.ins(asm.Movl, o, reg)
+	}
+}
 
-		c.emit("%s:", name)
+// store moves %eax into a temporary
+func (c *Compiler) store(t ir.Temp) {
+	c.ins(asm.Movl, asm.EAX, c.operand(ir.T(t)))
+}
 
-		err := c.compileExpr(lvarBody)
-		if err != nil {
-			return fmt.Errorf("error compiling body in _main form: %w", err)
-		}
+// put moves a value into a memory location, through %eax
+// unless it is an immediate or in a register
+func (c *Compiler) put(v ir.Value, dst asm.Mem) {
+	if o := c.operand(v); !isMemory(o) {
+		c.ins(asm.Movl, o, dst)
+		return
 	}
+	c.load(v, asm.EAX)
+	c.ins(asm.Movl, asm.EAX, dst)
+}
 
-	c.emit("%s:", topLevelName)
-	c.emit("movl %%eax, %%esi")
-	for _, body := range elems[4:] {
-		err := c.compileExpr(body)
-		if err != nil {
-			return fmt.Errorf("error compiling body in _main form: %w", err)
-		}
+// isMemory reports whether o is a memory operand
+func isMemory(o asm.Operand) bool {
+	_, ok := o.(asm.Mem)
+	return ok
+}
+
+// compare compares two values, and sets %eax to the boolean
+// given by the condition
+func (c *Compiler) compare(x, y ir.Value, cond asm.Cond) {
+	c.load(x, asm.EAX)
+	c.ins(asm.Cmpl, c.operand(y), asm.EAX)
+	c.setBool(cond)
+}
+
+// label returns the assembler label of a label of the procedure
+func (c *Compiler) label(l ir.Label) string {
+	s, ok := c.labels[l]
+	if !ok {
+		s = c.genLabel()
+		c.labels[l] = s
+	}
+	return s
+}
+
+// checkArity compares the argument count in %ecx
+// against the n required parameters of a procedure,
+// calling the runtime error routine on a mismatch
+func (c *Compiler) checkArity(n int, variadic bool) {
+	if c.Safety < SafetyMemory {
+		return
 	}
 
-	c.emit("ret")
+	ok := c.genLabel()
 
-	return nil
+	c.ins(asm.Cmpl, asm.Int(n), asm.ECX)
+	if variadic {
+		c.emit(asm.J(asm.GE, ok))
+	} else {
+		c.emit(asm.J(asm.E, ok))
+	}
+	c.callError("lisp_arity_error", asm.Int(n), asm.ECX, asm.Int(boolToInt(variadic)))
+	c.emit(asm.Label(ok))
 }
 
-func (c *Compiler) compileExpr(e expr.E) error {
-	switch e.Typ {
-	case expr.ExprIdent:
-		v := e.Ident
-		loc, ok := c.env[v]
-		if !ok {
-			return fmt.Errorf("unbound variable '%s'", v)
-		}
-		switch loc.location {
-		case stack:
-			c.emit("movl %d(%%esp), %%eax", loc.offset)
-		case closure:
-			c.emit("movl %d(%%edi), %%eax", loc.offset)
-		case heap:
-			c.emit("movl %d(%%esi), %%eax", loc.offset)
-		}
-		return nil
-	case expr.ExprNumber:
-		x := e.Number
-		x <<= fixnumShift
-
-		c.emit("movl $%d, %%eax", x)
-
-		return nil
-	case expr.ExprNil:
-		c.emit("movl $0x%x, %%eax", emptyList)
-		return nil
-
-	case expr.ExprList:
-		elems := e.List
-		if len(elems) == 0 {
-			c.emit("movl $0x%x, %%eax", emptyList)
-			return nil
-		}
+// callError calls a runtime error routine, which does not return,
+// with the given operands as arguments
+func (c *Compiler) callError(routine string, args ...asm.Operand) {
+	// align the stack as expected by the C calling convention
+	c.ins(asm.Andl, asm.Int(-16), asm.ESP)
+	if pad := (4 - len(args)%4) % 4; pad != 0 {
+		c.ins(asm.Subl, asm.Int(pad*wordsize), asm.ESP)
+	}
+	for i := len(args) - 1; i >= 0; i-- {
+		c.ins(asm.Pushl, args[i])
+	}
+	c.ins(asm.Call, asm.Symbol(routine))
+}
 
-		head := elems[0]
+// callRuntime calls a runtime function with the given values
+// as arguments, leaving its result in %eax.
+// Runtime functions take and return tagged values and follow
+// the C calling convention, which preserves %esi and %edi.
+// The heap pointer is exchanged through lisp_heap so that
+// the runtime can allocate objects.
+// The stack pointer is moved past the live part of the frame and
+// aligned for the call, and restored afterwards.
+func (c *Compiler) callRuntime(routine string, args ...ir.Value) {
+	c.ins(asm.Movl, asm.ESI, asm.Var("lisp_heap"))
+	c.ins(asm.Movl, asm.ESP, asm.EAX)
+	c.ins(asm.Addl, asm.Int(c.top()), asm.ESP)
+	c.ins(asm.Andl, asm.Int(-16), asm.ESP)
+	// the saved stack pointer
+	c.ins(asm.Pushl, asm.EAX)
+	pad := (4 - (len(args)+1)%4) % 4
+	if pad != 0 {
+		c.ins(asm.Subl, asm.Int(pad*wordsize), asm.ESP)
+	}
+	for i := len(args) - 1; i >= 0; i-- {
+		// temporaries in the frame are found
+		// through the saved stack pointer
+		if o := c.operand(args[i]); isMemory(o) {
+			c.ins(asm.Pushl, asm.At(slot(args[i].Temp), asm.EAX))
+		} else {
+			c.ins(asm.Pushl, o)
+		}
+	}
+	c.ins(asm.Call, asm.Symbol(routine))
+	c.ins(asm.Addl, asm.Int((pad+len(args))*wordsize), asm.ESP)
+	c.ins(asm.Popl, asm.ESP)
+	c.ins(asm.Movl, asm.Var("lisp_heap"), asm.ESI)
+}
 
-		switch head.Typ {
-		case expr.ExprIdent:
-			if proc, ok := builtins[head.Ident]; ok {
-				return proc(c, elems)
-			}
+// collectRest builds a list from the arguments past the first n
+// and stores it in the slot of argument n.
+// The argument count is expected in %ecx.
+func (c *Compiler) collectRest(n int) {
+	loop := c.genLabel()
+	done := c.genLabel()
+
+	c.ins(asm.Movl, asm.Hex(emptyList), asm.EAX)
+	c.emit(asm.Label(loop))
+	c.ins(asm.Cmpl, asm.Int(n), asm.ECX)
+	c.emit(asm.J(asm.LE, done))
+	// the last remaining argument is at -wordsize * ecx
+	c.ins(asm.Movl, asm.ECX, asm.EDX)
+	c.ins(asm.Negl, asm.EDX)
+	c.ins(asm.Movl, asm.Indexed(0, asm.ESP, asm.EDX, wordsize), asm.EBX)
+	// cons it onto the list
+	c.ins(asm.Movl, asm.EBX, asm.At(0, asm.ESI))
+	c.ins(asm.Movl, asm.EAX, asm.At(wordsize, asm.ESI))
+	c.ins(asm.Movl, asm.ESI, asm.EAX)
+	c.ins(asm.Orl, asm.Int(1), asm.EAX)
+	c.ins(asm.Addl, asm.Int(2*wordsize), asm.ESI)
+	c.ins(asm.Decl, asm.ECX)
+	c.ins(asm.Jmp, asm.Symbol(loop))
+	c.emit(asm.Label(done))
+	c.ins(asm.Movl, asm.EAX, asm.At(-wordsize*(n+1), asm.ESP))
+}
 
-			if _, ok := c.env[head.Ident]; ok {
-				newExpr := []expr.E{
-					expr.Id("funcall"),
-				}
+// charValue returns the tagged representation of a character
+func charValue(r rune) int {
+	return int(r)<<charShift | charTag
+}
 
-				for _, elem := range elems {
-					newExpr = append(newExpr, elem)
-				}
+// charRangeTest compares the character in %eax against the range
+// [lo, hi], so that the unsigned condition 'below or equal'
+// holds when it is within the range. %eax is left untouched.
+func (c *Compiler) charRangeTest(lo, hi rune) {
+	c.ins(asm.Movl, asm.EAX, asm.EBX)
+	c.ins(asm.Subl, asm.Hex(int(lo)<<charShift), asm.EBX)
+	c.ins(asm.Cmpl, asm.Hex(charValue(hi-lo)), asm.EBX)
+}
 
-				return c.compileExpr(expr.L(newExpr...))
-			}
+// setBool turns the condition of the last comparison
+// into a boolean in %eax
+func (c *Compiler) setBool(cond asm.Cond) {
+	c.ins(asm.Movl, asm.Int(0), asm.EAX)
+	c.emit(asm.Set(cond, asm.AL))
+	c.ins(asm.Sall, asm.Int(7), asm.EAX)
+	c.ins(asm.Orl, asm.Hex(boolTag), asm.EAX)
+}
 
-			// assume the procedure is defined as a label
-			newExpr := []expr.E{
-				expr.Id("labelcall"),
-			}
+// emit appends lines to the program
+func (c *Compiler) emit(lines ...asm.Line) {
+	c.out = append(c.out, lines...)
+}
 
-			for _, elem := range elems {
-				newExpr = append(newExpr, elem)
-			}
+// ins appends the instruction applying op to args to the program
+func (c *Compiler) ins(op asm.Op, args ...asm.Operand) {
+	c.emit(asm.I(op, args...))
+}
 
-			return c.compileExpr(expr.L(newExpr...))
-		case expr.ExprList:
-			newExpr := []expr.E{
-				expr.Id("funcall"),
-			}
+// mangle turns an identifier into a valid assembler symbol.
+// Letters and digits are kept, underscores are doubled, and every
+// other character is replaced by its code in hex surrounded by
+// underscores, e.g. list-ref becomes list_2d_ref and list_ref
+// becomes list__ref, so that different identifiers never clash.
+// Identifiers which Intel syntax reads as registers or operators
+// have their first letter replaced as well, e.g. eax becomes _65_ax.
+func mangle(id string) string {
+	var sb strings.Builder
+	for i, r := range id {
+		switch {
+		case i == 0 && intelReserved(id):
+			fmt.Fprintf(&sb, "_%x_", r)
+		case r == '_':
+			sb.WriteString("__")
+		case r < unicode.MaxASCII && (unicode.IsDigit(r) || unicode.IsLetter(r)):
+			sb.WriteRune(r)
+		default:
+			fmt.Fprintf(&sb, "_%x_", r)
+		}
+	}
+	return sb.String()
+}
 
-			for _, elem := range elems {
-				newExpr = append(newExpr, elem)
-			}
+// intelNames holds the names which Intel syntax reads as registers
+// or operators rather than as symbols
+var intelNames = map[string]struct{}{}
+
+// intelNumbered holds the prefixes of the numbered registers,
+// such as xmm0
+var intelNumbered = []string{"st", "mm", "xmm", "ymm", "zmm", "cr", "dr", "tr", "k", "r", "bnd"}
+
+func init() {
+	for _, n := range strings.Fields(`
+		eax ebx ecx edx esi edi esp ebp eip ax bx cx dx si di sp bp ip
+		al ah bl bh cl ch dl dh sil dil spl bpl
+		rax rbx rcx rdx rsi rdi rsp rbp rip
+		cs ds es fs gs ss st
+		byte word dword fword qword tbyte oword xmmword ymmword zmmword
+		ptr offset flat short near far
+		not and or xor mod shl shr eq ne lt le gt ge`) {
+		intelNames[n] = struct{}{}
+	}
+}
 
-			return c.compileExpr(expr.L(newExpr...))
+// intelReserved reports whether Intel syntax reads id as
+// a register or an operator, whatever its case
+func intelReserved(id string) bool {
+	id = strings.ToLower(id)
+	if _, ok := intelNames[id]; ok {
+		return true
+	}
+	for _, prefix := range intelNumbered {
+		n := strings.TrimPrefix(id, prefix)
+		if len(n) == len(id) || n == "" {
+			continue
 		}
+		// r8 to r15 also have the suffixes d, w and b
+		if prefix == "r" {
+			n = strings.TrimRight(n, "dwb")
+		}
+		if strings.Trim(n, "0123456789") == "" && n != "" {
+			return true
+		}
+	}
+	return false
+}
 
-		return fmt.Errorf("unsupported operation %s", head.String())
-	default:
-		return fmt.Errorf("error compiling code: %+v", e.String())
+// unitLabel returns the label of the top-level code of the unit called
+// name. The runtime calls the entry point by its name, and the code of
+// other units, which initialises them, is labelled apart from mangled
+// names, which contain no dot, and from the symbols of the runtime,
+// such as main.
+func unitLabel(name string) string {
+	if name == EntryName {
+		return name
 	}
+	return mangle(name) + ".init"
 }
 
-// push %eax onto the stack
-func (c *Compiler) push() {
-	// si points to the top of the stack
-	// i.e. in the free space above the stack frame
-	c.emit("movl %%eax, %d(%%esp)", c.si)
-	c.si -= wordsize
+// closureLabel returns the label of the static closure of the
+// procedure with the given label, which no mangled name contains
+func closureLabel(label string) string {
+	return label + ".closure"
 }
 
-func (c *Compiler) clearEnv() {
-	c.env = make(map[string]location)
+// emitStaticClosure emits the closure of the procedure with the given
+// label, which has no free variables and so never needs allocating
+func (c *Compiler) emitStaticClosure(label string) {
+	c.emit(asm.D("align", "8"), asm.Label(closureLabel(label)), asm.D("long", label))
 }
 
-func (c *Compiler) emit(format string, a ...interface{}) {
-	s := fmt.Sprintf(format, a...)
-	fmt.Fprintln(c.W, s)
+// isGlobal reports whether e is the (global) form defining a global variable
+func isGlobal(e expr.E) bool {
+	return e.Typ == expr.ExprList && len(e.List) == 1 && expr.IsIdent(e.List[0], "global")
+}
+
+// EntryName is the name of the unit whose entry point the runtime
+// calls to run the program
+const EntryName = "lisp_entry"
+
+// IsEntry reports whether the unit with the given name and top-level
+// body is the entry point of a program: it is named after it, or has
+// expressions to evaluate besides initialising global variables
+func IsEntry(name string, body []expr.E) bool {
+	if name == EntryName {
+		return true
+	}
+	for _, e := range body {
+		if e.Typ != expr.ExprNil && !isInitialisation(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// isInitialiser reports whether a unit other than the entry point
+// initialises global variables, in which case the runtime runs it
+// before the entry point
+func isInitialiser(name string, body []expr.E) bool {
+	if IsEntry(name, body) {
+		return false
+	}
+	for _, e := range body {
+		if isInitialisation(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func isInitialisation(e expr.E) bool {
+	return e.Typ == expr.ExprList && len(e.List) > 0 && expr.IsIdent(e.List[0], "global-set!")
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func (c *Compiler) genLabel() string {
@@ -2,152 +2,919 @@ package compiler
 
 import (
 	"bytes"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
+	"github.com/brenoafb/tinycompiler/pkg/asm"
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+	"github.com/brenoafb/tinycompiler/pkg/ir"
 	"github.com/brenoafb/tinycompiler/pkg/parser"
 )
 
+// compileExpr emits the code of the procedure e when it is
+// a code form, or else of an entry point evaluating e
+func compileExpr(c *Compiler, e expr.E) error {
+	var p *ir.Proc
+	var err error
+	if e.Typ == expr.ExprList && len(e.List) > 0 && expr.IsIdent(e.List[0], "code") {
+		p, err = c.lowerCode("f", e)
+	} else {
+		p, err = c.lowerEntry("entry", []expr.E{e})
+	}
+	if err != nil {
+		return err
+	}
+	if err := p.Verify(); err != nil {
+		return err
+	}
+	c.emitCode(p)
+	return c.print()
+}
+
 func TestCompileExpr(t *testing.T) {
 	tests := []struct {
 		code     string
 		expected string
 	}{
 		{
-			code:     "42",
-			expected: "movl $168, %eax\n",
+			code: "42",
+			expected: `movl %ebx, -4(%esp)
+movl %esi, -8(%esp)
+movl %edi, -12(%esp)
+movl %ebp, -16(%esp)
+movl lisp_heap, %esi
+movl $168, %eax
+movl %esi, lisp_heap
+movl -4(%esp), %ebx
+movl -8(%esp), %esi
+movl -12(%esp), %edi
+movl -16(%esp), %ebp
+ret
+`,
 		},
 		{
 			code: "(add1 42)",
-			expected: `movl $168, %eax
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $168, %eax
 addl $4, %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
 `,
 		},
 		{
 			code: "(null? ())",
-			expected: `movl $0x2f, %eax
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $0x2f, %eax
 cmpl $0x2f, %eax
 movl $0, %eax
 sete %al
 sall $7, %eax
 orl $0x1f, %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
 `,
 		},
 		{
 			code: "(zero? 41)",
-			expected: `movl $164, %eax
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $164, %eax
 cmpl $0, %eax
 movl $0, %eax
 sete %al
 sall $7, %eax
 orl $0x1f, %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
 `,
 		},
 		{
 			code: "(+ 13 87)",
-			expected: `movl $348, %eax
-movl %eax, -4(%esp)
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
 movl $52, %eax
-addl -4(%esp), %eax
+addl $348, %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
 `,
 		},
 		{
 			code: "(let (x 1) x)",
-			expected: `movl $4, %eax
+			expected: `movl %ebx, -4(%esp)
+movl %esi, -8(%esp)
+movl %edi, -12(%esp)
+movl %ebp, -16(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+movl %esi, lisp_heap
+movl -4(%esp), %ebx
+movl -8(%esp), %esi
+movl -12(%esp), %edi
+movl -16(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(let (x 1) (y 2) (+ x y))",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+addl $8, %eax
 movl %eax, -4(%esp)
 movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
 `,
 		},
 		{
-			code: "(let (x 1) (y 2) (+ x y))",
-			expected: `movl $4, %eax
+			code: "(let (x 1) (let ((x 2) (y x)) y))",
+			expected: `movl %ebx, -4(%esp)
+movl %esi, -8(%esp)
+movl %edi, -12(%esp)
+movl %ebp, -16(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+movl %esi, lisp_heap
+movl -4(%esp), %ebx
+movl -8(%esp), %esi
+movl -12(%esp), %edi
+movl -16(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(let (x 1) (+ x x) x)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+addl $4, %eax
+movl %eax, -4(%esp)
+movl $4, %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(set-box! (box 1) 2)",
+			expected: `movl %ebx, -12(%esp)
+movl %esi, -16(%esp)
+movl %edi, -20(%esp)
+movl %ebp, -24(%esp)
+movl lisp_heap, %esi
+movl $4, (%esi)
+movl $0x2f, 4(%esi)
+movl %esi, %eax
+orl $1, %eax
+addl $8, %esi
 movl %eax, -4(%esp)
+movl -4(%esp), %ebx
 movl $8, %eax
+movl %eax, -1(%ebx)
 movl %eax, -8(%esp)
 movl -8(%esp), %eax
-movl %eax, -12(%esp)
-movl -4(%esp), %eax
-addl -12(%esp), %eax
+movl %esi, lisp_heap
+movl -12(%esp), %ebx
+movl -16(%esp), %esi
+movl -20(%esp), %edi
+movl -24(%esp), %ebp
+ret
 `,
 		},
 		{
 			code: "(if (zero? 1) 0 1)",
-			expected: `movl $4, %eax
+			expected: `movl %ebx, -12(%esp)
+movl %esi, -16(%esp)
+movl %edi, -20(%esp)
+movl %ebp, -24(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
 cmpl $0, %eax
 movl $0, %eax
 sete %al
 sall $7, %eax
 orl $0x1f, %eax
-cmpl $0x1f, %eax
+movl %eax, -4(%esp)
+cmpl $0x1f, -4(%esp)
 je L0
-movl $0, %eax
+movl $0, -8(%esp)
 jmp L1
 L0:
-movl $4, %eax
+movl $4, -8(%esp)
 L1:
+movl -8(%esp), %eax
+movl %esi, lisp_heap
+movl -12(%esp), %ebx
+movl -16(%esp), %esi
+movl -20(%esp), %edi
+movl -24(%esp), %ebp
+ret
 `,
 		},
 		{
 			code: "(cons 1 2)",
-			expected: `movl $4, %eax
-movl %eax, 0(%esi)
-movl $8, %eax
-movl %eax, 4(%esi)
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, (%esi)
+movl $8, 4(%esi)
 movl %esi, %eax
 orl $1, %eax
 addl $8, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
 `,
 		},
 		{
-			code: "(code () () (+ 1 2))",
-			expected: `movl $8, %eax
+			code: "(vector-length (vector 1))",
+			expected: `movl %ebx, -12(%esp)
+movl %esi, -16(%esp)
+movl %edi, -20(%esp)
+movl %ebp, -24(%esp)
+movl lisp_heap, %esi
+movl $4, (%esi)
+movl $4, 4(%esi)
+movl %esi, %eax
+orl $2, %eax
+addl $8, %esi
 movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %eax, %ebx
+andl $0x7, %ebx
+cmpl $0x2, %ebx
+jne L0
+movl -2(%eax), %eax
+movl %eax, -8(%esp)
+movl -8(%esp), %eax
+movl %esi, lisp_heap
+movl -12(%esp), %ebx
+movl -16(%esp), %esi
+movl -20(%esp), %edi
+movl -24(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(set-cdr! (cons 1 2) #t)",
+			expected: `movl %ebx, -12(%esp)
+movl %esi, -16(%esp)
+movl %edi, -20(%esp)
+movl %ebp, -24(%esp)
+movl lisp_heap, %esi
+movl $4, (%esi)
+movl $8, 4(%esi)
+movl %esi, %eax
+orl $1, %eax
+addl $8, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %eax, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L0
+movl %eax, %ebx
+movl $0x9f, %eax
+movl %eax, 3(%ebx)
+movl %ebx, %eax
+movl %eax, -8(%esp)
+movl -8(%esp), %eax
+movl %esi, lisp_heap
+movl -12(%esp), %ebx
+movl -16(%esp), %esi
+movl -20(%esp), %edi
+movl -24(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(eq? #f ())",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $0x1f, %eax
+cmpl $0x2f, %eax
+movl $0, %eax
+sete %al
+sall $7, %eax
+orl $0x1f, %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(char<? 1 2)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+movl %eax, %ebx
+andl $0xff, %ebx
+cmpl $0xf, %ebx
+jne L0
+movl $8, %eax
+movl %eax, %ebx
+andl $0xff, %ebx
+cmpl $0xf, %ebx
+jne L0
 movl $4, %eax
-addl -4(%esp), %eax
+cmpl $8, %eax
+movl $0, %eax
+setl %al
+sall $7, %eax
+orl $0x1f, %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
 ret
 `,
 		},
 		{
-			code: "(code (x) () (+ x 1))",
-			expected: `movl $4, %eax
+			code: "(char-upcase 1)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+movl %eax, %ebx
+andl $0xff, %ebx
+cmpl $0xf, %ebx
+jne L0
+movl %eax, %ebx
+subl $0x6100, %ebx
+cmpl $0x190f, %ebx
+ja L1
+addl $-8192, %eax
+L1:
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(display 1)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl %esi, lisp_heap
+movl %esp, %eax
+addl $-24, %esp
+andl $-16, %esp
+pushl %eax
+subl $8, %esp
+pushl $4
+call lisp_display
+addl $12, %esp
+popl %esp
+movl lisp_heap, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(eof-object? (read-char))",
+			expected: `movl %ebx, -12(%esp)
+movl %esi, -16(%esp)
+movl %edi, -20(%esp)
+movl %ebp, -24(%esp)
+movl lisp_heap, %esi
+movl %esi, lisp_heap
+movl %esp, %eax
+addl $-28, %esp
+andl $-16, %esp
+pushl %eax
+subl $12, %esp
+call lisp_read_char
+addl $12, %esp
+popl %esp
+movl lisp_heap, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+cmpl $0x3f, %eax
+movl $0, %eax
+sete %al
+sall $7, %eax
+orl $0x1f, %eax
 movl %eax, -8(%esp)
+movl -8(%esp), %eax
+movl %esi, lisp_heap
+movl -12(%esp), %ebx
+movl -16(%esp), %esi
+movl -20(%esp), %edi
+movl -24(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(read-line)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl %esi, lisp_heap
+movl %esp, %eax
+addl $-24, %esp
+andl $-16, %esp
+pushl %eax
+subl $8, %esp
+pushl $0x4f
+call lisp_read_line
+addl $12, %esp
+popl %esp
+movl lisp_heap, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(port? 1)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+andl $0xff, %eax
+cmpl $0x4f, %eax
+movl $0, %eax
+sete %al
+sall $7, %eax
+orl $0x1f, %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(exit)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl %esi, lisp_heap
+movl %esp, %eax
+addl $-24, %esp
+andl $-16, %esp
+pushl %eax
+subl $8, %esp
+pushl $0
+call lisp_exit
+addl $12, %esp
+popl %esp
+movl lisp_heap, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(list-ref 1 0)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, -28(%esp)
+movl $0, -32(%esp)
+movl $2, %ecx
+addl $-20, %esp
+call list_2d_ref
+addl $20, %esp
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(code () () (+ 1 2))",
+			expected: `cmpl $0, %ecx
+je L0
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $0
+call lisp_arity_error
+L0:
+movl $4, %eax
+addl $8, %eax
+movl %eax, -4(%esp)
 movl -4(%esp), %eax
-addl -8(%esp), %eax
+ret
+`,
+		},
+		{
+			code: "(code (x) () (+ x 1))",
+			expected: `cmpl $1, %ecx
+je L0
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $1
+call lisp_arity_error
+L0:
+movl -4(%esp), %eax
+testl $3, %eax
+jne L1
+movl -4(%esp), %eax
+addl $4, %eax
+movl %eax, -8(%esp)
+movl -8(%esp), %eax
 ret
 `,
 		},
 		{
 			code: "(code (x) (y) (+ x y))",
-			expected: `movl 4(%edi), %eax
+			expected: `cmpl $1, %ecx
+je L0
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $1
+call lisp_arity_error
+L0:
+movl 4(%edi), %eax
 movl %eax, -8(%esp)
 movl -4(%esp), %eax
+testl $3, %eax
+jne L1
+movl -8(%esp), %eax
+testl $3, %eax
+jne L1
+movl -4(%esp), %eax
 addl -8(%esp), %eax
+movl %eax, -12(%esp)
+movl -12(%esp), %eax
 ret
 `,
 		},
 		{
-			code: "(closure f0)",
-			expected: `movl $f0, 0(%esi)
-movl $1, %ebx
+			code: "(code (x . r) () r)",
+			expected: `cmpl $1, %ecx
+jge L0
+andl $-16, %esp
+subl $4, %esp
+pushl $1
+pushl %ecx
+pushl $1
+call lisp_arity_error
+L0:
+movl $0x2f, %eax
+L1:
+cmpl $1, %ecx
+jle L2
+movl %ecx, %edx
+negl %edx
+movl (%esp,%edx,4), %ebx
+movl %ebx, (%esi)
+movl %eax, 4(%esi)
 movl %esi, %eax
+orl $1, %eax
+addl $8, %esi
+decl %ecx
+jmp L1
+L2:
+movl %eax, -8(%esp)
+movl -8(%esp), %eax
+ret
+`,
+		},
+		{
+			code: "(f 1)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, -28(%esp)
+movl $1, %ecx
+addl $-20, %esp
+call f
+addl $20, %esp
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code: "(closure f0)",
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $f0.closure, %eax
 orl $6, %eax
-addl $11, %ebx
-andl $-8, %ebx
-addl %ebx, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
 `,
 		},
 		{
 			code: "(closure f0 4)",
-			expected: `movl $f0, 0(%esi)
-movl $16, %eax
-movl %eax, 4(%esi)
-movl $2, %ebx
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $f0, (%esi)
+movl $16, 4(%esi)
 movl %esi, %eax
 orl $6, %eax
-addl $11, %ebx
-andl $-8, %ebx
-addl %ebx, %esi
+addl $8, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			c := NewCompiler(w)
+			c.Peephole = false
+			c.Registers = false
+
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+			require.Len(t, exprs, 1)
+			err = compileExpr(c, exprs[0])
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, w.String())
+		})
+	}
+}
+
+func TestSafetyLevels(t *testing.T) {
+	tests := []struct {
+		code     string
+		safety   int
+		expected string
+	}{
+		{
+			code:   "(car 1)",
+			safety: SafetyNone,
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+movl -1(%eax), %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code:   "(car 1)",
+			safety: SafetyMemory,
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+movl %eax, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L0
+movl -1(%eax), %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code:   "(vector-ref (vector 1) 0)",
+			safety: SafetyMemory,
+			expected: `movl %ebx, -12(%esp)
+movl %esi, -16(%esp)
+movl %edi, -20(%esp)
+movl %ebp, -24(%esp)
+movl lisp_heap, %esi
+movl $4, (%esi)
+movl $4, 4(%esi)
+movl %esi, %eax
+orl $2, %eax
+addl $8, %esi
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %eax, %ebx
+andl $0x7, %ebx
+cmpl $0x2, %ebx
+jne L0
+movl $0, %eax
+movl -4(%esp), %ebx
+cmpl -2(%ebx), %eax
+jae L1
+movl $0, %eax
+movl -4(%esp), %ebx
+movl 2(%ebx,%eax), %eax
+movl %eax, -8(%esp)
+movl -8(%esp), %eax
+movl %esi, lisp_heap
+movl -12(%esp), %ebx
+movl -16(%esp), %esi
+movl -20(%esp), %edi
+movl -24(%esp), %ebp
+ret
+`,
+		},
+		{
+			code:   "(vector-ref (vector 1) 0)",
+			safety: SafetyNone,
+			expected: `movl %ebx, -12(%esp)
+movl %esi, -16(%esp)
+movl %edi, -20(%esp)
+movl %ebp, -24(%esp)
+movl lisp_heap, %esi
+movl $4, (%esi)
+movl $4, 4(%esi)
+movl %esi, %eax
+orl $2, %eax
+addl $8, %esi
+movl %eax, -4(%esp)
+movl $0, %eax
+movl -4(%esp), %ebx
+movl 2(%ebx,%eax), %eax
+movl %eax, -8(%esp)
+movl -8(%esp), %eax
+movl %esi, lisp_heap
+movl -12(%esp), %ebx
+movl -16(%esp), %esi
+movl -20(%esp), %edi
+movl -24(%esp), %ebp
+ret
+`,
+		},
+		{
+			code:   "(add1 1)",
+			safety: SafetyMemory,
+			expected: `movl %ebx, -8(%esp)
+movl %esi, -12(%esp)
+movl %edi, -16(%esp)
+movl %ebp, -20(%esp)
+movl lisp_heap, %esi
+movl $4, %eax
+addl $4, %eax
+movl %eax, -4(%esp)
+movl -4(%esp), %eax
+movl %esi, lisp_heap
+movl -8(%esp), %ebx
+movl -12(%esp), %esi
+movl -16(%esp), %edi
+movl -20(%esp), %ebp
+ret
+`,
+		},
+		{
+			code:   "(code (x) () x)",
+			safety: SafetyNone,
+			expected: `movl -4(%esp), %eax
+ret
 `,
 		},
 	}
@@ -156,18 +923,512 @@ addl %ebx, %esi
 		t.Run(tt.code, func(t *testing.T) {
 			w := &bytes.Buffer{}
 			c := NewCompiler(w)
+			c.Safety = tt.safety
+			c.Peephole = false
+			c.Registers = false
 
 			tokens, err := parser.Tokenize(tt.code)
 			require.NoError(t, err)
 			exprs, err := parser.Parse(tokens)
 			require.NoError(t, err)
 			require.Len(t, exprs, 1)
-			expr := exprs[0]
 
-			err = c.compileExpr(expr)
+			err = compileExpr(c, exprs[0])
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, w.String())
+		})
+	}
+}
+
+func TestCompileTypeErrorRoutines(t *testing.T) {
+	tokens, err := parser.Tokenize("(entry () () () (car 1) (cdr 2) (car 3))")
+	require.NoError(t, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(t, err)
+
+	w := &bytes.Buffer{}
+	c := NewCompiler(w)
+	err = c.Compile(exprs[0])
+	require.NoError(t, err)
+
+	expected := `L0:
+andl $-16, %esp
+subl $4, %esp
+pushl %eax
+pushl $L3
+pushl $L2
+call lisp_type_error
+L1:
+andl $-16, %esp
+subl $4, %esp
+pushl %eax
+pushl $L3
+pushl $L4
+call lisp_type_error
+	.section	.rodata
+L2:
+	.asciz	"car"
+L3:
+	.asciz	"pair"
+L4:
+	.asciz	"cdr"
+`
+	require.Contains(t, w.String(), expected)
+}
+
+func TestCompileExportOrder(t *testing.T) {
+	tokens, err := parser.Tokenize(`(entry
+	  ((c (code () () 3)) (a (code () () 1)) (b (code () () 2)))
+	  () () ())`)
+	require.NoError(t, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(t, err)
+
+	w := &bytes.Buffer{}
+	c := NewCompiler(w)
+	err = c.Compile(exprs[0])
+	require.NoError(t, err)
+
+	expected := `	.global	entry.init
+	.global	c
+	.global	a
+	.global	b
+c:
+`
+	require.Contains(t, w.String(), expected)
+}
+
+func TestMangle(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected string
+	}{
+		{id: "list", expected: "list"},
+		{id: "list-ref", expected: "list_2d_ref"},
+		{id: "list_2d_ref", expected: "list__2d__ref"},
+		{id: "util:inc", expected: "util_3a_inc"},
+		{id: "util_3a_inc", expected: "util__3a__inc"},
+		// names Intel syntax reads as registers or operators
+		{id: "ecx", expected: "_65_cx"},
+		{id: "EAX", expected: "_45_AX"},
+		{id: "offset", expected: "_6f_ffset"},
+		{id: "xmm0", expected: "_78_mm0"},
+		{id: "r8d", expected: "_72_8d"},
+		{id: "ecx-1", expected: "ecx_2d_1"},
+		{id: "r", expected: "r"},
+		{id: "xmm", expected: "xmm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			require.Equal(t, tt.expected, mangle(tt.id))
+		})
+	}
+
+	// the runtime calls the entry point by name
+	require.Equal(t, "lisp_entry", unitLabel("lisp_entry"))
+	require.Equal(t, "my_2d_lib.init", unitLabel("my-lib"))
+	require.Equal(t, "main.init", unitLabel("main"))
+}
+
+func TestCompileGlobals(t *testing.T) {
+	tests := []struct {
+		code        string
+		initialiser bool
+	}{
+		{
+			code:        "(lib ((x (global))) ((y (global))) () (global-set! x 1) () (global-set! y (global-ref x)))",
+			initialiser: true,
+		},
+		{
+			code:        "(entry ((x (global))) () () (global-set! x 1) (global-ref x))",
+			initialiser: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			w := &bytes.Buffer{}
+			c := NewCompiler(w)
+			err = c.Compile(exprs[0])
+			require.NoError(t, err)
+
+			out := w.String()
+			require.Equal(t, 1, strings.Count(out, "\n"+exprs[0].List[0].Ident+".init:\n"))
+			require.Contains(t, out, "\t.global\tx\n\t.align\t8\nx:\n\t.long\t0\n")
+			require.Contains(t, out, "movl $4, x\n")
+			if tt.initialiser {
+				require.Contains(t, out, "\t.section\tlisp_init, \"aw\"\n\t.align\t4\n\t.long\tlib.init\n")
+				require.Contains(t, out, "y:\n\t.long\t0\n")
+				require.Contains(t, out, "lib.init:\nmovl %ebx, -8(%esp)\nmovl %esi, -12(%esp)\nmovl %edi, -16(%esp)\nmovl %ebp, -20(%esp)\nmovl lisp_heap, %esi\n")
+				require.Contains(t, out, "movl %esi, lisp_heap\nmovl -8(%esp), %ebx\nmovl -12(%esp), %esi\nmovl -16(%esp), %edi\nmovl -20(%esp), %ebp\nret\n")
+			} else {
+				require.NotContains(t, out, "lisp_init")
+				require.Contains(t, out, "entry.init:\nmovl %ebx, -8(%esp)\nmovl %esi, -12(%esp)\nmovl %edi, -16(%esp)\nmovl %ebp, -20(%esp)\nmovl lisp_heap, %esi\n")
+				require.Contains(t, out, "movl %esi, lisp_heap\nmovl -8(%esp), %ebx\n")
+			}
+		})
+	}
+}
+
+func TestCompileDefinitionsOnlyEntry(t *testing.T) {
+	tokens, err := parser.Tokenize(`(lisp_entry ((x (global))) () () (global-set! x (display 1)))`)
+	require.NoError(t, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(t, err)
+
+	w := &bytes.Buffer{}
+	c := NewCompiler(w)
+	err = c.Compile(exprs[0])
+	require.NoError(t, err)
+
+	// the runtime calls the entry point after the initialisers,
+	// so it must not be one of them
+	out := w.String()
+	require.NotContains(t, out, "lisp_init")
+	require.Equal(t, 1, strings.Count(out, "\nlisp_entry:\n"))
+	require.Contains(t, out, "call lisp_display\n")
+}
+
+func TestCompileProcedureValues(t *testing.T) {
+	tokens, err := parser.Tokenize(`(entry
+	  ((f (code (x) () x)))
+	  ()
+	  ((g (code () () 1)) (f0 (code () (y) y)))
+	  f g)`)
+	require.NoError(t, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(t, err)
+
+	w := &bytes.Buffer{}
+	c := NewCompiler(w)
+	err = c.Compile(exprs[0])
+	require.NoError(t, err)
+
+	out := w.String()
+	require.Contains(t, out, "\t.global\tf.closure\n\t.align\t8\nf.closure:\n\t.long\tf\n")
+	require.Contains(t, out, "\t.align\t8\ng.closure:\n\t.long\tg\n")
+	require.NotContains(t, out, ".global\tg.closure")
+	// closures capturing variables are allocated when created
+	require.NotContains(t, out, "f0.closure")
+	require.Contains(t, out, "movl $f.closure, %eax\norl $6, %eax\n")
+	require.Contains(t, out, "movl $g.closure, %eax\norl $6, %eax\n")
+
+	tokens, err = parser.Tokenize("(entry () () () h)")
+	require.NoError(t, err)
+	exprs, err = parser.Parse(tokens)
+	require.NoError(t, err)
+
+	err = NewCompiler(&bytes.Buffer{}).Compile(exprs[0])
+	require.ErrorContains(t, err, "unbound variable 'h'")
+}
+
+func TestPeephole(t *testing.T) {
+	tokens, err := parser.Tokenize("(code (x) () (if (char<? x (integer->char 65)) (car x) x))")
+	require.NoError(t, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(t, err)
+
+	w := &bytes.Buffer{}
+	c := NewCompiler(w)
+	c.Safety = SafetyNone
+	c.Registers = false
+	err = compileExpr(c, exprs[0])
+	require.NoError(t, err)
+
+	// the character is folded, the comparison is fused
+	// with the jump and the argument is not reloaded
+	expected := `movl $0x410f, %eax
+movl %eax, -8(%esp)
+movl -4(%esp), %eax
+cmpl -8(%esp), %eax
+jge L0
+movl -1(%eax), %eax
+movl %eax, -20(%esp)
+movl %eax, -16(%esp)
+jmp L1
+L0:
+movl -4(%esp), %eax
+movl %eax, -16(%esp)
+L1:
+movl -16(%esp), %eax
+ret
+`
+	require.Equal(t, expected, w.String())
+}
+
+func TestRegisterAllocation(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{
+			code: "(code (x y) () (let ((a (+ x y))) (- a x)))",
+			expected: `movl -4(%esp), %ecx
+movl -8(%esp), %edx
+movl %ecx, %eax
+addl %edx, %eax
+movl %eax, %edx
+subl %ecx, %eax
+ret
+`,
+		},
+		{
+			// a is kept in its slot across the call
+			code: "(code (x y) () (let ((a (+ x y))) (f a) (- a x)))",
+			expected: `movl -8(%esp), %ecx
+movl -4(%esp), %eax
+addl %ecx, %eax
+movl %eax, -12(%esp)
+movl %eax, -28(%esp)
+movl $1, %ecx
+addl $-20, %esp
+call f
+addl $20, %esp
+movl %eax, %ecx
+movl -12(%esp), %eax
+subl -4(%esp), %eax
+ret
+`,
+		},
+		{
+			// %ebx is the scratch register of vector-ref
+			code: "(code (v i) () (vector-ref v i))",
+			expected: `movl -4(%esp), %ecx
+movl -8(%esp), %edx
+movl %edx, %eax
+movl %ecx, %ebx
+movl 2(%ebx,%eax), %eax
+ret
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			w := &bytes.Buffer{}
+			c := NewCompiler(w)
+			c.Safety = SafetyNone
+			err = compileExpr(c, exprs[0])
 			require.NoError(t, err)
 			require.Equal(t, tt.expected, w.String())
 		})
 	}
 }
 
+func TestRegisterPressure(t *testing.T) {
+	tokens, err := parser.Tokenize(`(code (a b c d e) ()
+	  (let* ((x (+ a b)) (y (+ c d)) (z (+ e a)) (w (+ x y)) (u (+ b z)))
+	    (+ (+ x y) (+ (+ z w) (+ u e)))))`)
+	require.NoError(t, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(t, err)
+
+	w := &bytes.Buffer{}
+	c := NewCompiler(w)
+	c.Safety = SafetyNone
+	err = compileExpr(c, exprs[0])
+	require.NoError(t, err)
+
+	// with the other parameters in the four registers, e stays
+	// in its slot, and x is spilled to its own
+	out := w.String()
+	require.True(t, strings.HasPrefix(out, "movl -4(%esp), %ecx\nmovl -8(%esp), %edx\nmovl -12(%esp), %ebx\nmovl -16(%esp), %ebp\n"))
+	require.Contains(t, out, "movl %eax, -24(%esp)\n")
+	require.Contains(t, out, "addl -20(%esp), %eax\n")
+}
+
+// BenchmarkRegisters compiles a procedure with and without register
+// allocation, reporting the instructions of the code accessing the
+// stack frame
+func BenchmarkRegisters(b *testing.B) {
+	tokens, err := parser.Tokenize(`(code (v i acc) ()
+	  (let* ((x (vector-ref v i)) (y (+ x x)) (z (- y i)))
+	    (+ acc (- z x))))`)
+	require.NoError(b, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(b, err)
+
+	for _, registers := range []bool{false, true} {
+		b.Run(fmt.Sprintf("registers=%t", registers), func(b *testing.B) {
+			w := &bytes.Buffer{}
+			for i := 0; i < b.N; i++ {
+				w.Reset()
+				c := NewCompiler(w)
+				c.Registers = registers
+				require.NoError(b, compileExpr(c, exprs[0]))
+			}
+			b.ReportMetric(float64(strings.Count(w.String(), "(%esp)")), "stack-accesses")
+			b.ReportMetric(float64(strings.Count(w.String(), "\n")), "lines")
+		})
+	}
+}
+
+func TestCompileIntelSyntax(t *testing.T) {
+	tokens, err := parser.Tokenize("(entry ((x (global))) () () (global-set! x (car (global-ref x))))")
+	require.NoError(t, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(t, err)
+
+	w := &bytes.Buffer{}
+	c := NewCompiler(w)
+	c.Syntax = asm.Intel
+	c.Registers = false
+	err = c.Compile(exprs[0])
+	require.NoError(t, err)
+
+	expected := `	.intel_syntax noprefix
+	.data
+	.align	8
+	.global	x
+	.align	8
+x:
+	.long	0
+	.section	lisp_init, "aw"
+	.align	4
+	.long	entry.init
+	.text
+	.p2align	2
+	.global	entry.init
+entry.init:
+mov dword ptr [esp-12], ebx
+mov dword ptr [esp-16], esi
+mov dword ptr [esp-20], edi
+mov dword ptr [esp-24], ebp
+mov esi, dword ptr [lisp_heap]
+mov eax, dword ptr [x]
+mov dword ptr [esp-4], eax
+mov ebx, eax
+and ebx, 0x7
+cmp ebx, 0x1
+jne L0
+mov eax, dword ptr [eax-1]
+mov dword ptr [esp-8], eax
+mov dword ptr [x], eax
+mov eax, dword ptr [esp-8]
+mov dword ptr [lisp_heap], esi
+mov ebx, dword ptr [esp-12]
+mov esi, dword ptr [esp-16]
+mov edi, dword ptr [esp-20]
+mov ebp, dword ptr [esp-24]
+ret
+L0:
+and esp, -16
+sub esp, 4
+push eax
+push offset L2
+push offset L1
+call lisp_type_error
+	.section	.rodata
+L1:
+	.asciz	"car"
+L2:
+	.asciz	"pair"
+`
+	require.Equal(t, expected, w.String())
+
+	// symbols named like registers would be read as registers
+	tokens, err = parser.Tokenize("(entry ((ecx (code (x) () x)) (eax (global))) () () (global-set! eax (ecx 1)))")
+	require.NoError(t, err)
+	exprs, err = parser.Parse(tokens)
+	require.NoError(t, err)
+
+	w = &bytes.Buffer{}
+	c = NewCompiler(w)
+	c.Syntax = asm.Intel
+	err = c.Compile(exprs[0])
+	require.NoError(t, err)
+	require.Contains(t, w.String(), "call _65_cx\n")
+	require.Contains(t, w.String(), "dword ptr [_65_ax]")
+}
+
+func TestLower(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{
+			code: "(entry () () () (let ((x 1) (y (add1 2))) (+ x y)))",
+			expected: `unit entry
+proc entry entry
+	t0 = add1 8
+	t1 = + 4 t0
+	return t1
+`,
+		},
+		{
+			code: `(entry
+			  ((f (code (x . r) () (if (null? r) x (car r)))))
+			  ((s0 (string-init "hi")))
+			  ((f0 (code (y) (x) (f x y))))
+			  (display (string-ref s0))
+			  (funcall (closure f0 5) 2))`,
+			expected: `unit entry
+data s0 string "hi"
+proc f params 1 variadic export
+	t2 = null? t1
+	jump L0 unless t2
+	t3 = t0
+	jump L1
+L0:
+	t4 = car t1
+	t3 = t4
+L1:
+	return t3
+proc f0 params 1 free 1
+	t1 = free 0
+	t2 = call f t1 t0
+	return t2
+proc entry entry
+	t0 = address s0 3
+	t1 = display t0
+	t2 = closure f0 20
+	t3 = callclosure t2 8
+	return t3
+`,
+		},
+		{
+			code: "(lib ((x (global))) () () (global-set! x (read-line)))",
+			expected: `unit lib initialiser
+data x global export
+proc lib entry
+	t0 = read-line 79
+	global x = t0
+	return t0
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			u, err := NewCompiler(&bytes.Buffer{}).Lower(exprs[0])
+			require.NoError(t, err)
+			require.NoError(t, ir.Verify(u))
+			require.Equal(t, tt.expected, u.String())
+		})
+	}
+}
+
+func TestPrimitives(t *testing.T) {
+	for name := range ir.Primitives {
+		require.Contains(t, primitives, name)
+	}
+	for name := range primitives {
+		require.Contains(t, ir.Primitives, name)
+	}
+}
@@ -0,0 +1,185 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+)
+
+// Signature describes the arguments taken by a procedure:
+// Arity required ones, and any number of others when Variadic
+type Signature struct {
+	Arity    int
+	Variadic bool
+}
+
+func (s Signature) accepts(n int) bool {
+	if s.Variadic {
+		return n >= s.Arity
+	}
+	return n == s.Arity
+}
+
+func (s Signature) String() string {
+	plural := "s"
+	if s.Arity == 1 {
+		plural = ""
+	}
+	if s.Variadic {
+		return fmt.Sprintf("at least %d argument%s", s.Arity, plural)
+	}
+	return fmt.Sprintf("%d argument%s", s.Arity, plural)
+}
+
+// checkCall checks a call to the procedure with the given name
+// and number of arguments against its signature
+func (c *Compiler) checkCall(name string, n int) error {
+	sig, ok := c.procedures[name]
+	if !ok {
+		if c.Imports == nil {
+			return nil
+		}
+		return fmt.Errorf("call to undefined procedure '%s'", name)
+	}
+	if !sig.accepts(n) {
+		return fmt.Errorf("procedure '%s' takes %s, called with %d", name, sig, n)
+	}
+	return nil
+}
+
+// Interface lists the procedures and global variables exported by
+// a compilation unit, so that references to them can be checked when
+// compiling other units. Its textual form is
+//
+//	(interface <unit>
+//	  [(import <module>...)]
+//	  [(global <variable>...)]
+//	  (<procedure> <arity> <variadic>)...)
+//
+// where the modules imported by the unit, if any, are listed so
+// that they can be linked with it.
+type Interface struct {
+	Name    string
+	Imports []string
+	Globals []string
+	Exports map[string]Signature
+}
+
+// InterfaceOf returns the interface of a preprocessed compilation unit
+func InterfaceOf(e expr.E) (Interface, error) {
+	if e.Typ != expr.ExprList || len(e.List) < 2 || e.List[0].Typ != expr.ExprIdent {
+		return Interface{}, fmt.Errorf("input is no in expected format")
+	}
+
+	i := Interface{
+		Name:    e.List[0].Ident,
+		Exports: make(map[string]Signature),
+	}
+
+	for _, export := range e.List[1].List {
+		if len(export.List) != 2 || export.List[0].Typ != expr.ExprIdent {
+			return Interface{}, fmt.Errorf("malformed export %s", export.String())
+		}
+		if isGlobal(export.List[1]) {
+			i.Globals = append(i.Globals, export.List[0].Ident)
+			continue
+		}
+		sig, err := signatureOf(export.List[1])
+		if err != nil {
+			return Interface{}, fmt.Errorf("error in export %s: %w", export.List[0].Ident, err)
+		}
+		i.Exports[export.List[0].Ident] = sig
+	}
+
+	return i, nil
+}
+
+// signatureOf returns the signature of a code form
+func signatureOf(code expr.E) (Signature, error) {
+	if code.Typ != expr.ExprList || len(code.List) < 2 || !expr.IsIdent(code.List[0], "code") {
+		return Signature{}, fmt.Errorf("malformed code form")
+	}
+	required, rest, err := expr.SplitParams(code.List[1])
+	if err != nil {
+		return Signature{}, err
+	}
+	return Signature{Arity: len(required), Variadic: rest.Typ == expr.ExprIdent}, nil
+}
+
+// Expr returns the textual form of the interface,
+// with the procedures in order
+func (i Interface) Expr() expr.E {
+	names := make([]string, 0, len(i.Exports))
+	for name := range i.Exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	elems := []expr.E{expr.Id("interface"), expr.Id(i.Name)}
+	if len(i.Imports) > 0 {
+		imports := []expr.E{expr.Id("import")}
+		for _, name := range i.Imports {
+			imports = append(imports, expr.Id(name))
+		}
+		elems = append(elems, expr.L(imports...))
+	}
+	if len(i.Globals) > 0 {
+		globals := []expr.E{expr.Id("global")}
+		for _, name := range i.Globals {
+			globals = append(globals, expr.Id(name))
+		}
+		elems = append(elems, expr.L(globals...))
+	}
+	for _, name := range names {
+		sig := i.Exports[name]
+		elems = append(elems, expr.L(expr.Id(name), expr.N(sig.Arity), expr.B(sig.Variadic)))
+	}
+	return expr.L(elems...)
+}
+
+// ParseInterface reads an interface from its textual form
+func ParseInterface(e expr.E) (Interface, error) {
+	if e.Typ != expr.ExprList || len(e.List) < 2 ||
+		!expr.IsIdent(e.List[0], "interface") || e.List[1].Typ != expr.ExprIdent {
+		return Interface{}, fmt.Errorf("malformed interface")
+	}
+
+	i := Interface{
+		Name:    e.List[1].Ident,
+		Exports: make(map[string]Signature),
+	}
+
+	procs := e.List[2:]
+	for _, clause := range []struct {
+		name  string
+		names *[]string
+	}{{"import", &i.Imports}, {"global", &i.Globals}} {
+		if len(procs) == 0 || procs[0].Typ != expr.ExprList ||
+			len(procs[0].List) == 0 || !expr.IsIdent(procs[0].List[0], clause.name) {
+			continue
+		}
+		for _, name := range procs[0].List[1:] {
+			if name.Typ != expr.ExprIdent {
+				return Interface{}, fmt.Errorf("malformed %s %s in interface", clause.name, name.String())
+			}
+			*clause.names = append(*clause.names, name.Ident)
+		}
+		procs = procs[1:]
+	}
+
+	for _, proc := range procs {
+		if proc.Typ != expr.ExprList || len(proc.List) != 3 ||
+			proc.List[0].Typ != expr.ExprIdent ||
+			proc.List[1].Typ != expr.ExprNumber ||
+			proc.List[2].Typ != expr.ExprBool {
+			return Interface{}, fmt.Errorf("malformed procedure %s in interface", proc.String())
+		}
+		i.Exports[proc.List[0].Ident] = Signature{
+			Arity:    proc.List[1].Number,
+			Variadic: proc.List[2].Bool,
+		}
+	}
+
+	return i, nil
+}
@@ -0,0 +1,582 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+	"github.com/brenoafb/tinycompiler/pkg/ir"
+)
+
+// binding is where the value of a variable is found:
+// in a value of the procedure, or in its closure
+type binding struct {
+	free  bool
+	index int
+	value ir.Value
+}
+
+// lowerer translates the expressions of a procedure into its code
+type lowerer struct {
+	c    *Compiler
+	proc *ir.Proc
+	env  map[string]binding
+}
+
+// defaults holds the argument passed to primitives
+// taking an optional last argument when it is omitted
+var defaults = map[string]expr.E{
+	"read-line":    expr.L(expr.Id("current-input-port")),
+	"write-string": expr.L(expr.Id("current-output-port")),
+	"exit":         expr.N(0),
+}
+
+// Lower translates a preprocessed compilation unit into the IR
+func (c *Compiler) Lower(e expr.E) (*ir.Unit, error) {
+	// we expect input to have format
+	// (ident (<exported definitions>)
+	//        (<constants>)
+	//        (<internal procedures>)
+	//   <body>)
+	if e.Typ != expr.ExprList {
+		return nil, fmt.Errorf("input is no in expected format")
+	}
+
+	elems := e.List
+
+	if len(elems) < 5 {
+		return nil, fmt.Errorf("top-level form must contain at least 5 elements")
+	}
+
+	if elems[0].Typ != expr.ExprIdent {
+		return nil, fmt.Errorf("malformed top-level form: name is not ident")
+	}
+
+	for i, name := range []string{"exports", "constants", "procedures"} {
+		if elems[i+1].Typ != expr.ExprList && elems[i+1].Typ != expr.ExprNil {
+			return nil, fmt.Errorf("malformed top-level form: %s entry is not list", name)
+		}
+	}
+
+	exports := elems[1].List
+	cvars := elems[2].List
+	lvars := elems[3].List
+	body := elems[4:]
+
+	u := &ir.Unit{
+		Name:        elems[0].Ident,
+		Initialiser: isInitialiser(elems[0].Ident, body),
+	}
+
+	definitions := func(kind string, es []expr.E) ([]string, []expr.E, error) {
+		names := make([]string, 0, len(es))
+		bodies := make([]expr.E, 0, len(es))
+		for i, e := range es {
+			if e.Typ != expr.ExprList || len(e.List) != 2 || e.List[0].Typ != expr.ExprIdent {
+				return nil, nil, fmt.Errorf("malformed top-level form: bad %s at index %d", kind, i)
+			}
+			names = append(names, e.List[0].Ident)
+			bodies = append(bodies, e.List[1])
+		}
+		return names, bodies, nil
+	}
+
+	exportNames, exportBodies, err := definitions("export", exports)
+	if err != nil {
+		return nil, err
+	}
+	constNames, constBodies, err := definitions("constant", cvars)
+	if err != nil {
+		return nil, err
+	}
+	localNames, localBodies, err := definitions("procedure", lvars)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signatures of all procedures are known before
+	// any call to them is lowered
+	c.procedures = make(map[string]Signature)
+	for name, sig := range c.Imports {
+		c.procedures[name] = sig
+	}
+	for i, name := range exportNames {
+		if isGlobal(exportBodies[i]) {
+			continue
+		}
+		sig, err := signatureOf(exportBodies[i])
+		if err != nil {
+			return nil, fmt.Errorf("malformed export %s: %w", name, err)
+		}
+		c.procedures[name] = sig
+	}
+	for i, name := range localNames {
+		if sig, err := signatureOf(localBodies[i]); err == nil {
+			c.procedures[name] = sig
+		}
+	}
+
+	for i, name := range constNames {
+		d, err := lowerData(name, constBodies[i])
+		if err != nil {
+			return nil, fmt.Errorf("malformed constant %s: %w", name, err)
+		}
+		u.Data = append(u.Data, d)
+	}
+
+	// exports are kept in the order they are given,
+	// so that the output is deterministic
+	for i, name := range exportNames {
+		if isGlobal(exportBodies[i]) {
+			u.Data = append(u.Data, ir.Data{Name: name, Kind: ir.GlobalData, Exported: true})
+			continue
+		}
+		p, err := c.lowerCode(name, exportBodies[i])
+		if err != nil {
+			return nil, fmt.Errorf("error compiling export body: %w", err)
+		}
+		p.Exported = true
+		u.Procs = append(u.Procs, p)
+	}
+
+	for i, name := range localNames {
+		p, err := c.lowerCode(name, localBodies[i])
+		if err != nil {
+			return nil, fmt.Errorf("error compiling procedure %s: %w", name, err)
+		}
+		u.Procs = append(u.Procs, p)
+	}
+
+	u.Entry, err = c.lowerEntry(u.Name, body)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling body in _main form: %w", err)
+	}
+
+	return u, nil
+}
+
+// lowerData translates a constant, which is a string or
+// a global variable private to the unit
+func lowerData(name string, e expr.E) (ir.Data, error) {
+	if isGlobal(e) {
+		return ir.Data{Name: name, Kind: ir.GlobalData}, nil
+	}
+	if e.Typ == expr.ExprList && len(e.List) > 0 && expr.IsIdent(e.List[0], "string-init") {
+		if len(e.List) != 2 || e.List[1].Typ != expr.ExprString {
+			return ir.Data{}, fmt.Errorf("string-init: argument must be string")
+		}
+		return ir.Data{Name: name, Kind: ir.StringData, Str: e.List[1].Str}, nil
+	}
+	return ir.Data{}, fmt.Errorf("unsupported constant %s", e.String())
+}
+
+// lowerCode translates a code form
+//
+//	(code (<parameters>) (<free variables>) <body>...)
+//
+// into a procedure
+func (c *Compiler) lowerCode(name string, e expr.E) (*ir.Proc, error) {
+	elems := e.List
+	if e.Typ != expr.ExprList || len(elems) == 0 || !expr.IsIdent(elems[0], "code") {
+		return nil, fmt.Errorf("procedure %s is not a 'code' form", name)
+	}
+	if len(elems) < 4 {
+		return nil, fmt.Errorf("'code' form must contain at least 3 parameters")
+	}
+
+	arglist, rest, err := expr.SplitParams(elems[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed 'code' form: %w", err)
+	}
+
+	if elems[2].Typ != expr.ExprList && elems[2].Typ != expr.ExprNil {
+		return nil, fmt.Errorf("malformed 'code' form")
+	}
+	freevars := elems[2].List
+
+	l := c.newLowerer(&ir.Proc{
+		Name:     name,
+		Params:   len(arglist),
+		Variadic: rest.Typ == expr.ExprIdent,
+		Free:     len(freevars),
+	})
+
+	// the arguments are held by the first temporaries,
+	// and the excess ones are collected into a list
+	for _, arg := range arglist {
+		l.env[arg.Ident] = binding{value: ir.T(l.proc.NewTemp())}
+	}
+	if l.proc.Variadic {
+		l.env[rest.Ident] = binding{value: ir.T(l.proc.NewTemp())}
+	}
+
+	for i, arg := range freevars {
+		if arg.Typ != expr.ExprIdent {
+			return nil, fmt.Errorf("malformed 'code' form")
+		}
+		l.env[arg.Ident] = binding{free: true, index: i}
+	}
+
+	v, err := l.lowerBody(elems[3:])
+	if err != nil {
+		return nil, fmt.Errorf("error compiling body in 'code' form: %w", err)
+	}
+	l.proc.Emit(ir.Instr{Op: ir.Return, Args: []ir.Value{v}})
+
+	return l.proc, nil
+}
+
+// lowerEntry translates the top-level body of a unit into its entry point
+func (c *Compiler) lowerEntry(name string, body []expr.E) (*ir.Proc, error) {
+	l := c.newLowerer(&ir.Proc{Name: name, Entry: true})
+
+	v := ir.Imm(emptyList)
+	for _, e := range body {
+		var err error
+		v, err = l.lowerExpr(e)
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.proc.Emit(ir.Instr{Op: ir.Return, Args: []ir.Value{v}})
+
+	return l.proc, nil
+}
+
+func (c *Compiler) newLowerer(p *ir.Proc) *lowerer {
+	return &lowerer{
+		c:    c,
+		proc: p,
+		env:  make(map[string]binding),
+	}
+}
+
+// lowerBody lowers a sequence of expressions, returning
+// the value of the last one
+func (l *lowerer) lowerBody(body []expr.E) (ir.Value, error) {
+	v := ir.Imm(emptyList)
+	for i, e := range body {
+		var err error
+		v, err = l.lowerExpr(e)
+		if err != nil {
+			return v, fmt.Errorf("error compiling body expression at index %d: %w", i, err)
+		}
+	}
+	return v, nil
+}
+
+// lowerAll lowers expressions from left to right, returning their values
+func (l *lowerer) lowerAll(es []expr.E) ([]ir.Value, error) {
+	vs := make([]ir.Value, 0, len(es))
+	for _, e := range es {
+		v, err := l.lowerExpr(e)
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+// emit appends an instruction assigning a new temporary,
+// and returns its value
+func (l *lowerer) emit(in ir.Instr) ir.Value {
+	in.Dst = l.proc.NewTemp()
+	l.proc.Emit(in)
+	return ir.T(in.Dst)
+}
+
+func (l *lowerer) lowerExpr(e expr.E) (ir.Value, error) {
+	switch e.Typ {
+	case expr.ExprIdent:
+		v := e.Ident
+		b, ok := l.env[v]
+		if !ok {
+			if _, ok := l.c.procedures[v]; ok {
+				return l.emit(ir.Instr{Op: ir.MakeClosure, Name: v}), nil
+			}
+			return ir.Value{}, fmt.Errorf("unbound variable '%s'", v)
+		}
+		if b.free {
+			return l.emit(ir.Instr{Op: ir.LoadFree, Index: b.index}), nil
+		}
+		return b.value, nil
+	case expr.ExprNumber:
+		return ir.Imm(e.Number << fixnumShift), nil
+	case expr.ExprNil:
+		return ir.Imm(emptyList), nil
+	case expr.ExprBool:
+		if e.Bool {
+			return ir.Imm(immTrue), nil
+		}
+		return ir.Imm(immFalse), nil
+	case expr.ExprList:
+		elems := e.List
+		if len(elems) == 0 {
+			return ir.Imm(emptyList), nil
+		}
+
+		head := elems[0]
+		switch head.Typ {
+		case expr.ExprIdent:
+			if form, ok := specialForms[head.Ident]; ok {
+				return form(l, elems)
+			}
+
+			if _, ok := ir.Primitives[head.Ident]; ok {
+				return l.lowerPrimitive(elems)
+			}
+
+			if _, ok := l.env[head.Ident]; ok {
+				return l.lowerFuncall(elems)
+			}
+
+			// assume the procedure is defined as a label
+			return l.lowerLabelcall(elems)
+		case expr.ExprList:
+			return l.lowerFuncall(elems)
+		}
+
+		return ir.Value{}, fmt.Errorf("unsupported operation %s", head.String())
+	default:
+		return ir.Value{}, fmt.Errorf("error compiling code: %+v", e.String())
+	}
+}
+
+// lowerPrimitive lowers the application of a primitive operation
+func (l *lowerer) lowerPrimitive(elems []expr.E) (ir.Value, error) {
+	op := elems[0].Ident
+	n := ir.Primitives[op]
+
+	if def, ok := defaults[op]; ok && len(elems) == n {
+		elems = append(elems[:n:n], def)
+	}
+	if n >= 0 && len(elems) != n+1 {
+		if n == 1 {
+			return ir.Value{}, fmt.Errorf("%s requires 1 parameter", op)
+		}
+		return ir.Value{}, fmt.Errorf("%s requires %d parameters", op, n)
+	}
+
+	args, err := l.lowerAll(elems[1:])
+	if err != nil {
+		return ir.Value{}, fmt.Errorf("error compiling '%s' application: %w", op, err)
+	}
+
+	return l.emit(ir.Instr{Op: ir.Prim, Name: op, Args: args}), nil
+}
+
+// lowerLabelcall lowers a call to a procedure known by its name,
+// i.e. the elements of a (labelcall <name> <args>...) form
+// without the labelcall
+func (l *lowerer) lowerLabelcall(elems []expr.E) (ir.Value, error) {
+	if elems[0].Typ != expr.ExprIdent {
+		return ir.Value{}, fmt.Errorf("malformed 'labelcall' form")
+	}
+
+	name := elems[0].Ident
+	if err := l.c.checkCall(name, len(elems)-1); err != nil {
+		return ir.Value{}, err
+	}
+
+	args, err := l.lowerAll(elems[1:])
+	if err != nil {
+		return ir.Value{}, fmt.Errorf("error compiling argument in labelcall: %w", err)
+	}
+
+	return l.emit(ir.Instr{Op: ir.Call, Name: name, Args: args}), nil
+}
+
+// lowerFuncall lowers a call to the closure which is the value
+// of the first element, i.e. the elements of a (funcall <f> <args>...)
+// form without the funcall
+func (l *lowerer) lowerFuncall(elems []expr.E) (ir.Value, error) {
+	f, err := l.lowerExpr(elems[0])
+	if err != nil {
+		return ir.Value{}, fmt.Errorf("error compiling function in funcall: %w", err)
+	}
+
+	args, err := l.lowerAll(elems[1:])
+	if err != nil {
+		return ir.Value{}, fmt.Errorf("error compiling argument in funcall: %w", err)
+	}
+
+	return l.emit(ir.Instr{Op: ir.CallClosure, Args: append([]ir.Value{f}, args...)}), nil
+}
+
+type specialForm func(l *lowerer, elems []expr.E) (ir.Value, error)
+
+var specialForms map[string]specialForm
+
+func init() {
+	specialForms = map[string]specialForm{
+		"progn": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			return l.lowerBody(elems[1:])
+		},
+		"define": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			return ir.Value{}, fmt.Errorf("'define' is only supported at top level and at the beginning of a body")
+		},
+		"let":  lowerLet,
+		"let*": lowerLet,
+		"if":   lowerIf,
+		"code": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			return ir.Value{}, fmt.Errorf("'code' form is only supported at top level")
+		},
+		"labelcall": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			if len(elems) < 2 {
+				return ir.Value{}, fmt.Errorf("labelcall form must contain at least 1 parameter")
+			}
+			return l.lowerLabelcall(elems[1:])
+		},
+		"funcall": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			if len(elems) < 2 {
+				return ir.Value{}, fmt.Errorf("funcall form must contain at least 1 parameter")
+			}
+			return l.lowerFuncall(elems[1:])
+		},
+		"closure": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			if len(elems) < 2 {
+				return ir.Value{}, fmt.Errorf("closure form must contain at least 1 parameter")
+			}
+			if elems[1].Typ != expr.ExprIdent {
+				return ir.Value{}, fmt.Errorf("malformed 'closure' form")
+			}
+			freevars, err := l.lowerAll(elems[2:])
+			if err != nil {
+				return ir.Value{}, fmt.Errorf("error compiling free variable in closure form: %w", err)
+			}
+			return l.emit(ir.Instr{Op: ir.MakeClosure, Name: elems[1].Ident, Args: freevars}), nil
+		},
+		"lambda": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			// 'lambda' shoudln't show up in preprocessed code,
+			// but we leave it here so that variable capture
+			// analysis is performed correctly
+			return ir.Value{}, fmt.Errorf("lambda is not implemented")
+		},
+		"string-ref": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			if len(elems) != 2 {
+				return ir.Value{}, fmt.Errorf("string-ref: must have one argument")
+			}
+			if elems[1].Typ != expr.ExprIdent {
+				return ir.Value{}, fmt.Errorf("string-ref: argument must be label")
+			}
+			return l.emit(ir.Instr{Op: ir.Address, Name: elems[1].Ident, Index: stringType.tag}), nil
+		},
+		"global-ref": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			if len(elems) != 2 || elems[1].Typ != expr.ExprIdent {
+				return ir.Value{}, fmt.Errorf("malformed global-ref expression")
+			}
+			return l.emit(ir.Instr{Op: ir.LoadGlobal, Name: elems[1].Ident}), nil
+		},
+		"global-set!": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			if len(elems) != 3 || elems[1].Typ != expr.ExprIdent {
+				return ir.Value{}, fmt.Errorf("malformed global-set! expression")
+			}
+			v, err := l.lowerExpr(elems[2])
+			if err != nil {
+				return ir.Value{}, fmt.Errorf("error compiling value in global-set! expression: %w", err)
+			}
+			l.proc.Emit(ir.Instr{Op: ir.StoreGlobal, Name: elems[1].Ident, Args: []ir.Value{v}})
+			return v, nil
+		},
+		"ccall": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			if len(elems) < 2 {
+				return ir.Value{}, fmt.Errorf("ccall must have at least one argument")
+			}
+			return ir.Value{}, fmt.Errorf("ccall: not implemented")
+		},
+
+		// ports are indices into the port table of the runtime
+		"current-input-port": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			return ir.Imm(0<<portShift | portTag), nil
+		},
+		"current-output-port": func(l *lowerer, elems []expr.E) (ir.Value, error) {
+			return ir.Imm(1<<portShift | portTag), nil
+		},
+	}
+}
+
+// lowerIf lowers an if expression, whose value is assigned
+// to the same temporary by both branches
+func lowerIf(l *lowerer, elems []expr.E) (ir.Value, error) {
+	if len(elems) != 4 {
+		return ir.Value{}, fmt.Errorf("malformed 'if' expression")
+	}
+
+	test, err := l.lowerExpr(elems[1])
+	if err != nil {
+		return ir.Value{}, fmt.Errorf("error compiling test in if expression: %w", err)
+	}
+
+	alt := l.proc.NewLabel()
+	done := l.proc.NewLabel()
+	result := l.proc.NewTemp()
+
+	l.proc.Emit(ir.Instr{Op: ir.JumpIfFalse, Args: []ir.Value{test}, Target: alt})
+
+	v, err := l.lowerExpr(elems[2])
+	if err != nil {
+		return ir.Value{}, fmt.Errorf("error compiling conseq in if expression: %w", err)
+	}
+	l.proc.Emit(ir.Instr{Op: ir.Move, Dst: result, Args: []ir.Value{v}})
+	l.proc.Emit(ir.Instr{Op: ir.Jump, Target: done})
+
+	l.proc.Emit(ir.Instr{Op: ir.Mark, Target: alt})
+	v, err = l.lowerExpr(elems[3])
+	if err != nil {
+		return ir.Value{}, fmt.Errorf("error compiling alt in if expression: %w", err)
+	}
+	l.proc.Emit(ir.Instr{Op: ir.Move, Dst: result, Args: []ir.Value{v}})
+
+	l.proc.Emit(ir.Instr{Op: ir.Mark, Target: done})
+
+	return ir.T(result), nil
+}
+
+// lowerLet lowers let and let* forms
+// in either the standard or the original syntax.
+// Variables are bound to the values of their expressions,
+// which are never assigned again.
+func lowerLet(l *lowerer, elems []expr.E) (ir.Value, error) {
+	if len(elems) < 2 {
+		return ir.Value{}, fmt.Errorf("malformed 'let' expression")
+	}
+	if expr.IsNamedLet(elems) {
+		return ir.Value{}, fmt.Errorf("named let must be expanded by the preprocessor")
+	}
+
+	bindings, body, sequential := expr.SplitLet(elems)
+
+	outer := l.env
+	env := make(map[string]binding, len(outer)+len(bindings))
+	for k, b := range outer {
+		env[k] = b
+	}
+
+	for i, b := range bindings {
+		xs := b.List
+		if xs[0].Typ != expr.ExprIdent {
+			return ir.Value{}, fmt.Errorf(
+				"error compiling let binding: variable at index %d is not identifier",
+				i,
+			)
+		}
+		v, err := l.lowerExpr(xs[1])
+		if err != nil {
+			return ir.Value{}, fmt.Errorf("error compiling let binding: %w", err)
+		}
+		env[xs[0].Ident] = binding{value: v}
+		if sequential {
+			// the binding is visible to the following ones
+			l.env = env
+		}
+	}
+
+	l.env = env
+	v, err := l.lowerBody(body)
+	l.env = outer
+	if err != nil {
+		return ir.Value{}, fmt.Errorf("error compiling let binding body: %w", err)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,224 @@
+package compiler
+
+import (
+	"sort"
+
+	"github.com/brenoafb/tinycompiler/pkg/asm"
+	"github.com/brenoafb/tinycompiler/pkg/ir"
+)
+
+// registers holds the registers temporaries are allocated to.
+// %eax holds the results of instructions, and %esi and %edi
+// the heap and the closure pointers.
+var registers = []asm.Reg{asm.ECX, asm.EDX, asm.EBX, asm.EBP}
+
+// calleeSaved holds the registers which the C calling convention
+// requires entry points to preserve. The code uses all of them,
+// whether or not temporaries are allocated to registers.
+var calleeSaved = []asm.Reg{asm.EBX, asm.ESI, asm.EDI, asm.EBP}
+
+// regSet is a set of allocated registers, by their index in registers
+type regSet uint8
+
+var allRegisters = regSet(1)<<len(registers) - 1
+
+func (s regSet) has(i int) bool {
+	return s&(1<<i) != 0
+}
+
+func (s *regSet) add(r asm.Reg) {
+	for i, reg := range registers {
+		if reg == r {
+			*s |= 1 << i
+		}
+	}
+}
+
+// interval is the range of instructions over which a temporary
+// holds a value: from its first assignment to its last use.
+// Parameters are assigned before the first instruction.
+type interval struct {
+	temp       ir.Temp
+	start, end int
+}
+
+// allocateRegisters assigns registers to the temporaries of p by
+// a linear scan over their live intervals, leaving in the stack
+// frame those which cannot be kept in a register.
+// As jumps only go forward, a temporary is live over the whole of its
+// interval, and two temporaries whose intervals are disjoint can share
+// a register. A register can't hold a temporary across instructions
+// writing it: calls, which may change every register, and primitives
+// using it as scratch, which is done before all their operands are read.
+func (c *Compiler) allocateRegisters(p *ir.Proc) map[ir.Temp]asm.Reg {
+	intervals := liveIntervals(p, c.kept)
+
+	// the number of instructions before each position
+	// clobbering each register before or after reading operands
+	early := make([][]int, len(registers))
+	late := make([][]int, len(registers))
+	for r := range registers {
+		early[r] = make([]int, len(p.Code)+1)
+		late[r] = make([]int, len(p.Code)+1)
+	}
+	for i, in := range p.Code {
+		var before, after regSet
+		switch in.Op {
+		case ir.Call, ir.CallClosure:
+			after = allRegisters
+		case ir.Prim:
+			before = c.scratch(in)
+		}
+		for r := range registers {
+			early[r][i+1] = early[r][i]
+			late[r][i+1] = late[r][i]
+			if before.has(r) {
+				early[r][i+1]++
+			}
+			if after.has(r) {
+				late[r][i+1]++
+			}
+		}
+	}
+
+	// fits reports whether register r can hold a temporary
+	// over the interval iv. Its operands are read at the end,
+	// and it is assigned when the instruction at the start completes.
+	fits := func(iv interval, r int) bool {
+		from := iv.start + 1
+		if from > iv.end {
+			return true
+		}
+		return early[r][iv.end+1] == early[r][from] && late[r][iv.end] == late[r][from]
+	}
+
+	regs := make(map[ir.Temp]asm.Reg)
+	// the intervals holding each register
+	active := make([]*interval, len(registers))
+	for i := range intervals {
+		iv := &intervals[i]
+
+		chosen := -1
+		for r := range registers {
+			// a register is free again once its interval has ended,
+			// as operands are read before results are written
+			if active[r] != nil && active[r].end <= iv.start {
+				active[r] = nil
+			}
+			if chosen < 0 && active[r] == nil && fits(*iv, r) {
+				chosen = r
+			}
+		}
+
+		if chosen < 0 {
+			// spill the interval ending last, keeping
+			// the registers free for the others sooner
+			for r := range registers {
+				a := active[r]
+				if a == nil || a.end <= iv.end || !fits(*iv, r) {
+					continue
+				}
+				if chosen < 0 || a.end > active[chosen].end {
+					chosen = r
+				}
+			}
+			if chosen < 0 {
+				continue
+			}
+			delete(regs, active[chosen].temp)
+		}
+
+		active[chosen] = iv
+		regs[iv.temp] = registers[chosen]
+	}
+	return regs
+}
+
+// liveIntervals returns the intervals of the temporaries of p, other
+// than those skipped, ordered by their start
+func liveIntervals(p *ir.Proc, skip map[ir.Temp]bool) []interval {
+	start := make([]int, p.Temps)
+	end := make([]int, p.Temps)
+	for t := range start {
+		start[t] = len(p.Code)
+		end[t] = -1
+	}
+	for t := 0; t < p.ParamTemps(); t++ {
+		start[t] = -1
+	}
+
+	mention := func(t ir.Temp, i int) {
+		if i < start[t] {
+			start[t] = i
+		}
+		if i > end[t] {
+			end[t] = i
+		}
+	}
+	for i, in := range p.Code {
+		for _, v := range in.Args {
+			if v.IsTemp() {
+				mention(v.Temp, i)
+			}
+		}
+		if in.HasDst() {
+			mention(in.Dst, i)
+		}
+	}
+
+	intervals := []interval{}
+	for t := range start {
+		if end[t] < 0 || skip[ir.Temp(t)] {
+			continue
+		}
+		intervals = append(intervals, interval{temp: ir.Temp(t), start: start[t], end: end[t]})
+	}
+	sort.SliceStable(intervals, func(i, j int) bool {
+		return intervals[i].start < intervals[j].start
+	})
+	return intervals
+}
+
+// scratch returns the registers written by the code of a primitive,
+// found by emitting it apart with its operands in the stack frame
+func (c *Compiler) scratch(in ir.Instr) regSet {
+	s := &Compiler{Safety: c.Safety, proc: c.proc}
+	primitives[in.Name](s, in.Args)
+	return written(s.out)
+}
+
+// written returns the allocated registers written by lines
+func written(lines []asm.Line) regSet {
+	var s regSet
+	for _, l := range lines {
+		in, ok := l.(asm.Instr)
+		if !ok {
+			continue
+		}
+		switch in.Op {
+		case asm.Cmpl, asm.Testl, asm.Pushl, asm.Jmp, asm.Jcc, asm.Ret:
+		case asm.Call:
+			// the runtime follows the C calling convention
+			s.add(asm.ECX)
+			s.add(asm.EDX)
+		case asm.Negl, asm.Decl, asm.Popl, asm.Setcc:
+			s.add(widen(in.Args[0]))
+		default:
+			s.add(widen(in.Args[len(in.Args)-1]))
+		}
+	}
+	return s
+}
+
+// widen returns the register whose low byte is the operand o,
+// or o itself
+func widen(o asm.Operand) asm.Reg {
+	r, _ := o.(asm.Reg)
+	switch r {
+	case asm.AL:
+		return asm.EAX
+	case asm.DL:
+		return asm.EDX
+	}
+	return r
+}
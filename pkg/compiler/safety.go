@@ -0,0 +1,182 @@
+package compiler
+
+import (
+	"fmt"
+
+	"github.com/brenoafb/tinycompiler/pkg/asm"
+	"github.com/brenoafb/tinycompiler/pkg/ir"
+)
+
+// Safety levels select which runtime checks are emitted
+const (
+	// no runtime checks
+	SafetyNone = 0
+	// checks guarding memory accesses: arity, and the types
+	// of the operands of pair, vector and closure operations
+	SafetyMemory = 1
+	// all of the above plus the types of arithmetic
+	// and character operands
+	SafetyFull = 2
+)
+
+type valueType struct {
+	name string
+	mask int
+	tag  int
+}
+
+var (
+	// anyType accepts values of every type
+	anyType     = valueType{name: "any"}
+	fixnumType  = valueType{name: "fixnum", mask: 3, tag: fixnumTag}
+	charType    = valueType{name: "char", mask: 0xff, tag: charTag}
+	pairType    = valueType{name: "pair", mask: 7, tag: 1}
+	vectorType  = valueType{name: "vector", mask: 7, tag: 2}
+	stringType  = valueType{name: "string", mask: 7, tag: 3}
+	closureType = valueType{name: "closure", mask: 7, tag: 6}
+	portType    = valueType{name: "port", mask: 0xff, tag: portTag}
+	errorType   = valueType{name: "error object", mask: 0xff, tag: 0x5f}
+)
+
+// errorRoutine is an out of line routine calling
+// one of the runtime error functions. Its arguments are
+// the addresses of the given strings followed by the given registers.
+type errorRoutine struct {
+	label   string
+	routine string
+	strings []string
+	regs    []asm.Reg
+}
+
+// holds reports whether the tagged value x is of type t
+func (t valueType) holds(x int) bool {
+	return t == anyType || x&t.mask == t.tag
+}
+
+// checkType emits a check that %eax, holding v, is of type t,
+// reporting an error for op otherwise.
+// Nothing is emitted when the safety level is below level,
+// or when v is an immediate value of type t.
+func (c *Compiler) checkType(level int, op string, t valueType, v ir.Value) {
+	if c.Safety < level || (!v.IsTemp() && t.holds(v.Imm)) {
+		return
+	}
+
+	label := c.errorRoutineLabel("lisp_type_error", []string{op, t.name}, asm.EAX)
+
+	if t.tag == 0 {
+		c.ins(asm.Testl, asm.Int(t.mask), asm.EAX)
+	} else {
+		c.ins(asm.Movl, asm.EAX, asm.EBX)
+		c.ins(asm.Andl, asm.Hex(t.mask), asm.EBX)
+		c.ins(asm.Cmpl, asm.Hex(t.tag), asm.EBX)
+	}
+	c.emit(asm.J(asm.NE, label))
+}
+
+// loadChecked loads v into %eax and checks that it is of type t
+func (c *Compiler) loadChecked(level int, op string, t valueType, v ir.Value) {
+	c.load(v, asm.EAX)
+	c.checkType(level, op, t, v)
+}
+
+// checkOperands checks that the values vs are of type t,
+// loading into %eax those that need a check
+func (c *Compiler) checkOperands(level int, op string, t valueType, vs ...ir.Value) {
+	for _, v := range vs {
+		if c.Safety < level || (!v.IsTemp() && t.holds(v.Imm)) {
+			continue
+		}
+		c.loadChecked(level, op, t, v)
+	}
+}
+
+// checkVectorIndex checks that vector is a vector and that index
+// is a fixnum within its bounds, reporting an error for op otherwise
+func (c *Compiler) checkVectorIndex(op string, vector, index ir.Value) {
+	if c.Safety < SafetyMemory {
+		return
+	}
+
+	c.checkOperands(SafetyMemory, op, vectorType, vector)
+	c.loadChecked(SafetyMemory, op, fixnumType, index)
+
+	label := c.errorRoutineLabel("lisp_range_error", []string{op}, asm.EAX, asm.EBX)
+
+	c.load(vector, asm.EBX)
+
+	// the index and the length are both fixnums, and an unsigned
+	// comparison also catches negative indices
+	c.ins(asm.Cmpl, asm.At(-vectorType.tag, asm.EBX), asm.EAX)
+	c.emit(asm.J(asm.AE, label))
+}
+
+func (c *Compiler) errorRoutineLabel(routine string, strings []string, regs ...asm.Reg) string {
+	for _, r := range c.errorRoutines {
+		if r.routine == routine && equal(r.strings, strings) && equal(r.regs, regs) {
+			return r.label
+		}
+	}
+
+	label := c.genLabel()
+	c.errorRoutines = append(c.errorRoutines, errorRoutine{
+		label:   label,
+		routine: routine,
+		strings: strings,
+		regs:    regs,
+	})
+	return label
+}
+
+// emitErrorRoutines emits the routines used by the runtime checks
+func (c *Compiler) emitErrorRoutines() {
+	if len(c.errorRoutines) == 0 {
+		return
+	}
+
+	labels := make(map[string]string)
+	order := []string{}
+
+	for _, r := range c.errorRoutines {
+		args := []asm.Operand{}
+		for _, s := range r.strings {
+			l, ok := labels[s]
+			if !ok {
+				l = c.genLabel()
+				labels[s] = l
+				order = append(order, s)
+			}
+			args = append(args, asm.Addr(l))
+		}
+		for _, reg := range r.regs {
+			args = append(args, reg)
+		}
+
+		c.emit(asm.Label(r.label))
+		c.callError(r.routine, args...)
+	}
+
+	c.emit(asm.D("section", ".rodata"))
+	for _, s := range order {
+		c.emit(asm.Label(labels[s]), asm.D("asciz", fmt.Sprintf("\"%s\"", s)))
+	}
+}
+
+func equal[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Compiler) validateSafety() error {
+	if c.Safety < SafetyNone || c.Safety > SafetyFull {
+		return fmt.Errorf("invalid safety level %d", c.Safety)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Cache stores the results of compilation steps on disk,
+// keyed by a hash of everything they depend on.
+// It is safe for concurrent use.
+type Cache struct {
+	Dir    string
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func NewCache(dir string) *Cache {
+	return &Cache{Dir: dir}
+}
+
+// DefaultCacheDir returns the cache directory used
+// unless TINYC_CACHE names another one
+func DefaultCacheDir() (string, error) {
+	if dir, ok := os.LookupEnv("TINYC_CACHE"); ok {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot locate the cache directory, set it with TINYC_CACHE: %w", err)
+	}
+	return filepath.Join(dir, "tinyc"), nil
+}
+
+// Key hashes the given parts into a cache key
+func Key(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		// prefix each part with its length so that
+		// different splits of the same bytes differ
+		fmt.Fprintf(h, "%d:%s", len(p), p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *Cache) path(key string) string {
+	return filepath.Join(c.Dir, key[:2], key)
+}
+
+// Get returns the data stored under key, if any
+func (c *Cache) Get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.path(key))
+	if err != nil {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return data, true
+}
+
+// Put stores data under key
+func (c *Cache) Put(key string, data []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	// write to a temporary file first, so that concurrent builds
+	// never observe a partially written entry
+	f, err := os.CreateTemp(filepath.Dir(path), key+".tmp")
+	if err != nil {
+		return fmt.Errorf("error writing cache entry: %w", err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error writing cache entry: %w", err)
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Stats returns the number of hits and misses of Get so far
+func (c *Cache) Stats() (hits, misses int64) {
+	return c.hits.Load(), c.misses.Load()
+}
+
+// Clean removes every entry of the cache. Only the files the cache
+// creates are removed, as its directory may be shared with others,
+// and then the directories left empty.
+func (c *Cache) Clean() error {
+	dirs, err := os.ReadDir(c.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading cache directory: %w", err)
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() || !isHex(d.Name(), 2) {
+			continue
+		}
+		dir := filepath.Join(c.Dir, d.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("error reading cache directory: %w", err)
+		}
+		for _, e := range entries {
+			// entries, and the temporary files they are written to
+			key, _, _ := strings.Cut(e.Name(), ".tmp")
+			if e.IsDir() || !isHex(key, sha256.Size*2) || !strings.HasPrefix(key, d.Name()) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return fmt.Errorf("error removing cache entry: %w", err)
+			}
+		}
+		removeIfEmpty(dir)
+	}
+	removeIfEmpty(c.Dir)
+	return nil
+}
+
+// isHex reports whether s is made of n lower case hexadecimal digits
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeIfEmpty removes the directory dir if it has no entries
+func removeIfEmpty(dir string) {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 {
+		os.Remove(dir)
+	}
+}
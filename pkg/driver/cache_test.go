@@ -0,0 +1,62 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKey(t *testing.T) {
+	require.Equal(t, Key("a", "b"), Key("a", "b"))
+	require.NotEqual(t, Key("ab", ""), Key("a", "b"))
+	require.NotEqual(t, Key("a", "b"), Key("b", "a"))
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(t.TempDir())
+	key := Key("(+ 1 2)", "lisp_entry")
+
+	_, ok := c.Get(key)
+	require.False(t, ok)
+
+	require.NoError(t, c.Put(key, []byte("movl $12, %eax\n")))
+
+	data, ok := c.Get(key)
+	require.True(t, ok)
+	require.Equal(t, "movl $12, %eax\n", string(data))
+
+	hits, misses := c.Stats()
+	require.Equal(t, int64(1), hits)
+	require.Equal(t, int64(1), misses)
+
+	require.NoError(t, c.Clean())
+	_, ok = c.Get(key)
+	require.False(t, ok)
+}
+
+func TestCacheCleanKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	c := NewCache(dir)
+	key := Key("(+ 1 2)")
+	require.NoError(t, c.Put(key, []byte("movl $12, %eax\n")))
+
+	// the cache may share its directory with other files
+	other := filepath.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(other, []byte("keep"), 0o644))
+	sub := filepath.Join(dir, key[:2], "notes.txt")
+	require.NoError(t, os.WriteFile(sub, []byte("keep"), 0o644))
+
+	require.NoError(t, c.Clean())
+	_, ok := c.Get(key)
+	require.False(t, ok)
+	require.FileExists(t, other)
+	require.FileExists(t, sub)
+
+	require.NoError(t, os.Remove(other))
+	require.NoError(t, os.Remove(sub))
+	require.NoError(t, c.Put(key, []byte("")))
+	require.NoError(t, c.Clean())
+	require.NoDirExists(t, dir)
+}
@@ -0,0 +1,152 @@
+package driver
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/brenoafb/tinycompiler/pkg/compiler"
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+	"github.com/brenoafb/tinycompiler/pkg/parser"
+	pp "github.com/brenoafb/tinycompiler/pkg/preprocess"
+)
+
+// EntryName is the name of the unit called by the runtime
+const EntryName = compiler.EntryName
+
+// UnitName returns the name of the compilation unit preprocessed into e.
+// A unit with top-level expressions to evaluate is the entry point of
+// the program, and others are named after the module they declare or
+// else the base name of their file without the extension.
+func UnitName(e expr.E) string {
+	// definitions of procedures are replaced by nil,
+	// and those of global variables by their initialisation
+	if e.Typ == expr.ExprList && len(e.List) > 4 && compiler.IsEntry(e.List[0].Ident, e.List[4:]) {
+		return EntryName
+	}
+	return e.List[0].Ident
+}
+
+// Parse tokenizes and parses the expressions of a source file
+func Parse(src string) ([]expr.E, error) {
+	tokens, err := parser.Tokenize(src)
+	if err != nil {
+		return nil, fmt.Errorf("tokenizer error: %w", err)
+	}
+
+	es, err := parser.Parse(tokens)
+	if err != nil {
+		return nil, fmt.Errorf("parser error: %w", err)
+	}
+
+	return es, nil
+}
+
+// Preprocess parses the source of the file at path and preprocesses
+// it into a compilation unit named by UnitName, finding the modules
+// it imports with opts.Modules
+func Preprocess(src string, path string, opts Options) (expr.E, error) {
+	es, err := Parse(src)
+	if err != nil {
+		return expr.Nil(), err
+	}
+
+	base := filepath.Base(path)
+	name := strings.TrimSuffix(base, filepath.Ext(base))
+	ppOpts := pp.Options{Resolve: opts.Modules.For(path), InlineSize: opts.InlineSize}
+	e, err := pp.PreprocessWith(es, name, ppOpts)
+	if err != nil {
+		return expr.Nil(), fmt.Errorf("preprocessor error: %w", err)
+	}
+	e.List[0] = expr.Id(UnitName(e))
+
+	return e, nil
+}
+
+// Options control the compilation of a unit
+type Options struct {
+	Safety int
+	// NoPeephole disables the peephole optimiser
+	NoPeephole bool
+	// NoRegisters disables register allocation
+	NoRegisters bool
+	// InlineSize is the size of the largest procedure inlined,
+	// see preprocess.Options
+	InlineSize int
+	// Imports holds the procedures exported by other units,
+	// see compiler.Compiler
+	Imports map[string]compiler.Signature
+	// Modules finds the modules imported by the unit
+	Modules Resolver
+}
+
+// Compile parses, preprocesses and compiles the source of
+// the file at path, writing its assembly to w
+func Compile(w io.Writer, src string, path string, opts Options) error {
+	e, err := Preprocess(src, path, opts)
+	if err != nil {
+		return err
+	}
+
+	c := compiler.NewCompiler(w)
+	c.Safety = opts.Safety
+	c.Peephole = !opts.NoPeephole
+	c.Registers = !opts.NoRegisters
+	c.Imports = opts.Imports
+	err = c.Compile(e)
+	if err != nil {
+		return fmt.Errorf("compiler error: %w", err)
+	}
+
+	return nil
+}
+
+// InterfaceOf returns the interface of the compilation unit
+// compiled from the source of the file at path
+func InterfaceOf(src string, path string, modules Resolver) (compiler.Interface, error) {
+	e, err := Preprocess(src, path, Options{Modules: modules})
+	if err != nil {
+		return compiler.Interface{}, err
+	}
+	i, err := compiler.InterfaceOf(e)
+	if err != nil {
+		return compiler.Interface{}, err
+	}
+	i.Imports, err = ModuleImports(src)
+	return i, err
+}
+
+// ParseInterface reads the contents of an interface file
+func ParseInterface(src string) (compiler.Interface, error) {
+	es, err := Parse(src)
+	if err != nil {
+		return compiler.Interface{}, err
+	}
+	if len(es) != 1 {
+		return compiler.Interface{}, fmt.Errorf("interface file must contain a single expression")
+	}
+	return compiler.ParseInterface(es[0])
+}
+
+// FormatInterface returns the contents of the interface file for i
+func FormatInterface(i compiler.Interface) string {
+	e := i.Expr()
+	return e.String()
+}
+
+// Imports gathers the procedures exported by the given interfaces
+func Imports(ifaces []compiler.Interface) (map[string]compiler.Signature, error) {
+	imports := make(map[string]compiler.Signature)
+	definedBy := make(map[string]string)
+	for _, i := range ifaces {
+		for name, sig := range i.Exports {
+			if other, ok := definedBy[name]; ok {
+				return nil, fmt.Errorf("procedure '%s' is exported by both %s and %s", name, other, i.Name)
+			}
+			definedBy[name] = i.Name
+			imports[name] = sig
+		}
+	}
+	return imports, nil
+}
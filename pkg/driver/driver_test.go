@@ -0,0 +1,270 @@
+package driver
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/brenoafb/tinycompiler/pkg/compiler"
+)
+
+func TestUnitName(t *testing.T) {
+	tests := []struct {
+		path     string
+		code     string
+		expected string
+	}{
+		{path: "main.lisp", code: "(+ 1 2)", expected: "lisp_entry"},
+		{path: "lib.lisp", code: "(defun next (x) (+ x 1))", expected: "lib"},
+		{path: "src/util.lisp", code: "(defun id (x) x) (id 1)", expected: "lisp_entry"},
+		{path: "src/util.lisp", code: "(defun id (x) x)", expected: "util"},
+		{path: "util.lisp", code: "(module strings (export id)) (defun id (x) x)", expected: "strings"},
+		{path: "main.lisp", code: "(module main) (defun id (x) x) (id 1)", expected: "lisp_entry"},
+		{path: "main.lisp", code: "(define x (display \"hello\"))", expected: "main"},
+		{path: "lisp_entry.lisp", code: "(define x (display \"hello\"))", expected: "lisp_entry"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			e, err := Preprocess(tt.code, tt.path, Options{})
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, UnitName(e))
+			require.Equal(t, tt.expected, e.List[0].Ident)
+		})
+	}
+}
+
+func TestCompile(t *testing.T) {
+	var out bytes.Buffer
+	err := Compile(&out, "(defun next (x) (+ x 1)) (next 1)", "main.lisp", Options{})
+	require.NoError(t, err)
+
+	asm := out.String()
+	require.True(t, strings.Contains(asm, "\t.global\tlisp_entry\n"))
+	require.True(t, strings.Contains(asm, "\t.global\tnext\n"))
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		code string
+		err  string
+	}{
+		{code: "(+ 1 2", err: "parser error"},
+		{code: "(lambda)", err: "preprocessor error"},
+		{code: "(+ x 1)", err: "compiler error"},
+		{code: "(defun f (x) x) (f 1 2)", err: "procedure 'f' takes 1 argument, called with 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Compile(&out, tt.code, "test.lisp", Options{})
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestForEach(t *testing.T) {
+	results := make([]int, 100)
+	err := ForEach(len(results), 8, func(i int) error {
+		results[i] = i * i
+		return nil
+	})
+	require.NoError(t, err)
+	for i, r := range results {
+		require.Equal(t, i*i, r)
+	}
+
+	err = ForEach(10, 4, func(i int) error {
+		if i%3 == 0 {
+			return fmt.Errorf("error %d", i)
+		}
+		return nil
+	})
+	require.EqualError(t, err, "error 0\nerror 3\nerror 6\nerror 9")
+}
+
+func TestInterfaces(t *testing.T) {
+	lib, err := InterfaceOf("(defun next (x) (+ x 1)) (defun list xs xs)", "lib.lisp", Resolver{})
+	require.NoError(t, err)
+	require.Equal(t, "(interface lib\n  (list 0 #t)\n  (next 1 #f))\n", FormatInterface(lib))
+
+	parsed, err := ParseInterface(FormatInterface(lib))
+	require.NoError(t, err)
+	require.Equal(t, lib, parsed)
+
+	imports, err := Imports([]compiler.Interface{lib})
+	require.NoError(t, err)
+
+	tests := []struct {
+		code string
+		err  string
+	}{
+		{code: "(next (list 1 2 3))"},
+		{code: "(nxt 1)", err: "call to undefined procedure 'nxt'"},
+		{code: "(next 1 2)", err: "procedure 'next' takes 1 argument, called with 2"},
+		{code: "(list next (lambda (x) (next x)))"},
+		{code: "(list nxt)", err: "unbound variable 'nxt'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			var out bytes.Buffer
+			err := Compile(&out, tt.code, "main.lisp", Options{Imports: imports})
+			if tt.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.err)
+			}
+		})
+	}
+
+	_, err = Imports([]compiler.Interface{lib, lib})
+	require.Error(t, err)
+}
+
+func TestResolver(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "lib")
+	require.NoError(t, os.Mkdir(lib, 0o755))
+
+	files := map[string]string{
+		"lib/util.lisp":      "(module util (export inc)) (defun inc (x) (+ x 1))",
+		"lib/counter.lispi":  "(interface counter (import util) (counter:next 1 #f))",
+		"lib/strings.lisp":   "(defun id (x) x)",
+		"main.lisp":          "(module main (import util counter)) (next (inc 1))",
+		"local/counter.lisp": "(module counter (export next)) (defun next (x) x)",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte(src), 0o644))
+	}
+
+	r := Resolver{Path: []string{lib}}
+
+	path, err := r.Find("util", dir)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(lib, "util.lisp"), path)
+
+	// the directory of the importing file comes first
+	path, err = r.Find("counter", filepath.Join(dir, "local"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "local", "counter.lisp"), path)
+
+	m, err := r.Module("counter", dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"next"}, m.Exports)
+	require.Equal(t, []string{"util"}, m.Imports)
+
+	config := "(module config (export debug level)) (define debug #f) (define level 1) (define (level? n) (< n level))"
+	i, err := InterfaceOf(config, "config.lisp", r)
+	require.NoError(t, err)
+	require.Equal(t, "(interface config\n  (global config:debug config:level))\n", FormatInterface(i))
+	require.NoError(t, os.WriteFile(filepath.Join(lib, "config.lispi"), []byte(FormatInterface(i)), 0o644))
+
+	m, err = r.Module("config", dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"debug", "level"}, m.Exports)
+	require.Equal(t, []string{"debug", "level"}, m.Globals)
+
+	_, err = r.Module("strings", dir)
+	require.ErrorContains(t, err, "does not declare module strings")
+
+	_, err = r.Module("missing", dir)
+	require.ErrorContains(t, err, "module missing not found")
+
+	main := filepath.Join(dir, "main.lisp")
+	e, err := Preprocess(files["main.lisp"], main, Options{Modules: r})
+	require.NoError(t, err)
+	require.Equal(t, "(counter:next\n  (util:inc 1))\n", e.List[4].String())
+
+	i, err = InterfaceOf(files["main.lisp"], main, r)
+	require.NoError(t, err)
+	require.Equal(t, []string{"util", "counter"}, i.Imports)
+
+	parsed, err := ParseInterface(FormatInterface(i))
+	require.NoError(t, err)
+	require.Equal(t, i, parsed)
+}
+
+// toolchain returns the C compiler linking programs, set by TINYC_CC
+// as for tinyc, skipping tb when it is not installed
+func toolchain(tb testing.TB) []string {
+	cc := strings.Fields(os.Getenv("TINYC_CC"))
+	if len(cc) == 0 {
+		cc = []string{"zig", "cc", "-target", "x86-linux-musl"}
+	}
+	if _, err := exec.LookPath(cc[0]); err != nil {
+		tb.Skipf("no C compiler for i386: %v", err)
+	}
+	return cc
+}
+
+// build compiles the files at paths with opts and links them with the
+// runtime in order, returning the executable. tb is skipped when the
+// toolchain cannot build or run i386 programs.
+func build(tb testing.TB, opts Options, paths ...string) string {
+	cc := toolchain(tb)
+	dir := tb.TempDir()
+	runtime, err := filepath.Abs("../../runtime.c")
+	require.NoError(tb, err)
+
+	args := append(cc[1:len(cc):len(cc)], runtime)
+	for i, path := range paths {
+		src, err := os.ReadFile(path)
+		require.NoError(tb, err)
+		var out bytes.Buffer
+		require.NoError(tb, Compile(&out, string(src), path, opts))
+		s := filepath.Join(dir, fmt.Sprintf("%d.s", i))
+		require.NoError(tb, os.WriteFile(s, out.Bytes(), 0o644))
+		args = append(args, s)
+	}
+
+	prog := filepath.Join(dir, "prog")
+	if out, err := exec.Command(cc[0], append(args, "-o", prog)...).CombinedOutput(); err != nil {
+		tb.Skipf("cannot link i386 programs: %v\n%s", err, out)
+	}
+	if err := exec.Command(prog).Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			tb.Skipf("cannot run i386 programs: %v", err)
+		}
+	}
+	return prog
+}
+
+// BenchmarkRegisters runs a program spending its time in loops over a
+// vector, compiled with and without register allocation
+func BenchmarkRegisters(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "main.lisp")
+	require.NoError(b, os.WriteFile(path, []byte(`
+(defun sum (v i acc)
+  (if (eq? i (vector-length v))
+      acc
+      (let* ((x (vector-ref v i)) (y (+ x x)) (z (- y i)))
+        (sum v (+ i 1) (+ acc (- z x))))))
+(defun loop (n v acc)
+  (if (zero? n) acc (loop (- n 1) v (+ acc (sum v 0 0)))))
+(let ((v (make-vector 1000)))
+  (vector-fill! v 3)
+  (loop 20000 v 0))
+`), 0o644))
+
+	for _, registers := range []bool{false, true} {
+		b.Run(fmt.Sprintf("registers=%t", registers), func(b *testing.B) {
+			prog := build(b, Options{NoRegisters: !registers}, path)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				out, err := exec.Command(prog).Output()
+				require.NoError(b, err)
+				require.Equal(b, "-266323584\n", string(out))
+			}
+		})
+	}
+}
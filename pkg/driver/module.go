@@ -0,0 +1,121 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/brenoafb/tinycompiler/pkg/compiler"
+	pp "github.com/brenoafb/tinycompiler/pkg/preprocess"
+)
+
+// InterfaceExt is the extension of interface files
+const InterfaceExt = ".lispi"
+
+// Resolver finds imported modules. Module <name> is defined by the
+// file <name>.lisp, or described by the interface file <name>.lispi
+// when compiled separately, in the directory of the importing file
+// or else in the first directory of Path holding either.
+type Resolver struct {
+	Path []string
+}
+
+// Find returns the file defining or describing the module
+// with the given name, imported by a file in dir
+func (r Resolver) Find(name string, dir string) (string, error) {
+	for _, d := range append([]string{dir}, r.Path...) {
+		for _, ext := range []string{".lisp", InterfaceExt} {
+			path := filepath.Join(d, name+ext)
+			_, err := os.Stat(path)
+			if err == nil {
+				return path, nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", err
+			}
+		}
+	}
+	return "", fmt.Errorf("module %s not found", name)
+}
+
+// Module returns the declaration of the module with
+// the given name, imported by a file in dir
+func (r Resolver) Module(name string, dir string) (pp.Module, error) {
+	path, err := r.Find(name, dir)
+	if err != nil {
+		return pp.Module{}, err
+	}
+
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return pp.Module{}, err
+	}
+
+	if filepath.Ext(path) == InterfaceExt {
+		i, err := ParseInterface(string(src))
+		if err != nil {
+			return pp.Module{}, fmt.Errorf("%s: %w", path, err)
+		}
+		if i.Name != name {
+			return pp.Module{}, fmt.Errorf("%s describes unit %s, not module %s", path, i.Name, name)
+		}
+		return moduleOf(i), nil
+	}
+
+	es, err := Parse(string(src))
+	if err != nil {
+		return pp.Module{}, fmt.Errorf("%s: %w", path, err)
+	}
+	m, ok, err := pp.ParseModule(es)
+	if err != nil {
+		return pp.Module{}, fmt.Errorf("%s: %w", path, err)
+	}
+	if !ok || m.Name != name {
+		return pp.Module{}, fmt.Errorf("%s does not declare module %s", path, name)
+	}
+	return m, nil
+}
+
+// ModuleImports returns the modules imported by the source of a file,
+// which are none unless it declares a module
+func ModuleImports(src string) ([]string, error) {
+	es, err := Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	m, _, err := pp.ParseModule(es)
+	if err != nil {
+		return nil, fmt.Errorf("preprocessor error: %w", err)
+	}
+	return m.Imports, nil
+}
+
+// For returns the resolver used to preprocess the file at path
+func (r Resolver) For(path string) pp.Resolver {
+	return func(name string) (pp.Module, error) {
+		return r.Module(name, filepath.Dir(path))
+	}
+}
+
+// moduleOf returns the declaration of the module described by i
+func moduleOf(i compiler.Interface) pp.Module {
+	m := pp.Module{Name: i.Name, Imports: i.Imports}
+	prefix := pp.Qualify(i.Name, "")
+	for name := range i.Exports {
+		if strings.HasPrefix(name, prefix) {
+			m.Exports = append(m.Exports, strings.TrimPrefix(name, prefix))
+		}
+	}
+	for _, name := range i.Globals {
+		if strings.HasPrefix(name, prefix) {
+			m.Exports = append(m.Exports, strings.TrimPrefix(name, prefix))
+			m.Globals = append(m.Globals, strings.TrimPrefix(name, prefix))
+		}
+	}
+	sort.Strings(m.Exports)
+	return m
+}
@@ -0,0 +1,37 @@
+package driver
+
+import (
+	"errors"
+	"sync"
+)
+
+// ForEach calls f for every index in [0, n), with up to jobs calls
+// running concurrently. The errors returned by f are joined
+// in the order of their indices, so that diagnostics are deterministic.
+func ForEach(n, jobs int, f func(i int) error) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	errs := make([]error, n)
+	indices := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = f(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
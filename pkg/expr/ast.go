@@ -1,5 +1,7 @@
 package expr
 
+import "fmt"
+
 type ExprType int
 
 const (
@@ -67,3 +69,112 @@ func L(es ...E) E {
 func IsIdent(e E, s string) bool {
 	return e.Typ == ExprIdent && e.Ident == s
 }
+
+// IsLet reports whether e is the head of a let or let* form
+func IsLet(e E) bool {
+	return IsIdent(e, "let") || IsIdent(e, "let*")
+}
+
+// SplitLet separates the elements of a let or let* form
+// into bindings and body. Both the standard syntax
+//
+//	(let ((<variable> <expr>)...) <body...>)
+//
+// and the original one
+//
+//	(let (<variable> <expr>)... <body...>)
+//
+// are accepted. In the original syntax, a body expression that
+// looks like a binding must be wrapped in a progn.
+// Bindings of let* and of the original syntax are sequential,
+// i.e. each one is visible to the following ones.
+func SplitLet(elems []E) (bindings []E, body []E, sequential bool) {
+	if len(elems) > 2 && isBindingList(elems[1]) {
+		return elems[1].List, elems[2:], IsIdent(elems[0], "let*")
+	}
+
+	i := 1
+	for i < len(elems)-1 && isBinding(elems[i]) {
+		i++
+	}
+	return elems[1:i], elems[i:], true
+}
+
+// IsNamedLet reports whether elems form a named let
+//
+//	(let <name> ((<variable> <expr>)...) <body...>)
+func IsNamedLet(elems []E) bool {
+	return len(elems) > 3 &&
+		IsIdent(elems[0], "let") &&
+		elems[1].Typ == ExprIdent &&
+		isBindingList(elems[2])
+}
+
+// IsOriginalLet reports whether elems form a let or let*
+// in the original syntax, see SplitLet
+func IsOriginalLet(elems []E) bool {
+	return len(elems) > 2 && IsLet(elems[0]) && !IsNamedLet(elems) && !isBindingList(elems[1])
+}
+
+func isBindingList(e E) bool {
+	if e.Typ == ExprNil {
+		return true
+	}
+	if e.Typ != ExprList {
+		return false
+	}
+	for _, binding := range e.List {
+		if !isBinding(binding) {
+			return false
+		}
+	}
+	return true
+}
+
+func isBinding(e E) bool {
+	return e.Typ == ExprList && len(e.List) == 2 && e.List[0].Typ == ExprIdent
+}
+
+// SplitParams separates a parameter list into the required parameters
+// and the rest parameter, which is Nil for fixed arity procedures.
+// Besides (<param>...), the forms (<param>... . <rest>) and <rest>
+// are accepted.
+func SplitParams(e E) ([]E, E, error) {
+	switch e.Typ {
+	case ExprNil:
+		return nil, Nil(), nil
+	case ExprIdent:
+		return nil, e, nil
+	case ExprList:
+	default:
+		return nil, Nil(), fmt.Errorf("parameter list is not list")
+	}
+
+	params := e.List
+	for i, param := range params {
+		if param.Typ != ExprIdent {
+			return nil, Nil(), fmt.Errorf("parameter at index %d is not identifier", i)
+		}
+		if param.Ident == "." {
+			if i != len(params)-2 || params[i+1].Ident == "." {
+				return nil, Nil(), fmt.Errorf("malformed rest parameter")
+			}
+			return params[:i], params[i+1], nil
+		}
+	}
+
+	return params, Nil(), nil
+}
+
+// Params returns every identifier bound by a parameter list,
+// including the rest parameter
+func Params(e E) []E {
+	required, rest, err := SplitParams(e)
+	if err != nil {
+		return nil
+	}
+	if rest.Typ == ExprIdent {
+		return append(append([]E{}, required...), rest)
+	}
+	return required
+}
@@ -19,9 +19,9 @@ func (e *E) prettyPrint(level int) string {
 		return e.Ident
 	case ExprBool:
 		if e.Bool {
-			return "true"
+			return "#t"
 		}
-		return "false"
+		return "#f"
 	case ExprNumber:
 		return fmt.Sprintf("%d", e.Number)
 	case ExprString:
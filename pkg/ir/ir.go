@@ -0,0 +1,247 @@
+// Package ir defines the intermediate representation between
+// preprocessed expressions and assembly.
+//
+// A unit is a set of procedures and static data. The code of a
+// procedure is a linear sequence of three-address instructions over
+// temporaries, each holding a tagged value, and immediate tagged values.
+// Control flow is explicit, through labels and jumps, and only ever
+// goes forward, so that the code of a procedure is acyclic.
+package ir
+
+// Temp is a temporary of a procedure. Temporaries are numbered from 0,
+// the first ones holding the parameters of the procedure.
+type Temp int
+
+// Label is a position in the code of a procedure
+type Label int
+
+type ValueKind int
+
+const (
+	TempValue ValueKind = iota
+	ImmValue
+)
+
+// Value is an operand of an instruction:
+// either a temporary or an immediate tagged value
+type Value struct {
+	Kind ValueKind
+	Temp Temp
+	Imm  int
+}
+
+// T returns the value held by temporary t
+func T(t Temp) Value {
+	return Value{Kind: TempValue, Temp: t}
+}
+
+// Imm returns the immediate tagged value x
+func Imm(x int) Value {
+	return Value{Kind: ImmValue, Imm: x}
+}
+
+// IsTemp reports whether v is held by a temporary
+func (v Value) IsTemp() bool {
+	return v.Kind == TempValue
+}
+
+type Op int
+
+const (
+	// Dst = Args[0]
+	Move Op = iota
+	// Dst = the primitive operation Name applied to Args
+	Prim
+	// Dst = the result of calling procedure Name with Args
+	Call
+	// Dst = the result of calling the closure Args[0] with Args[1:]
+	CallClosure
+	// Dst = a closure of procedure Name capturing Args.
+	// Procedures without free variables have static closures,
+	// which are never allocated.
+	MakeClosure
+	// Dst = free variable Index of the current closure
+	LoadFree
+	// Dst = global variable Name
+	LoadGlobal
+	// global variable Name = Args[0]
+	StoreGlobal
+	// Dst = the address of the static data Name tagged with Index
+	Address
+	// continue at Target
+	Jump
+	// continue at Target if Args[0] is false
+	JumpIfFalse
+	// marks the position of Target
+	Mark
+	// return Args[0] to the caller
+	Return
+)
+
+// Instr is an instruction, whose fields are used as described by its Op
+type Instr struct {
+	Op     Op
+	Dst    Temp
+	Name   string
+	Index  int
+	Args   []Value
+	Target Label
+}
+
+// HasDst reports whether the instruction assigns a temporary
+func (in Instr) HasDst() bool {
+	switch in.Op {
+	case StoreGlobal, Jump, JumpIfFalse, Mark, Return:
+		return false
+	}
+	return true
+}
+
+// Uses returns the temporaries read by the instruction
+func (in Instr) Uses() []Temp {
+	ts := []Temp{}
+	for _, v := range in.Args {
+		if v.IsTemp() {
+			ts = append(ts, v.Temp)
+		}
+	}
+	return ts
+}
+
+// Proc is a procedure. Procedures called from Lisp code receive their
+// Params arguments in the first temporaries, followed by a list of the
+// remaining ones when Variadic, and may refer to Free variables
+// captured by their closure.
+// The entry point of a unit is called by the runtime instead.
+type Proc struct {
+	Name     string
+	Exported bool
+	Entry    bool
+	Params   int
+	Variadic bool
+	Free     int
+	// Temps is the number of temporaries and Labels
+	// the number of labels used by the code
+	Temps  int
+	Labels int
+	Code   []Instr
+}
+
+// ParamTemps returns the number of temporaries holding parameters
+func (p *Proc) ParamTemps() int {
+	if p.Variadic {
+		return p.Params + 1
+	}
+	return p.Params
+}
+
+// NewTemp returns an unused temporary
+func (p *Proc) NewTemp() Temp {
+	t := Temp(p.Temps)
+	p.Temps++
+	return t
+}
+
+// NewLabel returns an unused label
+func (p *Proc) NewLabel() Label {
+	l := Label(p.Labels)
+	p.Labels++
+	return l
+}
+
+// Emit appends an instruction to the code of the procedure
+func (p *Proc) Emit(in Instr) {
+	p.Code = append(p.Code, in)
+}
+
+type DataKind int
+
+const (
+	// a global variable, initially zero
+	GlobalData DataKind = iota
+	// a string constant holding Str
+	StringData
+)
+
+// Data is an object allocated statically
+type Data struct {
+	Name     string
+	Kind     DataKind
+	Exported bool
+	Str      string
+}
+
+// Unit is a compilation unit. The runtime calls the entry point of
+// units that are Initialisers before the entry point of the program.
+type Unit struct {
+	Name        string
+	Initialiser bool
+	Data        []Data
+	Procs       []*Proc
+	Entry       *Proc
+}
+
+// Proc returns the procedure of the unit with the given name, if any
+func (u *Unit) Proc(name string) (*Proc, bool) {
+	for _, p := range u.Procs {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Primitives maps the name of each primitive operation
+// to its number of arguments, or -1 when it takes any number
+var Primitives = map[string]int{
+	"add1":                 1,
+	"+":                    2,
+	"-":                    2,
+	"zero?":                1,
+	"eq?":                  2,
+	"null?":                1,
+	"eof-object?":          1,
+	"port?":                1,
+	"error-object?":        1,
+	"integer->char":        1,
+	"char->integer":        1,
+	"char=?":               2,
+	"char<?":               2,
+	"char>?":               2,
+	"char<=?":              2,
+	"char>=?":              2,
+	"char-upcase":          1,
+	"char-downcase":        1,
+	"char-alphabetic?":     1,
+	"char-numeric?":        1,
+	"char-whitespace?":     1,
+	"cons":                 2,
+	"car":                  1,
+	"cdr":                  1,
+	"set-car!":             2,
+	"set-cdr!":             2,
+	"box":                  1,
+	"unbox":                1,
+	"set-box!":             2,
+	"make-vector":          1,
+	"vector":               -1,
+	"vector-ref":           2,
+	"vector-set!":          3,
+	"vector-length":        1,
+	"vector-fill!":         2,
+	"vector->list":         1,
+	"write-char":           1,
+	"display":              1,
+	"write":                1,
+	"newline":              0,
+	"read-char":            0,
+	"peek-char":            0,
+	"open-input-file":      1,
+	"open-output-file":     1,
+	"close-port":           1,
+	"read-line":            1,
+	"write-string":         2,
+	"error-object-message": 1,
+	"command-line":         0,
+	"exit":                 1,
+}
@@ -0,0 +1,224 @@
+package ir
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// abs returns a procedure computing (if (zero? x) 0 (- 0 x))
+func abs() *Proc {
+	p := &Proc{Name: "abs", Params: 1, Temps: 1}
+	test := p.NewTemp()
+	result := p.NewTemp()
+	neg := p.NewTemp()
+	alt := p.NewLabel()
+	done := p.NewLabel()
+
+	p.Emit(Instr{Op: Prim, Dst: test, Name: "zero?", Args: []Value{T(0)}})
+	p.Emit(Instr{Op: JumpIfFalse, Args: []Value{T(test)}, Target: alt})
+	p.Emit(Instr{Op: Move, Dst: result, Args: []Value{Imm(0)}})
+	p.Emit(Instr{Op: Jump, Target: done})
+	p.Emit(Instr{Op: Mark, Target: alt})
+	p.Emit(Instr{Op: Prim, Dst: neg, Name: "-", Args: []Value{Imm(0), T(0)}})
+	p.Emit(Instr{Op: Move, Dst: result, Args: []Value{T(neg)}})
+	p.Emit(Instr{Op: Mark, Target: done})
+	p.Emit(Instr{Op: Return, Args: []Value{T(result)}})
+	return p
+}
+
+func TestPrint(t *testing.T) {
+	entry := &Proc{Name: "main", Entry: true}
+	entry.Emit(Instr{Op: Address, Dst: entry.NewTemp(), Name: "s0", Index: 3})
+	entry.Emit(Instr{Op: MakeClosure, Dst: entry.NewTemp(), Name: "abs"})
+	entry.Emit(Instr{Op: CallClosure, Dst: entry.NewTemp(), Args: []Value{T(1), Imm(4)}})
+	entry.Emit(Instr{Op: Call, Dst: entry.NewTemp(), Name: "abs", Args: []Value{T(2)}})
+	entry.Emit(Instr{Op: StoreGlobal, Name: "x", Args: []Value{T(3)}})
+	entry.Emit(Instr{Op: LoadGlobal, Dst: entry.NewTemp(), Name: "x"})
+	entry.Emit(Instr{Op: Return, Args: []Value{T(4)}})
+
+	u := &Unit{
+		Name: "main",
+		Data: []Data{
+			{Name: "s0", Kind: StringData, Str: "hi"},
+			{Name: "x", Kind: GlobalData, Exported: true},
+		},
+		Procs: []*Proc{abs()},
+		Entry: entry,
+	}
+
+	expected := `unit main
+data s0 string "hi"
+data x global export
+proc abs params 1
+	t1 = zero? t0
+	jump L0 unless t1
+	t2 = 0
+	jump L1
+L0:
+	t3 = - 0 t0
+	t2 = t3
+L1:
+	return t2
+proc main entry
+	t0 = address s0 3
+	t1 = closure abs
+	t2 = callclosure t1 4
+	t3 = call abs t2
+	global x = t3
+	t4 = global x
+	return t4
+`
+	require.Equal(t, expected, u.String())
+	require.NoError(t, Verify(u))
+}
+
+func TestVerifyProc(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(p *Proc)
+		err    string
+	}{
+		{
+			name:   "unknown primitive",
+			modify: func(p *Proc) { p.Code[0].Name = "frobnicate" },
+			err:    "unknown primitive frobnicate",
+		},
+		{
+			name:   "wrong number of operands",
+			modify: func(p *Proc) { p.Code[0].Args = nil },
+			err:    "takes 1 operands, has 0",
+		},
+		{
+			name:   "temporary out of range",
+			modify: func(p *Proc) { p.Code[0].Dst = 9 },
+			err:    "temporary t9 out of range",
+		},
+		{
+			name:   "use before assignment",
+			modify: func(p *Proc) { p.Code[0].Args[0] = T(3) },
+			err:    "t3 may be used before it is assigned",
+		},
+		{
+			name: "assigned on one path only",
+			modify: func(p *Proc) {
+				p.Code[2] = Instr{Op: Move, Dst: 3, Args: []Value{Imm(0)}}
+			},
+			err: "t2 may be used before it is assigned",
+		},
+		{
+			name:   "label marked twice",
+			modify: func(p *Proc) { p.Code[7].Target = 0 },
+			err:    "label L0 is marked more than once",
+		},
+		{
+			name: "backward jump",
+			modify: func(p *Proc) {
+				p.Code[6] = Instr{Op: Jump, Target: 0}
+			},
+			err: "backward jump to L0",
+		},
+		{
+			name:   "runs past its end",
+			modify: func(p *Proc) { p.Code = p.Code[:len(p.Code)-1] },
+			err:    "code runs past its end",
+		},
+		{
+			name:   "free variable out of range",
+			modify: func(p *Proc) { p.Code[2] = Instr{Op: LoadFree, Dst: 2} },
+			err:    "free variable 0 out of range",
+		},
+		{
+			name:   "entry point with parameters",
+			modify: func(p *Proc) { p.Entry = true },
+			err:    "entry point takes arguments",
+		},
+	}
+
+	require.NoError(t, abs().Verify())
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := abs()
+			tt.modify(p)
+			require.ErrorContains(t, p.Verify(), tt.err)
+		})
+	}
+}
+
+func TestVerifyUnit(t *testing.T) {
+	entry := func(in Instr) *Proc {
+		p := &Proc{Name: "main", Entry: true}
+		in.Dst = p.NewTemp()
+		p.Emit(in)
+		p.Emit(Instr{Op: Return, Args: []Value{T(in.Dst)}})
+		return p
+	}
+	capture := func(p *Proc) *Proc {
+		p.Free = 1
+		return p
+	}
+
+	tests := []struct {
+		name string
+		unit *Unit
+		err  string
+	}{
+		{
+			name: "static closure of another unit",
+			unit: &Unit{Name: "main", Entry: entry(Instr{Op: MakeClosure, Name: "f"})},
+		},
+		{
+			name: "closure capturing variables",
+			unit: &Unit{
+				Name:  "main",
+				Procs: []*Proc{capture(abs())},
+				Entry: entry(Instr{Op: MakeClosure, Name: "abs", Args: []Value{Imm(0)}}),
+			},
+		},
+		{
+			name: "closure capturing too few variables",
+			unit: &Unit{
+				Name:  "main",
+				Procs: []*Proc{capture(abs())},
+				Entry: entry(Instr{Op: MakeClosure, Name: "abs"}),
+			},
+			err: "closure of abs captures 0 variables, it has 1",
+		},
+		{
+			name: "closure of another unit capturing variables",
+			unit: &Unit{Name: "main", Entry: entry(Instr{Op: MakeClosure, Name: "f", Args: []Value{Imm(0)}})},
+			err:  "closure of undefined proc f captures variables",
+		},
+		{
+			name: "address of a global variable",
+			unit: &Unit{
+				Name:  "main",
+				Data:  []Data{{Name: "x", Kind: GlobalData}},
+				Entry: entry(Instr{Op: Address, Name: "x", Index: 3}),
+			},
+			err: "address of x, which is not a string",
+		},
+		{
+			name: "duplicate procedure",
+			unit: &Unit{Name: "main", Procs: []*Proc{abs(), abs()}, Entry: entry(Instr{Op: LoadGlobal, Name: "x"})},
+			err:  "proc abs is defined more than once",
+		},
+		{
+			name: "no entry point",
+			unit: &Unit{Name: "main"},
+			err:  "unit main has no entry point",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.unit)
+			if tt.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.ErrorContains(t, err, tt.err)
+			}
+		})
+	}
+}
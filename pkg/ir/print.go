@@ -0,0 +1,129 @@
+package ir
+
+import (
+	"fmt"
+	"strings"
+)
+
+func (t Temp) String() string {
+	return fmt.Sprintf("t%d", t)
+}
+
+func (l Label) String() string {
+	return fmt.Sprintf("L%d", l)
+}
+
+func (v Value) String() string {
+	if v.IsTemp() {
+		return v.Temp.String()
+	}
+	return fmt.Sprintf("%d", v.Imm)
+}
+
+func (in Instr) String() string {
+	args := make([]string, 0, len(in.Args))
+	for _, v := range in.Args {
+		args = append(args, v.String())
+	}
+	rest := strings.Join(args, " ")
+
+	switch in.Op {
+	case Move:
+		return fmt.Sprintf("%s = %s", in.Dst, rest)
+	case Prim:
+		return strings.TrimSpace(fmt.Sprintf("%s = %s %s", in.Dst, in.Name, rest))
+	case Call:
+		return strings.TrimSpace(fmt.Sprintf("%s = call %s %s", in.Dst, in.Name, rest))
+	case CallClosure:
+		return fmt.Sprintf("%s = callclosure %s", in.Dst, rest)
+	case MakeClosure:
+		return strings.TrimSpace(fmt.Sprintf("%s = closure %s %s", in.Dst, in.Name, rest))
+	case LoadFree:
+		return fmt.Sprintf("%s = free %d", in.Dst, in.Index)
+	case LoadGlobal:
+		return fmt.Sprintf("%s = global %s", in.Dst, in.Name)
+	case StoreGlobal:
+		return fmt.Sprintf("global %s = %s", in.Name, rest)
+	case Address:
+		return fmt.Sprintf("%s = address %s %d", in.Dst, in.Name, in.Index)
+	case Jump:
+		return fmt.Sprintf("jump %s", in.Target)
+	case JumpIfFalse:
+		return fmt.Sprintf("jump %s unless %s", in.Target, rest)
+	case Mark:
+		return fmt.Sprintf("%s:", in.Target)
+	case Return:
+		return fmt.Sprintf("return %s", rest)
+	default:
+		return fmt.Sprintf("unknown instruction %d", in.Op)
+	}
+}
+
+// String returns the header of the procedure followed by its code,
+// one instruction per line
+func (p *Proc) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "proc %s", p.Name)
+	if p.Entry {
+		sb.WriteString(" entry")
+	} else {
+		fmt.Fprintf(&sb, " params %d", p.Params)
+	}
+	if p.Variadic {
+		sb.WriteString(" variadic")
+	}
+	if p.Free > 0 {
+		fmt.Fprintf(&sb, " free %d", p.Free)
+	}
+	if p.Exported {
+		sb.WriteString(" export")
+	}
+	sb.WriteString("\n")
+
+	for _, in := range p.Code {
+		if in.Op == Mark {
+			fmt.Fprintf(&sb, "%s\n", in)
+		} else {
+			fmt.Fprintf(&sb, "\t%s\n", in)
+		}
+	}
+	return sb.String()
+}
+
+func (d Data) String() string {
+	var s string
+	switch d.Kind {
+	case GlobalData:
+		s = fmt.Sprintf("data %s global", d.Name)
+	case StringData:
+		s = fmt.Sprintf("data %s string \"%s\"", d.Name, d.Str)
+	default:
+		s = fmt.Sprintf("data %s unknown", d.Name)
+	}
+	if d.Exported {
+		s += " export"
+	}
+	return s
+}
+
+// String returns the header of the unit followed by its data
+// and its procedures, the entry point last
+func (u *Unit) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "unit %s", u.Name)
+	if u.Initialiser {
+		sb.WriteString(" initialiser")
+	}
+	sb.WriteString("\n")
+
+	for _, d := range u.Data {
+		fmt.Fprintf(&sb, "%s\n", d)
+	}
+	for _, p := range u.Procs {
+		sb.WriteString(p.String())
+	}
+	if u.Entry != nil {
+		sb.WriteString(u.Entry.String())
+	}
+	return sb.String()
+}
@@ -0,0 +1,216 @@
+package ir
+
+import "fmt"
+
+// Verify checks that a unit is well formed: that the code of every
+// procedure is well formed, that procedure and data names are unique,
+// and that the closures and addresses it refers to are consistent
+// with the procedures and data of the unit.
+func Verify(u *Unit) error {
+	if u.Entry == nil {
+		return fmt.Errorf("unit %s has no entry point", u.Name)
+	}
+	if !u.Entry.Entry {
+		return fmt.Errorf("unit %s: proc %s is not an entry point", u.Name, u.Entry.Name)
+	}
+
+	data := make(map[string]Data)
+	for _, d := range u.Data {
+		if _, ok := data[d.Name]; ok {
+			return fmt.Errorf("unit %s: data %s is defined more than once", u.Name, d.Name)
+		}
+		data[d.Name] = d
+	}
+
+	procs := make(map[string]*Proc)
+	for _, p := range append(u.Procs, u.Entry) {
+		if _, ok := procs[p.Name]; ok {
+			return fmt.Errorf("unit %s: proc %s is defined more than once", u.Name, p.Name)
+		}
+		if _, ok := data[p.Name]; ok {
+			return fmt.Errorf("unit %s: %s is defined both as proc and as data", u.Name, p.Name)
+		}
+		procs[p.Name] = p
+	}
+
+	for _, p := range append(u.Procs, u.Entry) {
+		if p.Entry && p != u.Entry {
+			return fmt.Errorf("unit %s: proc %s is an entry point", u.Name, p.Name)
+		}
+		if err := p.Verify(); err != nil {
+			return err
+		}
+
+		for i, in := range p.Code {
+			switch in.Op {
+			case MakeClosure:
+				q, ok := procs[in.Name]
+				if !ok {
+					// procedures of other units have static closures
+					if len(in.Args) != 0 {
+						return instrError(p, i, "closure of undefined proc %s captures variables", in.Name)
+					}
+					continue
+				}
+				if q.Entry {
+					return instrError(p, i, "closure of entry point %s", in.Name)
+				}
+				if len(in.Args) != q.Free {
+					return instrError(p, i, "closure of %s captures %d variables, it has %d", in.Name, len(in.Args), q.Free)
+				}
+			case Address:
+				if d, ok := data[in.Name]; !ok || d.Kind != StringData {
+					return instrError(p, i, "address of %s, which is not a string", in.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Verify checks that the code of a procedure is well formed: that the
+// instructions have the operands their op requires, that temporaries
+// and labels are in range, that every label is marked exactly once,
+// after the jumps to it, and that temporaries are assigned on every
+// path leading to their uses. Code must not run past its end.
+func (p *Proc) Verify() error {
+	if p.Entry && (p.Params != 0 || p.Variadic || p.Free != 0) {
+		return fmt.Errorf("proc %s: entry point takes arguments", p.Name)
+	}
+	if p.Params < 0 || p.Free < 0 || p.ParamTemps() > p.Temps {
+		return fmt.Errorf("proc %s: bad parameters", p.Name)
+	}
+
+	// assigned holds the temporaries assigned on every path
+	// reaching the current instruction, and is nil when
+	// it cannot be reached
+	assigned := make([]bool, p.Temps)
+	for t := 0; t < p.ParamTemps(); t++ {
+		assigned[t] = true
+	}
+	// incoming holds, for every label, the temporaries
+	// assigned on every jump to it seen so far
+	incoming := make(map[Label][]bool)
+	marked := make(map[Label]bool)
+
+	join := func(l Label, state []bool) {
+		if state == nil {
+			return
+		}
+		in, ok := incoming[l]
+		if !ok {
+			incoming[l] = append([]bool{}, state...)
+			return
+		}
+		for t := range in {
+			in[t] = in[t] && state[t]
+		}
+	}
+
+	for i, in := range p.Code {
+		if err := p.checkOperands(in); err != nil {
+			return instrError(p, i, "%s", err)
+		}
+
+		if in.Op == Mark {
+			if marked[in.Target] {
+				return instrError(p, i, "label %s is marked more than once", in.Target)
+			}
+			marked[in.Target] = true
+			join(in.Target, assigned)
+			assigned = incoming[in.Target]
+			continue
+		}
+
+		if assigned != nil {
+			for _, t := range in.Uses() {
+				if !assigned[t] {
+					return instrError(p, i, "%s may be used before it is assigned", t)
+				}
+			}
+		}
+
+		switch in.Op {
+		case Jump, JumpIfFalse:
+			if marked[in.Target] {
+				return instrError(p, i, "backward jump to %s", in.Target)
+			}
+			join(in.Target, assigned)
+		}
+
+		if in.Op == Jump || in.Op == Return {
+			assigned = nil
+		} else if in.HasDst() && assigned != nil {
+			assigned[in.Dst] = true
+		}
+	}
+
+	if assigned != nil {
+		return fmt.Errorf("proc %s: code runs past its end", p.Name)
+	}
+	for l := range incoming {
+		if !marked[l] {
+			return fmt.Errorf("proc %s: label %s is never marked", p.Name, l)
+		}
+	}
+
+	return nil
+}
+
+// checkOperands checks the operands of a single instruction
+func (p *Proc) checkOperands(in Instr) error {
+	args := -1
+	switch in.Op {
+	case Move, StoreGlobal, JumpIfFalse, Return:
+		args = 1
+	case LoadFree, LoadGlobal, Address, Jump, Mark:
+		args = 0
+	case Prim:
+		n, ok := Primitives[in.Name]
+		if !ok {
+			return fmt.Errorf("unknown primitive %s", in.Name)
+		}
+		args = n
+	case CallClosure:
+		if len(in.Args) == 0 {
+			return fmt.Errorf("call without closure")
+		}
+	case Call, MakeClosure:
+	default:
+		return fmt.Errorf("unknown op %d", in.Op)
+	}
+	if args >= 0 && len(in.Args) != args {
+		return fmt.Errorf("takes %d operands, has %d", args, len(in.Args))
+	}
+
+	switch in.Op {
+	case Prim, Call, MakeClosure, LoadGlobal, StoreGlobal, Address:
+		if in.Name == "" {
+			return fmt.Errorf("missing name")
+		}
+	case Jump, JumpIfFalse, Mark:
+		if in.Target < 0 || int(in.Target) >= p.Labels {
+			return fmt.Errorf("label %s out of range", in.Target)
+		}
+	case LoadFree:
+		if in.Index < 0 || in.Index >= p.Free {
+			return fmt.Errorf("free variable %d out of range", in.Index)
+		}
+	}
+
+	if in.HasDst() && (in.Dst < 0 || int(in.Dst) >= p.Temps) {
+		return fmt.Errorf("temporary %s out of range", in.Dst)
+	}
+	for _, t := range in.Uses() {
+		if t < 0 || int(t) >= p.Temps {
+			return fmt.Errorf("temporary %s out of range", t)
+		}
+	}
+
+	return nil
+}
+
+func instrError(p *Proc, i int, format string, a ...interface{}) error {
+	return fmt.Errorf("proc %s: instruction %d (%s): %s", p.Name, i, p.Code[i], fmt.Sprintf(format, a...))
+}
@@ -43,12 +43,14 @@ func parseExpr(tokens *Tokens) (expr.E, error) {
 			return expr.N(head.Number), nil
 		case TokenString:
 			return expr.S(head.String), nil
+		case TokenBool:
+			return expr.B(head.Bool), nil
 		case TokenRParen:
 			return expr.Nil(), fmt.Errorf("unexpected ')'")
 		case TokenLParen:
 			elems := make([]expr.E, 0)
 
-			for tokens.head().Typ != TokenRParen {
+			for tokens.len() > 0 && tokens.head().Typ != TokenRParen {
 				n, err := parseExpr(tokens)
 				if err != nil {
 					return expr.Nil(), fmt.Errorf("error parsing list: %w\n", err)
@@ -56,6 +58,9 @@ func parseExpr(tokens *Tokens) (expr.E, error) {
 
 				elems = append(elems, n)
 			}
+			if tokens.len() == 0 {
+				return expr.Nil(), fmt.Errorf("input ended before list terminated")
+			}
 			// remove ')'
 			tokens.pop()
 			return expr.L(elems...), nil
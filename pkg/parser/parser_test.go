@@ -86,6 +86,17 @@ func TestTokenize(t *testing.T) {
 				rparen(),
 			},
 		},
+		{
+			code: "(if #t #f x)",
+			expected: []Token{
+				lparen(),
+				ident("if"),
+				boolean(true),
+				boolean(false),
+				ident("x"),
+				rparen(),
+			},
+		},
 		{
 			code: `"hello world"`,
 			expected: []Token{
@@ -185,3 +196,28 @@ func TestParseMultipleExprs(t *testing.T) {
 
 	require.Equal(t, expected, result)
 }
+
+func TestSpans(t *testing.T) {
+	code := `(let (x "a b")
+  x) ()  42`
+	expected := []Span{
+		{
+			Start: 0,
+			End:   19,
+			Elems: []Span{
+				{Start: 1, End: 4},
+				{Start: 5, End: 14, Elems: []Span{{Start: 6, End: 7}, {Start: 8, End: 13}}},
+				{Start: 17, End: 18},
+			},
+		},
+		{Start: 20, End: 22},
+		{Start: 24, End: 26},
+	}
+
+	result, err := Spans(code)
+	require.NoError(t, err)
+	require.Equal(t, expected, result)
+
+	_, err = Spans("(x")
+	require.ErrorContains(t, err, "input ended before list terminated")
+}
@@ -0,0 +1,55 @@
+package parser
+
+import "fmt"
+
+// Span is the extent of an expression in the code, from the offset of
+// its first rune to the one past its last, with the spans of its
+// elements when it is a list
+type Span struct {
+	Start int
+	End   int
+	Elems []Span
+}
+
+// Spans returns the spans of the expressions Parse returns for the
+// tokens of code, so that tools can edit the code in place
+func Spans(code string) ([]Span, error) {
+	tokens, err := Tokenize(code)
+	if err != nil {
+		return nil, err
+	}
+
+	spans := make([]Span, 0)
+	for tokens.len() > 0 {
+		span, err := parseSpan(tokens)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing expressions: %w", err)
+		}
+		spans = append(spans, span)
+	}
+	return spans, nil
+}
+
+func parseSpan(tokens *Tokens) (Span, error) {
+	offsets := tokens.offsets[0]
+	switch tokens.pop().Typ {
+	case TokenRParen:
+		return Span{}, fmt.Errorf("unexpected ')'")
+	case TokenLParen:
+		span := Span{Start: offsets[0]}
+		for tokens.len() > 0 && tokens.head().Typ != TokenRParen {
+			elem, err := parseSpan(tokens)
+			if err != nil {
+				return Span{}, fmt.Errorf("error parsing list: %w", err)
+			}
+			span.Elems = append(span.Elems, elem)
+		}
+		if tokens.len() == 0 {
+			return Span{}, fmt.Errorf("input ended before list terminated")
+		}
+		span.End = tokens.offsets[0][1]
+		tokens.pop()
+		return span, nil
+	}
+	return Span{Start: offsets[0], End: offsets[1]}, nil
+}
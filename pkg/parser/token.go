@@ -14,6 +14,7 @@ const (
 	TokenIdent
 	TokenNumber
 	TokenString
+	TokenBool
 )
 
 type Token struct {
@@ -21,6 +22,7 @@ type Token struct {
 	Ident  string
 	Number int
 	String string
+	Bool   bool
 }
 
 func lparen() Token {
@@ -56,8 +58,17 @@ func str(s string) Token {
 	}
 }
 
+func boolean(b bool) Token {
+	return Token{
+		Typ:  TokenBool,
+		Bool: b,
+	}
+}
+
 type Tokens struct {
 	tokens []Token
+	// the start and end offsets of the tokens in the code, in runes
+	offsets [][2]int
 }
 
 func (t *Tokens) pop() Token {
@@ -66,6 +77,7 @@ func (t *Tokens) pop() Token {
 	}
 	token := t.tokens[0]
 	t.tokens = t.tokens[1:]
+	t.offsets = t.offsets[1:]
 
 	return token
 }
@@ -77,8 +89,9 @@ func (t *Tokens) head() Token {
 	return t.tokens[0]
 }
 
-func (t *Tokens) append(tok Token) {
+func (t *Tokens) append(tok Token, start, end int) {
 	t.tokens = append(t.tokens, tok)
+	t.offsets = append(t.offsets, [2]int{start, end})
 }
 
 func (t *Tokens) len() int {
@@ -105,13 +118,13 @@ func Tokenize(code string) (*Tokens, error) {
 		}
 
 		if runes[i] == '(' {
-			tokens.append(lparen())
+			tokens.append(lparen(), i, i+1)
 			i++
 			continue
 		}
 
 		if runes[i] == ')' {
-			tokens.append(rparen())
+			tokens.append(rparen(), i, i+1)
 			i++
 			continue
 		}
@@ -127,7 +140,7 @@ func Tokenize(code string) (*Tokens, error) {
 			}
 
 			t := str(string(runes[start:i]))
-			tokens.append(t)
+			tokens.append(t, start-1, i+1)
 			i++
 			continue
 		}
@@ -147,7 +160,7 @@ func Tokenize(code string) (*Tokens, error) {
 			}
 
 			t := number(n)
-			tokens.append(t)
+			tokens.append(t, start, i)
 			continue
 		}
 
@@ -158,8 +171,16 @@ func Tokenize(code string) (*Tokens, error) {
 		}
 
 		if start != i {
-			t := ident(string(runes[start:i]))
-			tokens.append(t)
+			var t Token
+			switch id := string(runes[start:i]); id {
+			case "#t":
+				t = boolean(true)
+			case "#f":
+				t = boolean(false)
+			default:
+				t = ident(id)
+			}
+			tokens.append(t, start, i)
 			continue
 		}
 
@@ -3,7 +3,14 @@ package preprocess
 var names []string = []string{
 	"progn",
 	"define",
+	"declare",
+	"set!",
+	"global",
+	"global-ref",
+	"global-set!",
 	"let",
+	"let*",
+	"letrec*",
 	"if",
 	"_main",
 	"code",
@@ -17,16 +24,55 @@ var names []string = []string{
 	"ccall",
 	"integer->char",
 	"char->integer",
+	"char=?",
+	"char<?",
+	"char>?",
+	"char<=?",
+	"char>=?",
+	"char-upcase",
+	"char-downcase",
+	"char-alphabetic?",
+	"char-numeric?",
+	"char-whitespace?",
+	"write-char",
+	"display",
+	"write",
+	"newline",
+	"read-char",
+	"peek-char",
+	"eof-object?",
+	"current-input-port",
+	"current-output-port",
+	"open-input-file",
+	"open-output-file",
+	"close-port",
+	"read-line",
+	"write-string",
+	"port?",
+	"error-object?",
+	"error-object-message",
+	"command-line",
+	"exit",
 	"null?",
 	"zero?",
+	"eq?",
 	"+",
 	"-",
 	"cons",
 	"car",
 	"cdr",
+	"set-car!",
+	"set-cdr!",
+	"box",
+	"unbox",
+	"set-box!",
 	"make-vector",
 	"vector-ref",
 	"vector-set!",
+	"vector-length",
+	"vector",
+	"vector-fill!",
+	"vector->list",
 }
 
 var builtins map[string]struct{}
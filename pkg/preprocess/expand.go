@@ -0,0 +1,369 @@
+package preprocess
+
+import (
+	"fmt"
+
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+)
+
+// expandBodies rewrites every body (let, lambda, defun and letrec*)
+// so that internal definitions at its beginning are turned into a
+// letrec* form, and letrec* forms into let bindings of boxes.
+func expandBodies(e expr.E) (expr.E, error) {
+	if e.Typ != expr.ExprList || len(e.List) == 0 {
+		return e, nil
+	}
+
+	elems := e.List
+	head := elems[0]
+
+	switch {
+	case expr.IsIdent(head, "lambda"):
+		// (lambda <args> <body...>)
+		if len(elems) < 3 {
+			return expr.Nil(), fmt.Errorf("lambda form must contain at least 3 elements")
+		}
+
+		body, err := expandBody(elems[2:])
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("error expanding lambda body: %w", err)
+		}
+
+		newExpr := []expr.E{head, elems[1]}
+		return expr.L(append(newExpr, body...)...), nil
+
+	case expr.IsIdent(head, "defun"):
+		// (defun <name> <args> <body...>)
+		if len(elems) < 4 {
+			return expr.Nil(), fmt.Errorf("defun form must contain at least 4 elements")
+		}
+
+		// declarations come before definitions, and are kept for inline
+		i := 3
+		for i < len(elems)-1 && isDeclaration(elems[i]) {
+			i++
+		}
+
+		body, err := expandBody(elems[i:])
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("error expanding defun body: %w", err)
+		}
+
+		newExpr := append([]expr.E{head, elems[1], elems[2]}, elems[3:i]...)
+		return expr.L(append(newExpr, body...)...), nil
+
+	case expr.IsNamedLet(elems):
+		// (let <name> ((<variable> <expr>)...) <body...>)
+		// becomes
+		// ((letrec* ((<name> (lambda (<variable>...) <body...>))) <name>) <expr>...)
+		name := elems[1]
+		args := []expr.E{}
+		inits := []expr.E{}
+		for _, binding := range elems[2].List {
+			args = append(args, binding.List[0])
+			inits = append(inits, binding.List[1])
+		}
+
+		lambda := []expr.E{expr.Id("lambda"), expr.L(args...)}
+		letrec := expr.L(
+			expr.Id("letrec*"),
+			expr.L(expr.L(name, expr.L(append(lambda, elems[3:]...)...))),
+			name,
+		)
+
+		return expandBodies(expr.L(append([]expr.E{letrec}, inits...)...))
+
+	case expr.IsLet(head):
+		bindings, body, sequential := expr.SplitLet(elems)
+
+		newBindings := []expr.E{}
+		for i, binding := range bindings {
+			b, err := expandBodies(binding.List[1])
+			if err != nil {
+				return expr.Nil(), fmt.Errorf("error expanding let binding at index %d: %w", i, err)
+			}
+			newBindings = append(newBindings, expr.L(binding.List[0], b))
+		}
+
+		body, err := expandBody(body)
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("error expanding let body: %w", err)
+		}
+
+		if sequential && expr.IsIdent(head, "let") {
+			// (let <bindings...> <body>)
+			if len(body) > 1 {
+				// keep the body from being mistaken for bindings
+				body = []expr.E{expr.L(append([]expr.E{expr.Id("progn")}, body...)...)}
+			}
+			return expr.L(append(append([]expr.E{head}, newBindings...), body...)...), nil
+		}
+
+		// (let ((<variable> <expr>)...) <body...>)
+		return expr.L(append([]expr.E{head, expr.L(newBindings...)}, body...)...), nil
+
+	case expr.IsIdent(head, "letrec*"):
+		// (letrec* ((<variable> <expr>)...) <body...>)
+		if len(elems) < 3 {
+			return expr.Nil(), fmt.Errorf("letrec* form must contain at least 3 elements")
+		}
+
+		if elems[1].Typ != expr.ExprList && elems[1].Typ != expr.ExprNil {
+			return expr.Nil(), fmt.Errorf("malformed letrec* form: bindings is not list")
+		}
+
+		return expandLetrec(elems[1].List, elems[2:])
+	}
+
+	newExpr := make([]expr.E, 0, len(elems))
+
+	for _, elem := range elems {
+		elem, err := expandBodies(elem)
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("error expanding bodies in sub expression: %w", err)
+		}
+		newExpr = append(newExpr, elem)
+	}
+
+	return expr.L(newExpr...), nil
+}
+
+// expandBody expands a sequence of body expressions.
+// Definitions at its beginning become a single letrec* form.
+func expandBody(body []expr.E) ([]expr.E, error) {
+	bindings := []expr.E{}
+
+	i := 0
+	for ; i < len(body); i++ {
+		e := body[i]
+		if e.Typ != expr.ExprList || !expr.IsIdent(e.List[0], "define") {
+			break
+		}
+
+		binding, err := defineBinding(e)
+		if err != nil {
+			return nil, fmt.Errorf("error expanding definition at index %d: %w", i, err)
+		}
+		bindings = append(bindings, binding)
+	}
+
+	rest := body[i:]
+
+	for j, e := range rest {
+		if e.Typ == expr.ExprList && expr.IsIdent(e.List[0], "define") {
+			return nil, fmt.Errorf(
+				"definition at index %d must appear at the beginning of a body",
+				i+j,
+			)
+		}
+	}
+
+	if len(rest) == 0 {
+		return nil, fmt.Errorf("body must contain at least one expression")
+	}
+
+	if len(bindings) > 0 {
+		e, err := expandLetrec(bindings, rest)
+		if err != nil {
+			return nil, err
+		}
+		return []expr.E{e}, nil
+	}
+
+	newBody := make([]expr.E, 0, len(rest))
+	for _, e := range rest {
+		e, err := expandBodies(e)
+		if err != nil {
+			return nil, err
+		}
+		newBody = append(newBody, e)
+	}
+
+	return newBody, nil
+}
+
+// defineBinding turns (define <variable> <expr>) into (<variable> <expr>)
+// and (define (<name> <params...>) <body...>) into
+// (<name> (lambda (<params...>) <body...>))
+func defineBinding(e expr.E) (expr.E, error) {
+	elems := e.List
+	if len(elems) < 3 {
+		return expr.Nil(), fmt.Errorf("define form must contain at least 3 elements")
+	}
+
+	target := elems[1]
+
+	switch target.Typ {
+	case expr.ExprIdent:
+		if len(elems) != 3 {
+			return expr.Nil(), fmt.Errorf("malformed define form")
+		}
+		return expr.L(target, elems[2]), nil
+	case expr.ExprList:
+		name := target.List[0]
+		if name.Typ != expr.ExprIdent {
+			return expr.Nil(), fmt.Errorf("malformed define form: name is not identifier")
+		}
+
+		params := expr.L(target.List[1:]...)
+		if len(target.List) == 3 && expr.IsIdent(target.List[1], ".") {
+			// (define (<name> . <rest>) <body...>)
+			params = target.List[2]
+		}
+
+		lambda := []expr.E{
+			expr.Id("lambda"),
+			params,
+		}
+
+		return expr.L(name, expr.L(append(lambda, elems[2:]...)...)), nil
+	default:
+		return expr.Nil(), fmt.Errorf("malformed define form")
+	}
+}
+
+// expandLetrec turns
+//
+//	(letrec* ((v1 e1) ... (vn en)) <body...>)
+//
+// into
+//
+//	(let ((v1 (box ())) ... (vn (box ())))
+//	  (set-box! v1 e1) ... (set-box! vn en) <body...>)
+//
+// with every reference to v1...vn replaced by (unbox vi).
+// Closures capture the box, so they see values assigned later on.
+func expandLetrec(bindings []expr.E, body []expr.E) (expr.E, error) {
+	boxed := make(map[string]struct{})
+	for i, binding := range bindings {
+		if binding.Typ != expr.ExprList || len(binding.List) != 2 {
+			return expr.Nil(), fmt.Errorf("malformed letrec* binding at index %d", i)
+		}
+		if binding.List[0].Typ != expr.ExprIdent {
+			return expr.Nil(), fmt.Errorf(
+				"malformed letrec* binding: variable at index %d is not identifier",
+				i,
+			)
+		}
+		boxed[binding.List[0].Ident] = struct{}{}
+	}
+
+	body, err := expandBody(body)
+	if err != nil {
+		return expr.Nil(), fmt.Errorf("error expanding letrec* body: %w", err)
+	}
+
+	boxes := []expr.E{}
+	sets := []expr.E{}
+
+	for i, binding := range bindings {
+		v := binding.List[0]
+
+		b, err := expandBodies(binding.List[1])
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("error expanding letrec* binding at index %d: %w", i, err)
+		}
+
+		boxes = append(boxes, expr.L(v, expr.L(expr.Id("box"), expr.Nil())))
+		sets = append(sets, expr.L(expr.Id("set-box!"), v, unboxRefs(b, boxed)))
+	}
+
+	for _, e := range body {
+		sets = append(sets, unboxRefs(e, boxed))
+	}
+
+	let := []expr.E{expr.Id("let"), expr.L(boxes...)}
+
+	return expr.L(append(let, sets...)...), nil
+}
+
+// unboxRefs replaces references to boxed variables with (unbox <variable>),
+// taking shadowing by lambda arguments and let bindings into account
+func unboxRefs(e expr.E, boxed map[string]struct{}) expr.E {
+	switch e.Typ {
+	case expr.ExprIdent:
+		if _, ok := boxed[e.Ident]; ok {
+			return expr.L(expr.Id("unbox"), e)
+		}
+		return e
+	case expr.ExprList:
+		elems := e.List
+		head := elems[0]
+
+		if expr.IsIdent(head, "lambda") && len(elems) >= 3 {
+			inner := without(boxed, expr.Params(elems[1]))
+			newExpr := []expr.E{head, elems[1]}
+			for _, elem := range elems[2:] {
+				newExpr = append(newExpr, unboxRefs(elem, inner))
+			}
+			return expr.L(newExpr...)
+		}
+
+		if expr.IsLet(head) && !expr.IsNamedLet(elems) {
+			bindings, body, sequential := expr.SplitLet(elems)
+			inner := boxed
+			newBindings := []expr.E{}
+			for _, binding := range bindings {
+				v := binding.List[0]
+				newBindings = append(newBindings, expr.L(v, unboxRefs(binding.List[1], inner)))
+				if sequential {
+					inner = without(inner, []expr.E{v})
+				}
+			}
+			inner = without(inner, firsts(bindings))
+			newBody := []expr.E{}
+			for _, elem := range body {
+				newBody = append(newBody, unboxRefs(elem, inner))
+			}
+			if sequential && expr.IsIdent(head, "let") {
+				return expr.L(append(append([]expr.E{head}, newBindings...), newBody...)...)
+			}
+			return expr.L(append([]expr.E{head, expr.L(newBindings...)}, newBody...)...)
+		}
+
+		newExpr := make([]expr.E, 0, len(elems))
+		for _, elem := range elems {
+			newExpr = append(newExpr, unboxRefs(elem, boxed))
+		}
+		return expr.L(newExpr...)
+	default:
+		return e
+	}
+}
+
+// without returns a copy of vars minus the given identifiers
+func without(vars map[string]struct{}, ids []expr.E) map[string]struct{} {
+	result := make(map[string]struct{}, len(vars))
+	for k := range vars {
+		result[k] = struct{}{}
+	}
+	for _, id := range ids {
+		if id.Typ == expr.ExprIdent {
+			delete(result, id.Ident)
+		}
+	}
+	return result
+}
+
+// with returns a copy of vars plus the given identifiers
+func with(vars map[string]struct{}, ids []expr.E) map[string]struct{} {
+	result := make(map[string]struct{}, len(vars)+len(ids))
+	for k := range vars {
+		result[k] = struct{}{}
+	}
+	for _, id := range ids {
+		if id.Typ == expr.ExprIdent {
+			result[id.Ident] = struct{}{}
+		}
+	}
+	return result
+}
+
+// firsts returns the first element of each of the given lists
+func firsts(es []expr.E) []expr.E {
+	result := make([]expr.E, 0, len(es))
+	for _, e := range es {
+		result = append(result, e.List[0])
+	}
+	return result
+}
@@ -0,0 +1,145 @@
+package preprocess
+
+import (
+	"fmt"
+
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+)
+
+// globalDefinition returns the variable defined by
+// a top-level (define <variable> <expr>) form
+func globalDefinition(e expr.E) (string, bool) {
+	if e.Typ != expr.ExprList || len(e.List) != 3 ||
+		!expr.IsIdent(e.List[0], "define") || e.List[1].Typ != expr.ExprIdent {
+		return "", false
+	}
+	return e.List[1].Ident, true
+}
+
+// defineProcedures turns top-level (define (<name> <params...>) <body...>)
+// forms into defuns
+func defineProcedures(es []expr.E) ([]expr.E, error) {
+	result := make([]expr.E, 0, len(es))
+	for i, e := range es {
+		if e.Typ != expr.ExprList || len(e.List) == 0 || !expr.IsIdent(e.List[0], "define") {
+			result = append(result, e)
+			continue
+		}
+
+		binding, err := defineBinding(e)
+		if err != nil {
+			return nil, fmt.Errorf("error in definition at index %d: %w", i, err)
+		}
+		if e.List[1].Typ == expr.ExprIdent {
+			result = append(result, e)
+			continue
+		}
+
+		// (<name> (lambda <params> <body...>))
+		lambda := binding.List[1].List
+		defun := []expr.E{expr.Id("defun"), binding.List[0], lambda[1]}
+		result = append(result, expr.L(append(defun, lambda[2:]...)...))
+	}
+	return result, nil
+}
+
+// gatherGlobals turns the top-level (define <variable> <expr>) forms of es
+// into the initialisations (global-set! <variable> <expr>), references to
+// global variables into (global-ref <variable>), and (set! <variable> <expr>)
+// into global-set!. Global variables are not bound in the environment,
+// so closures never capture them. imported holds the global variables of
+// other units, and the ones defined in es are returned in order.
+func gatherGlobals(es []expr.E, imported map[string]struct{}) ([]expr.E, []string, error) {
+	defined := []string{}
+	globals := make(map[string]struct{}, len(imported))
+	for name := range imported {
+		globals[name] = struct{}{}
+	}
+
+	defuns := make(map[string]struct{})
+	for _, e := range es {
+		if e.Typ == expr.ExprList && len(e.List) > 1 &&
+			expr.IsIdent(e.List[0], "defun") && e.List[1].Typ == expr.ExprIdent {
+			defuns[e.List[1].Ident] = struct{}{}
+		}
+	}
+
+	for _, e := range es {
+		name, ok := globalDefinition(e)
+		if !ok {
+			continue
+		}
+		if _, ok := defuns[name]; ok {
+			return nil, nil, fmt.Errorf("'%s' is defined both as a procedure and as a global variable", name)
+		}
+		for _, other := range defined {
+			if other == name {
+				return nil, nil, fmt.Errorf("global variable '%s' is defined more than once", name)
+			}
+		}
+		defined = append(defined, name)
+		globals[name] = struct{}{}
+	}
+
+	result := make([]expr.E, 0, len(es))
+	for i, e := range es {
+		if _, ok := globalDefinition(e); ok {
+			e = expr.L(expr.Id("set!"), e.List[1], e.List[2])
+		}
+
+		e, err := mapFree(e, nil, func(id expr.E) (expr.E, error) {
+			if _, ok := globals[id.Ident]; ok {
+				return expr.L(expr.Id("global-ref"), id), nil
+			}
+			return id, nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		e, err = assignGlobals(e)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error at index %d: %w", i, err)
+		}
+		result = append(result, e)
+	}
+
+	return result, defined, nil
+}
+
+// assignGlobals turns (set! (global-ref <variable>) <expr>)
+// into (global-set! <variable> <expr>)
+func assignGlobals(e expr.E) (expr.E, error) {
+	if e.Typ != expr.ExprList || len(e.List) == 0 {
+		return e, nil
+	}
+
+	elems := e.List
+	if expr.IsIdent(elems[0], "set!") {
+		if len(elems) != 3 {
+			return expr.Nil(), fmt.Errorf("set! form must contain 3 elements")
+		}
+		target := elems[1]
+		if target.Typ == expr.ExprIdent {
+			return expr.Nil(), fmt.Errorf("cannot assign '%s', which is not a global variable", target.Ident)
+		}
+		if target.Typ != expr.ExprList || len(target.List) != 2 || !expr.IsIdent(target.List[0], "global-ref") {
+			return expr.Nil(), fmt.Errorf("malformed set! form")
+		}
+		value, err := assignGlobals(elems[2])
+		if err != nil {
+			return expr.Nil(), err
+		}
+		return expr.L(expr.Id("global-set!"), target.List[1], value), nil
+	}
+
+	newExpr := make([]expr.E, 0, len(elems))
+	for _, elem := range elems {
+		elem, err := assignGlobals(elem)
+		if err != nil {
+			return expr.Nil(), err
+		}
+		newExpr = append(newExpr, elem)
+	}
+	return expr.L(newExpr...), nil
+}
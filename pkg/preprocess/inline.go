@@ -0,0 +1,261 @@
+package preprocess
+
+import (
+	"fmt"
+
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+)
+
+// DefaultInlineSize is the size of the largest procedure body
+// inlined unless Options.InlineSize says otherwise
+const DefaultInlineSize = 16
+
+// inliner substitutes the bodies of small procedures
+// for the calls to them
+type inliner struct {
+	// the procedures which may be inlined, by name
+	defuns map[string]inlineCandidate
+	// the largest size of the bodies inlined
+	size int
+}
+
+type inlineCandidate struct {
+	params []expr.E
+	body   []expr.E
+	// whether body has its own calls inlined
+	expanded bool
+	// the identifiers body refers to, other than its parameters
+	free map[string]struct{}
+}
+
+// inline rewrites the applications of lambda expressions in es,
+// ((lambda (<param>...) <body...>) <arg>...), into the equivalent
+// (let ((<param> <arg>)...) <body...>), and does the same for the
+// calls to procedures defined in es whose body is at most size
+// expressions large, as counted by exprSize. Recursive procedures,
+// including those calling themselves through others, are not inlined,
+// nor are those whose body starts with the declaration (declare noinline),
+// which is removed. A call is not inlined where a variable binds the name
+// of the procedure or of one its body refers to.
+func inline(es []expr.E, size int) ([]expr.E, error) {
+	in := inliner{defuns: make(map[string]inlineCandidate), size: size}
+
+	result := make([]expr.E, 0, len(es))
+	for _, e := range es {
+		if !isDefun(e) {
+			result = append(result, e)
+			continue
+		}
+
+		name, params, body := e.List[1], e.List[2], e.List[3:]
+		noinline := false
+		for len(body) > 0 && isDeclaration(body[0]) {
+			d := body[0].List
+			if len(d) != 2 || !expr.IsIdent(d[1], "noinline") {
+				return nil, fmt.Errorf("unknown declaration in procedure '%s'", name.Ident)
+			}
+			noinline = true
+			body = body[1:]
+		}
+		if len(body) == 0 {
+			return nil, fmt.Errorf("procedure '%s' has no body", name.Ident)
+		}
+
+		required, rest, err := expr.SplitParams(params)
+		if err == nil && rest.Typ == expr.ExprNil && !noinline {
+			in.defuns[name.Ident] = inlineCandidate{params: required, body: body}
+		}
+		result = append(result, expr.L(append([]expr.E{e.List[0], name, params}, body...)...))
+	}
+
+	// procedures reaching themselves are recursive
+	recursive := []string{}
+	for name := range in.defuns {
+		if in.reaches(name, name, make(map[string]struct{})) {
+			recursive = append(recursive, name)
+		}
+	}
+	for _, name := range recursive {
+		delete(in.defuns, name)
+	}
+
+	for i, e := range result {
+		if isDefun(e) {
+			body := in.inlineAll(e.List[3:], with(nil, expr.Params(e.List[2])))
+			result[i] = expr.L(append([]expr.E{e.List[0], e.List[1], e.List[2]}, body...)...)
+			continue
+		}
+		result[i] = in.inline(e, nil)
+	}
+	return result, nil
+}
+
+// reaches reports whether the body of the procedure from
+// refers to the procedure to, directly or through others
+func (in *inliner) reaches(from, to string, visited map[string]struct{}) bool {
+	if _, ok := visited[from]; ok {
+		return false
+	}
+	visited[from] = struct{}{}
+
+	d := in.defuns[from]
+	free := make(map[string]struct{})
+	_ = gatherFreeVariables(expr.L(d.body...), with(nil, d.params), free)
+	for name := range free {
+		if name == to {
+			return true
+		}
+		if _, ok := in.defuns[name]; ok && in.reaches(name, to, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidate returns the procedure called name with the calls in its
+// body inlined, if it may be inlined
+func (in *inliner) candidate(name string) (inlineCandidate, bool) {
+	d, ok := in.defuns[name]
+	if !ok {
+		return inlineCandidate{}, false
+	}
+	if !d.expanded {
+		// the procedure is not recursive, so this terminates
+		params := with(nil, d.params)
+		d.body = in.inlineAll(d.body, params)
+		d.free = make(map[string]struct{})
+		_ = gatherFreeVariables(expr.L(d.body...), params, d.free)
+		d.expanded = true
+		in.defuns[name] = d
+	}
+	if exprSize(expr.L(d.body...))-1 > in.size {
+		return inlineCandidate{}, false
+	}
+	return d, true
+}
+
+func (in *inliner) inlineAll(es []expr.E, bound map[string]struct{}) []expr.E {
+	result := make([]expr.E, 0, len(es))
+	for _, e := range es {
+		result = append(result, in.inline(e, bound))
+	}
+	return result
+}
+
+// inline inlines the calls in e, where the variables bound are in scope
+func (in *inliner) inline(e expr.E, bound map[string]struct{}) expr.E {
+	if e.Typ != expr.ExprList || len(e.List) == 0 {
+		return e
+	}
+
+	elems := e.List
+	head := elems[0]
+	switch {
+	case expr.IsIdent(head, "global-ref"), isDeclaration(e):
+		return e
+	case expr.IsIdent(head, "lambda") && len(elems) >= 3:
+		body := in.inlineAll(elems[2:], with(bound, expr.Params(elems[1])))
+		return expr.L(append([]expr.E{head, elems[1]}, body...)...)
+	case expr.IsLet(head) && len(elems) >= 3 && !expr.IsNamedLet(elems):
+		bindings, body, sequential := expr.SplitLet(elems)
+		inner := bound
+		newBindings := make([]expr.E, 0, len(bindings))
+		for _, binding := range bindings {
+			v := binding.List[0]
+			newBindings = append(newBindings, expr.L(v, in.inline(binding.List[1], inner)))
+			if sequential {
+				inner = with(inner, []expr.E{v})
+			}
+		}
+		newBody := in.inlineAll(body, with(inner, firsts(bindings)))
+		if sequential {
+			head = expr.Id("let*")
+		}
+		return expr.L(append([]expr.E{head, expr.L(newBindings...)}, newBody...)...)
+	}
+
+	args := in.inlineAll(elems[1:], bound)
+
+	if isLambda(head) {
+		// the body is in the scope of the application
+		required, rest, err := expr.SplitParams(head.List[1])
+		if err == nil && rest.Typ == expr.ExprNil && len(required) == len(args) {
+			body := in.inlineAll(head.List[2:], with(bound, required))
+			return bind(required, args, body)
+		}
+		return expr.L(append([]expr.E{in.inline(head, bound)}, args...)...)
+	}
+
+	if head.Typ == expr.ExprIdent {
+		if d, ok := in.inlinable(head.Ident, len(args), bound); ok {
+			return bind(d.params, args, d.body)
+		}
+	}
+	return expr.L(append([]expr.E{in.inline(head, bound)}, args...)...)
+}
+
+// inlinable returns the procedure called name, if a call to it
+// with n arguments can be inlined where the variables bound are in scope
+func (in *inliner) inlinable(name string, n int, bound map[string]struct{}) (inlineCandidate, bool) {
+	if _, ok := bound[name]; ok {
+		return inlineCandidate{}, false
+	}
+	if _, ok := builtins[name]; ok {
+		return inlineCandidate{}, false
+	}
+	d, ok := in.candidate(name)
+	// calls with the wrong number of arguments are left to be reported
+	if !ok || len(d.params) != n {
+		return inlineCandidate{}, false
+	}
+	for v := range d.free {
+		if _, ok := bound[v]; ok {
+			return inlineCandidate{}, false
+		}
+	}
+	return d, true
+}
+
+// bind returns the expression evaluating body with params bound to args
+func bind(params, args, body []expr.E) expr.E {
+	if len(params) == 0 {
+		if len(body) == 1 {
+			return body[0]
+		}
+		return expr.L(append([]expr.E{expr.Id("progn")}, body...)...)
+	}
+
+	bindings := make([]expr.E, 0, len(params))
+	for i, p := range params {
+		bindings = append(bindings, expr.L(p, args[i]))
+	}
+	return expr.L(append([]expr.E{expr.Id("let"), expr.L(bindings...)}, body...)...)
+}
+
+// exprSize returns the number of lists and atoms in e
+func exprSize(e expr.E) int {
+	if e.Typ != expr.ExprList {
+		return 1
+	}
+	n := 1
+	for _, elem := range e.List {
+		n += exprSize(elem)
+	}
+	return n
+}
+
+// isDefun reports whether e is a well formed (defun <name> <params> <body...>)
+func isDefun(e expr.E) bool {
+	return e.Typ == expr.ExprList && len(e.List) >= 4 &&
+		expr.IsIdent(e.List[0], "defun") && e.List[1].Typ == expr.ExprIdent
+}
+
+// isLambda reports whether e is a (lambda <params> <body...>) form
+func isLambda(e expr.E) bool {
+	return e.Typ == expr.ExprList && len(e.List) >= 3 && expr.IsIdent(e.List[0], "lambda")
+}
+
+// isDeclaration reports whether e is a (declare ...) form
+func isDeclaration(e expr.E) bool {
+	return e.Typ == expr.ExprList && len(e.List) > 0 && expr.IsIdent(e.List[0], "declare")
+}
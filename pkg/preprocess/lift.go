@@ -0,0 +1,487 @@
+package preprocess
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+)
+
+// lifter turns the lambdas bound to variables which are only ever
+// called into procedures, so that no closure is allocated for them.
+// The variables the lambdas capture are passed as extra arguments.
+//
+// The expressions are walked twice: the first walk finds the variables
+// and how they are used, and the second rewrites the expressions.
+// Both walks meet the same bindings in the same order.
+type lifter struct {
+	// the variables bound in the expressions, in the order they are met
+	vars []*variable
+	next int
+	// whether the expressions are being rewritten
+	rewriting bool
+	// the lambdas enclosing the expression being walked, innermost
+	// last, with the variables they are bound to if they may be lifted
+	frames []*variable
+	// the identifiers used in the expressions, which labels avoid
+	used    map[string]struct{}
+	counter *int
+	// the lifted procedures, by label
+	lifted map[string]expr.E
+}
+
+// variable is a binding of a local variable
+type variable struct {
+	name string
+	// the number of lambdas enclosing the binding
+	depth int
+	// whether the variable holds a box, as bound by letrec*
+	boxed bool
+	// the index in the body of the let binding the variable of
+	// the (set-box! <variable> <lambda>) statement initialising the box
+	set int
+	// the lambda bound to the variable, if it may be lifted,
+	// and its parameters
+	lambda expr.E
+	params []expr.E
+	// whether the variable is used other than in the operator
+	// position of a call, so that the lambda must be a closure
+	escapes bool
+	// the variables the lambda refers to, bound outside of it
+	free map[*variable]struct{}
+	// the scopes of the calls to the lambda
+	calls []scope
+	// the variables passed to the lifted lambda as extra arguments,
+	// and its label
+	extra []*variable
+	label string
+}
+
+// scope maps the names of the variables in scope to their bindings
+type scope map[string]*variable
+
+func (s scope) with(vs ...*variable) scope {
+	result := make(scope, len(s)+len(vs))
+	for k, v := range s {
+		result[k] = v
+	}
+	for _, v := range vs {
+		result[v.name] = v
+	}
+	return result
+}
+
+// lift lifts the lambdas in es which do not escape, i.e. those bound by
+// let forms, or by letrec* forms through boxes, and only ever called, into
+// procedures taking the variables they capture as extra arguments, and
+// rewrites the calls to them into calls to the procedures. A lambda is
+// not lifted if a call is where one of the variables it captures is
+// shadowed. The procedures are returned as (defun <label> <params> <body...>)
+// forms, where the labels are numbered from counter.
+func lift(es []expr.E, counter *int) ([]expr.E, map[string]expr.E) {
+	l := &lifter{
+		used:    make(map[string]struct{}),
+		counter: counter,
+		lifted:  make(map[string]expr.E),
+	}
+	for _, e := range es {
+		identifiers(e, l.used)
+	}
+
+	for _, e := range es {
+		l.walk(e, nil)
+	}
+	l.decide()
+
+	l.rewriting = true
+	result := make([]expr.E, 0, len(es))
+	for _, e := range es {
+		result = append(result, l.walk(e, nil))
+	}
+	return result, l.lifted
+}
+
+// decide chooses the lambdas which are lifted, their extra arguments and labels
+func (l *lifter) decide() {
+	for changed := true; changed; {
+		changed = false
+
+		// a lifted lambda needs the extra arguments of those it calls
+		extra := make(map[*variable]map[*variable]struct{})
+		for _, v := range l.vars {
+			if !v.isLifted() {
+				continue
+			}
+			extra[v] = make(map[*variable]struct{})
+			for w := range v.free {
+				if !w.isLifted() {
+					extra[v][w] = struct{}{}
+				}
+			}
+		}
+		for grown := true; grown; {
+			grown = false
+			for v, vs := range extra {
+				for w := range v.free {
+					if w == v || !w.isLifted() {
+						continue
+					}
+					for x := range extra[w] {
+						if _, ok := vs[x]; !ok {
+							vs[x] = struct{}{}
+							grown = true
+						}
+					}
+				}
+			}
+		}
+
+		for _, v := range l.vars {
+			if !v.isLifted() {
+				continue
+			}
+			v.extra = v.extra[:0]
+			for w := range extra[v] {
+				v.extra = append(v.extra, w)
+			}
+			sort.Slice(v.extra, func(i, j int) bool {
+				return v.extra[i].name < v.extra[j].name
+			})
+			if !v.reachable() {
+				v.escapes = true
+				changed = true
+			}
+		}
+	}
+
+	for _, v := range l.vars {
+		if !v.isLifted() {
+			continue
+		}
+		for {
+			v.label = fmt.Sprintf("f%d", *l.counter)
+			*l.counter = *l.counter + 1
+			if _, ok := l.used[v.label]; !ok {
+				break
+			}
+		}
+	}
+}
+
+func (v *variable) isLifted() bool {
+	return v.lambda.Typ == expr.ExprList && !v.escapes
+}
+
+// reachable reports whether the extra arguments of v are
+// the variables of their names at the calls to v
+func (v *variable) reachable() bool {
+	for i, w := range v.extra {
+		if i > 0 && v.extra[i-1].name == w.name {
+			return false
+		}
+		for _, s := range v.calls {
+			if s[w.name] != w {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// bind returns the variable bound by name,
+// which is met anew in the first walk
+func (l *lifter) bind(name expr.E) *variable {
+	if l.rewriting {
+		v := l.vars[l.next]
+		l.next++
+		return v
+	}
+	v := &variable{name: name.Ident, depth: len(l.frames), set: -1}
+	l.vars = append(l.vars, v)
+	return v
+}
+
+func (l *lifter) bindAll(names []expr.E) []*variable {
+	vs := make([]*variable, 0, len(names))
+	for _, name := range names {
+		vs = append(vs, l.bind(name))
+	}
+	return vs
+}
+
+// lookup returns the variable name refers to in s, if any.
+// Builtins are not variables, even where a variable shadows them.
+func lookup(s scope, name expr.E) *variable {
+	if name.Typ != expr.ExprIdent {
+		return nil
+	}
+	if _, ok := builtins[name.Ident]; ok {
+		return nil
+	}
+	return s[name.Ident]
+}
+
+// refer records a reference to v by the lambdas enclosing it
+func (l *lifter) refer(v *variable) {
+	if l.rewriting {
+		return
+	}
+	for _, f := range l.frames[v.depth:] {
+		if f != nil {
+			f.free[v] = struct{}{}
+		}
+	}
+}
+
+func (l *lifter) walkAll(es []expr.E, s scope) []expr.E {
+	result := make([]expr.E, 0, len(es))
+	for _, e := range es {
+		result = append(result, l.walk(e, s))
+	}
+	return result
+}
+
+func (l *lifter) walk(e expr.E, s scope) expr.E {
+	if e.Typ == expr.ExprIdent {
+		if v := lookup(s, e); v != nil {
+			l.refer(v)
+			v.escapes = true
+		}
+		return e
+	}
+	if e.Typ != expr.ExprList || len(e.List) == 0 {
+		return e
+	}
+
+	elems := e.List
+	head := elems[0]
+	switch {
+	case expr.IsIdent(head, "global-ref"), isDeclaration(e):
+		return e
+	case expr.IsIdent(head, "global-set!") && len(elems) == 3:
+		return expr.L(head, elems[1], l.walk(elems[2], s))
+	case isDefun(e):
+		inner := s.with(l.bindAll(expr.Params(elems[2]))...)
+		return expr.L(append([]expr.E{head, elems[1], elems[2]}, l.walkAll(elems[3:], inner)...)...)
+	case isLambda(e):
+		return l.walkLambda(e, s, nil)
+	case expr.IsLet(head) && len(elems) >= 3 && !expr.IsNamedLet(elems):
+		return l.walkLet(elems, s)
+	}
+
+	if call, ok := pushCall(elems); ok {
+		return l.walk(call, s)
+	}
+
+	// the operator of a call to a lambda which may be lifted
+	var callee *variable
+	if v := lookup(s, head); v != nil && !v.boxed {
+		callee = v
+	}
+	if head.Typ == expr.ExprList && len(head.List) == 2 && expr.IsIdent(head.List[0], "unbox") {
+		if v := lookup(s, head.List[1]); v != nil && v.boxed {
+			callee = v
+		}
+	}
+	if callee == nil || callee.lambda.Typ != expr.ExprList || len(callee.params) != len(elems)-1 {
+		return expr.L(l.walkAll(elems, s)...)
+	}
+
+	l.refer(callee)
+	args := l.walkAll(elems[1:], s)
+	if !l.rewriting {
+		callee.calls = append(callee.calls, s)
+		return e
+	}
+	if !callee.isLifted() {
+		return expr.L(append([]expr.E{head}, args...)...)
+	}
+	for _, v := range callee.extra {
+		args = append(args, expr.Id(v.name))
+	}
+	return expr.L(append([]expr.E{expr.Id(callee.label)}, args...)...)
+}
+
+// walkLambda walks the lambda e, which is bound to v if v is not nil.
+// It returns nil if the lambda is lifted.
+func (l *lifter) walkLambda(e expr.E, s scope, v *variable) expr.E {
+	if v != nil && !l.rewriting {
+		v.free = make(map[*variable]struct{})
+	}
+	l.frames = append(l.frames, v)
+	params := e.List[1]
+	body := l.walkAll(e.List[2:], s.with(l.bindAll(expr.Params(params))...))
+	l.frames = l.frames[:len(l.frames)-1]
+
+	if v == nil || !l.rewriting || !v.isLifted() {
+		return expr.L(append([]expr.E{e.List[0], params}, body...)...)
+	}
+
+	args := append([]expr.E{}, params.List...)
+	for _, w := range v.extra {
+		args = append(args, expr.Id(w.name))
+	}
+	l.lifted[v.label] = expr.L(append([]expr.E{expr.Id("defun"), expr.Id(v.label), expr.L(args...)}, body...)...)
+	return expr.Nil()
+}
+
+func (l *lifter) walkLet(elems []expr.E, s scope) expr.E {
+	bindings, body, sequential := expr.SplitLet(elems)
+
+	inner := s
+	vars := make([]*variable, 0, len(bindings))
+	values := make([]expr.E, 0, len(bindings))
+	for _, binding := range bindings {
+		v := l.bind(binding.List[0])
+		value := binding.List[1]
+		switch {
+		case liftable(value):
+			if !l.rewriting {
+				v.lambda, v.params = value, value.List[1].List
+			}
+			value = l.walkLambda(value, inner, v)
+		case isBox(value):
+			v.boxed = true
+		default:
+			value = l.walk(value, inner)
+		}
+		vars = append(vars, v)
+		values = append(values, value)
+		if sequential {
+			inner = inner.with(v)
+		}
+	}
+	inner = inner.with(vars...)
+
+	// the boxes are initialised before the last statement of the body
+	if !l.rewriting {
+		for i, stmt := range body[:len(body)-1] {
+			if !isSetBox(stmt) || !liftable(stmt.List[2]) {
+				continue
+			}
+			v := lookup(inner, stmt.List[1])
+			if v == nil || !v.boxed || v.set >= 0 || !contains(vars, v) {
+				continue
+			}
+			v.set = i
+			v.lambda, v.params = stmt.List[2], stmt.List[2].List[1].List
+		}
+	}
+
+	newBody := make([]expr.E, 0, len(body))
+	for i, stmt := range body {
+		v := boxAt(vars, i)
+		if v == nil {
+			newBody = append(newBody, l.walk(stmt, inner))
+			continue
+		}
+		lambda := l.walkLambda(stmt.List[2], inner, v)
+		if !l.rewriting || !v.isLifted() {
+			newBody = append(newBody, expr.L(stmt.List[0], stmt.List[1], lambda))
+		}
+	}
+
+	// lifted lambdas, and the boxes they were put in, are no longer bound
+	newBindings := make([]expr.E, 0, len(bindings))
+	for i, v := range vars {
+		if !l.rewriting || !v.isLifted() {
+			newBindings = append(newBindings, expr.L(expr.Id(v.name), values[i]))
+		}
+	}
+	if len(newBindings) == 0 {
+		return bind(nil, nil, newBody)
+	}
+
+	head := elems[0]
+	if sequential {
+		head = expr.Id("let*")
+	}
+	return expr.L(append([]expr.E{head, expr.L(newBindings...)}, newBody...)...)
+}
+
+// pushCall rewrites the call of the value of a let form,
+// ((let <bindings> <body...> <last>) <arg>...), into the equivalent
+// (let <bindings> <body...> (<last> <arg>...)), where the bindings
+// do not shadow the variables of the arguments. Named lets are
+// such calls once expanded.
+func pushCall(elems []expr.E) (expr.E, bool) {
+	head := elems[0]
+	if head.Typ != expr.ExprList || len(head.List) < 3 ||
+		!expr.IsLet(head.List[0]) || expr.IsNamedLet(head.List) {
+		return expr.Nil(), false
+	}
+
+	bindings, body, sequential := expr.SplitLet(head.List)
+	free := make(map[string]struct{})
+	_ = gatherFreeVariables(expr.L(elems[1:]...), nil, free)
+	for _, v := range firsts(bindings) {
+		if _, ok := free[v.Ident]; ok {
+			return expr.Nil(), false
+		}
+	}
+
+	last := expr.L(append([]expr.E{body[len(body)-1]}, elems[1:]...)...)
+	let := head.List[0]
+	if sequential {
+		let = expr.Id("let*")
+	}
+	newBody := append(append([]expr.E{}, body[:len(body)-1]...), last)
+	return expr.L(append([]expr.E{let, expr.L(bindings...)}, newBody...)...), true
+}
+
+// liftable reports whether e is a lambda without rest parameter
+func liftable(e expr.E) bool {
+	if !isLambda(e) {
+		return false
+	}
+	_, rest, err := expr.SplitParams(e.List[1])
+	return err == nil && rest.Typ == expr.ExprNil
+}
+
+// isBox reports whether e is the (box <literal>) form binding
+// a variable of a letrec* form
+func isBox(e expr.E) bool {
+	if e.Typ != expr.ExprList || len(e.List) != 2 || !expr.IsIdent(e.List[0], "box") {
+		return false
+	}
+	arg := e.List[1]
+	return arg.Typ != expr.ExprIdent && arg.Typ != expr.ExprList
+}
+
+// isSetBox reports whether e is a (set-box! <variable> <expr>) form
+func isSetBox(e expr.E) bool {
+	return e.Typ == expr.ExprList && len(e.List) == 3 &&
+		expr.IsIdent(e.List[0], "set-box!") && e.List[1].Typ == expr.ExprIdent
+}
+
+// boxAt returns the variable of vars whose box is initialised
+// to a lambda by the statement at index i of the body
+func boxAt(vars []*variable, i int) *variable {
+	for _, v := range vars {
+		if v.boxed && v.set == i && v.lambda.Typ == expr.ExprList {
+			return v
+		}
+	}
+	return nil
+}
+
+func contains(vars []*variable, v *variable) bool {
+	for _, w := range vars {
+		if w == v {
+			return true
+		}
+	}
+	return false
+}
+
+// identifiers adds the identifiers in e to ids
+func identifiers(e expr.E, ids map[string]struct{}) {
+	switch e.Typ {
+	case expr.ExprIdent:
+		ids[e.Ident] = struct{}{}
+	case expr.ExprList:
+		for _, elem := range e.List {
+			identifiers(elem, ids)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package preprocess
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+	"github.com/brenoafb/tinycompiler/pkg/parser"
+)
+
+// CheckLets reports the let forms of es in the original syntax which
+// are likely misread. Any expression of two elements headed by an
+// identifier reads as a binding, so in (let (x 1) (display x) (newline))
+// the body is only (newline). A binding may not name a builtin or a
+// procedure defined in es, and a single expression may follow the
+// bindings, which a progn can group.
+func CheckLets(es []expr.E) error {
+	procedures := make(map[string]struct{})
+	for _, e := range es {
+		if isDefun(e) {
+			procedures[e.List[1].Ident] = struct{}{}
+		}
+		if e.Typ == expr.ExprList && len(e.List) > 2 && expr.IsIdent(e.List[0], "define") &&
+			e.List[1].Typ == expr.ExprList && len(e.List[1].List) > 0 && e.List[1].List[0].Typ == expr.ExprIdent {
+			procedures[e.List[1].List[0].Ident] = struct{}{}
+		}
+	}
+
+	for i, e := range es {
+		if err := checkLets(e, procedures); err != nil {
+			return fmt.Errorf("error in expression at index %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func checkLets(e expr.E, procedures map[string]struct{}) error {
+	if e.Typ != expr.ExprList {
+		return nil
+	}
+	for _, elem := range e.List {
+		if err := checkLets(elem, procedures); err != nil {
+			return err
+		}
+	}
+	if !expr.IsOriginalLet(e.List) {
+		return nil
+	}
+
+	bindings, body, _ := expr.SplitLet(e.List)
+	for _, binding := range bindings {
+		name := binding.List[0].Ident
+		_, builtin := builtins[name]
+		_, procedure := procedures[name]
+		if builtin || procedure {
+			return fmt.Errorf(
+				"let binds '%s', which names a procedure: wrap the body in progn or use the standard syntax ((<variable> <expr>)...)",
+				name,
+			)
+		}
+	}
+	if len(body) > 1 {
+		return fmt.Errorf(
+			"let has %d expressions after its bindings: wrap them in progn or use the standard syntax ((<variable> <expr>)...)",
+			len(body),
+		)
+	}
+	return nil
+}
+
+// MigrateLet rewrites let forms written in the original syntax
+//
+//	(let (<variable> <expr>)... <body...>)
+//
+// into the standard one. Since the original bindings are sequential,
+// a let* is produced whenever a binding refers to an earlier one.
+func MigrateLet(e expr.E) expr.E {
+	if e.Typ != expr.ExprList {
+		return e
+	}
+
+	elems := make([]expr.E, 0, len(e.List))
+	for _, elem := range e.List {
+		elems = append(elems, MigrateLet(elem))
+	}
+
+	if !expr.IsIdent(elems[0], "let") || expr.IsNamedLet(elems) {
+		return expr.L(elems...)
+	}
+
+	bindings, body, sequential := expr.SplitLet(elems)
+	if !sequential {
+		return expr.L(elems...)
+	}
+
+	head := expr.Id("let")
+	if refersToEarlier(bindings) {
+		head = expr.Id("let*")
+	}
+	if isProgn(body) {
+		body = body[0].List[1:]
+	}
+
+	return expr.L(append([]expr.E{head, expr.L(bindings...)}, body...)...)
+}
+
+// MigrateLetSource rewrites the let forms of src in the original syntax
+// like MigrateLet, by editing their head and the parentheses around their
+// bindings and body in place, so that the rest of src keeps its layout
+func MigrateLetSource(src string) (string, error) {
+	tokens, err := parser.Tokenize(src)
+	if err != nil {
+		return "", fmt.Errorf("tokenizer error: %w", err)
+	}
+	es, err := parser.Parse(tokens)
+	if err != nil {
+		return "", fmt.Errorf("parser error: %w", err)
+	}
+	spans, err := parser.Spans(src)
+	if err != nil {
+		return "", fmt.Errorf("parser error: %w", err)
+	}
+
+	edits := []edit{}
+	for i, e := range es {
+		edits = migrateLetEdits(e, spans[i], edits)
+	}
+
+	// edits don't overlap, and those applied first don't move the others.
+	// A deletion goes before an insertion at the same offset.
+	sort.Slice(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start > edits[j].start
+		}
+		return edits[i].end > edits[j].end
+	})
+	runes := []rune(src)
+	for _, ed := range edits {
+		tail := append([]rune(ed.text), runes[ed.end:]...)
+		runes = append(runes[:ed.start], tail...)
+	}
+	return string(runes), nil
+}
+
+// edit replaces the runes of the source from start to end with text
+type edit struct {
+	start int
+	end   int
+	text  string
+}
+
+func migrateLetEdits(e expr.E, span parser.Span, edits []edit) []edit {
+	if e.Typ != expr.ExprList {
+		return edits
+	}
+	for i, elem := range e.List {
+		edits = migrateLetEdits(elem, span.Elems[i], edits)
+	}
+
+	if !expr.IsIdent(e.List[0], "let") || expr.IsNamedLet(e.List) {
+		return edits
+	}
+	bindings, body, sequential := expr.SplitLet(e.List)
+	if !sequential {
+		return edits
+	}
+
+	if refersToEarlier(bindings) {
+		edits = append(edits, edit{start: span.Elems[0].Start, end: span.Elems[0].End, text: "let*"})
+	}
+	if len(bindings) == 0 {
+		edits = append(edits, edit{start: span.Elems[0].End, end: span.Elems[0].End, text: " ()"})
+	} else {
+		first, last := span.Elems[1], span.Elems[len(bindings)]
+		edits = append(edits,
+			edit{start: first.Start, end: first.Start, text: "("},
+			edit{start: last.End, end: last.End, text: ")"},
+		)
+	}
+	if isProgn(body) {
+		progn := span.Elems[len(bindings)+1]
+		edits = append(edits,
+			edit{start: progn.Start, end: progn.Elems[1].Start},
+			edit{start: progn.Elems[len(progn.Elems)-1].End, end: progn.End},
+		)
+	}
+	return edits
+}
+
+// refersToEarlier reports whether a binding of a let refers to the
+// variable of an earlier one, which only let* allows
+func refersToEarlier(bindings []expr.E) bool {
+	earlier := make(map[string]struct{})
+	for _, binding := range bindings {
+		if mentions(binding.List[1], earlier) {
+			return true
+		}
+		earlier[binding.List[0].Ident] = struct{}{}
+	}
+	return false
+}
+
+// isProgn reports whether the body of a let is a single progn, which
+// only served to separate it from the bindings in the original syntax
+func isProgn(body []expr.E) bool {
+	return len(body) == 1 && body[0].Typ == expr.ExprList &&
+		len(body[0].List) > 1 && expr.IsIdent(body[0].List[0], "progn")
+}
+
+// mentions reports whether any of the given identifiers occurs in e
+func mentions(e expr.E, ids map[string]struct{}) bool {
+	switch e.Typ {
+	case expr.ExprIdent:
+		_, ok := ids[e.Ident]
+		return ok
+	case expr.ExprList:
+		for _, elem := range e.List {
+			if mentions(elem, ids) {
+				return true
+			}
+		}
+	}
+	return false
+}
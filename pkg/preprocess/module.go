@@ -0,0 +1,279 @@
+package preprocess
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+)
+
+// Module is declared by a form heading a source file
+//
+//	(module <name> (export <name>...) (import <module>...))
+//
+// where both the export and import clauses are optional.
+// The procedures and global variables defined in a module are named
+// after it, as in <name>:<procedure>, and only the exported ones are
+// visible to other compilation units. Unqualified references to names
+// exported by imported modules are qualified as well.
+type Module struct {
+	Name    string
+	Exports []string
+	Imports []string
+	// Globals holds the global variables defined by the module
+	Globals []string
+}
+
+// Resolver returns the module with the given name
+type Resolver func(name string) (Module, error)
+
+// Qualify returns the name of a procedure or global variable defined in module
+func Qualify(module, name string) string {
+	return module + ":" + name
+}
+
+// ParseModule returns the module declared by the first of es, if any
+func ParseModule(es []expr.E) (Module, bool, error) {
+	if len(es) == 0 || es[0].Typ != expr.ExprList || len(es[0].List) == 0 ||
+		!expr.IsIdent(es[0].List[0], "module") {
+		return Module{}, false, nil
+	}
+
+	elems := es[0].List
+	if len(elems) < 2 || elems[1].Typ != expr.ExprIdent {
+		return Module{}, false, fmt.Errorf("malformed module form: missing name")
+	}
+	if strings.Contains(elems[1].Ident, ":") {
+		return Module{}, false, fmt.Errorf("malformed module form: name '%s' contains ':'", elems[1].Ident)
+	}
+
+	m := Module{Name: elems[1].Ident}
+	seen := make(map[string]struct{})
+	for _, clause := range elems[2:] {
+		if clause.Typ != expr.ExprList || len(clause.List) == 0 || clause.List[0].Typ != expr.ExprIdent {
+			return Module{}, false, fmt.Errorf("malformed module form: bad clause %s", clause.String())
+		}
+
+		kind := clause.List[0].Ident
+		if kind != "export" && kind != "import" {
+			return Module{}, false, fmt.Errorf("malformed module form: unknown clause '%s'", kind)
+		}
+		if _, ok := seen[kind]; ok {
+			return Module{}, false, fmt.Errorf("malformed module form: more than one %s clause", kind)
+		}
+		seen[kind] = struct{}{}
+
+		names := []string{}
+		for _, name := range clause.List[1:] {
+			if name.Typ != expr.ExprIdent {
+				return Module{}, false, fmt.Errorf("malformed %s clause: %s is not identifier", kind, name.String())
+			}
+			names = append(names, name.Ident)
+		}
+
+		if kind == "export" {
+			m.Exports = names
+		} else {
+			m.Imports = names
+		}
+	}
+
+	for _, e := range es[1:] {
+		if name, ok := globalDefinition(e); ok {
+			m.Globals = append(m.Globals, name)
+		}
+	}
+
+	return m, true, nil
+}
+
+// qualifyModule qualifies the names defined in m and the references
+// to them and to the names exported by the modules m imports.
+// It also returns the qualified names of the imported global variables.
+func qualifyModule(es []expr.E, m Module, resolve Resolver) ([]expr.E, map[string]struct{}, error) {
+	// exportedBy maps the unqualified name of every imported procedure
+	// and global variable to the modules exporting it
+	exportedBy := make(map[string][]string)
+	globals := make(map[string]struct{})
+	for _, imported := range m.Imports {
+		if imported == m.Name {
+			return nil, nil, fmt.Errorf("module %s imports itself", m.Name)
+		}
+		if resolve == nil {
+			return nil, nil, fmt.Errorf("cannot import module %s: no resolver", imported)
+		}
+		other, err := resolve(imported)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error importing module %s: %w", imported, err)
+		}
+		exports := make(map[string]struct{}, len(other.Exports))
+		for _, name := range other.Exports {
+			exportedBy[name] = append(exportedBy[name], imported)
+			exports[name] = struct{}{}
+		}
+		for _, name := range other.Globals {
+			if _, ok := exports[name]; ok {
+				globals[Qualify(imported, name)] = struct{}{}
+			}
+		}
+	}
+
+	names := make(map[string]string)
+	ambiguous := make(map[string][]string)
+	for name, modules := range exportedBy {
+		if len(modules) > 1 {
+			ambiguous[name] = modules
+			continue
+		}
+		names[name] = Qualify(modules[0], name)
+	}
+
+	// names defined in the module hide imported ones
+	for _, e := range es {
+		name, ok := globalDefinition(e)
+		if !ok && e.Typ == expr.ExprList && len(e.List) > 1 &&
+			expr.IsIdent(e.List[0], "defun") && e.List[1].Typ == expr.ExprIdent {
+			name, ok = e.List[1].Ident, true
+		}
+		if ok {
+			names[name] = Qualify(m.Name, name)
+			delete(ambiguous, name)
+		}
+	}
+
+	for _, name := range m.Exports {
+		if q, ok := names[name]; !ok || q != Qualify(m.Name, name) {
+			return nil, nil, fmt.Errorf("module %s exports undefined name '%s'", m.Name, name)
+		}
+	}
+
+	result := make([]expr.E, 0, len(es))
+	for i, e := range es {
+		e, err := qualifyRefs(e, names, ambiguous)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error qualifying names at index %d: %w", i, err)
+		}
+		result = append(result, e)
+	}
+
+	return result, globals, nil
+}
+
+// qualifyRefs replaces the identifiers in e that are not bound
+// by the names they map to
+func qualifyRefs(
+	e expr.E,
+	names map[string]string,
+	ambiguous map[string][]string,
+) (expr.E, error) {
+	return mapFree(e, nil, func(id expr.E) (expr.E, error) {
+		if _, ok := builtins[id.Ident]; ok {
+			return id, nil
+		}
+		if modules, ok := ambiguous[id.Ident]; ok {
+			sort.Strings(modules)
+			return expr.Nil(), fmt.Errorf(
+				"reference to '%s' is ambiguous, it is exported by %s",
+				id.Ident,
+				strings.Join(modules, " and "),
+			)
+		}
+		if q, ok := names[id.Ident]; ok {
+			return expr.Id(q), nil
+		}
+		return id, nil
+	})
+}
+
+// mapFree replaces the identifiers in e that are neither bound within e
+// nor in bound by the result of f. The names of defuns are free.
+func mapFree(
+	e expr.E,
+	bound map[string]struct{},
+	f func(id expr.E) (expr.E, error),
+) (expr.E, error) {
+	switch e.Typ {
+	case expr.ExprIdent:
+		if _, ok := bound[e.Ident]; ok {
+			return e, nil
+		}
+		return f(e)
+	case expr.ExprList:
+		elems := e.List
+		if len(elems) == 0 {
+			return e, nil
+		}
+		head := elems[0]
+
+		// declarations are not expressions
+		if expr.IsIdent(head, "declare") {
+			return e, nil
+		}
+
+		mapAll := func(es []expr.E, bound map[string]struct{}) ([]expr.E, error) {
+			result := make([]expr.E, 0, len(es))
+			for _, elem := range es {
+				elem, err := mapFree(elem, bound, f)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, elem)
+			}
+			return result, nil
+		}
+
+		if expr.IsIdent(head, "defun") && len(elems) >= 3 {
+			name, err := mapFree(elems[1], bound, f)
+			if err != nil {
+				return expr.Nil(), err
+			}
+			body, err := mapAll(elems[3:], with(bound, expr.Params(elems[2])))
+			if err != nil {
+				return expr.Nil(), err
+			}
+			return expr.L(append([]expr.E{head, name, elems[2]}, body...)...), nil
+		}
+
+		if expr.IsIdent(head, "lambda") && len(elems) >= 3 {
+			body, err := mapAll(elems[2:], with(bound, expr.Params(elems[1])))
+			if err != nil {
+				return expr.Nil(), err
+			}
+			return expr.L(append([]expr.E{head, elems[1]}, body...)...), nil
+		}
+
+		if expr.IsLet(head) && !expr.IsNamedLet(elems) {
+			bindings, body, sequential := expr.SplitLet(elems)
+			inner := bound
+			newBindings := []expr.E{}
+			for _, binding := range bindings {
+				v := binding.List[0]
+				value, err := mapFree(binding.List[1], inner, f)
+				if err != nil {
+					return expr.Nil(), err
+				}
+				newBindings = append(newBindings, expr.L(v, value))
+				if sequential {
+					inner = with(inner, []expr.E{v})
+				}
+			}
+			newBody, err := mapAll(body, with(inner, firsts(bindings)))
+			if err != nil {
+				return expr.Nil(), err
+			}
+			if sequential && expr.IsIdent(head, "let") {
+				return expr.L(append(append([]expr.E{head}, newBindings...), newBody...)...), nil
+			}
+			return expr.L(append([]expr.E{head, expr.L(newBindings...)}, newBody...)...), nil
+		}
+
+		newExpr, err := mapAll(elems, bound)
+		if err != nil {
+			return expr.Nil(), err
+		}
+		return expr.L(newExpr...), nil
+	default:
+		return e, nil
+	}
+}
@@ -2,23 +2,109 @@ package preprocess
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/brenoafb/tinycompiler/pkg/expr"
 )
 
+// Options control the preprocessing of a compilation unit
+type Options struct {
+	// Resolve finds the procedures exported by the modules
+	// imported by the unit, see Module
+	Resolve Resolver
+	// InlineSize is the size of the largest procedure body inlined,
+	// DefaultInlineSize if zero. Negative sizes disable inlining
+	// of procedures, but not of lambda applications.
+	InlineSize int
+}
+
 func Preprocess(es []expr.E, name string) (expr.E, error) {
+	return PreprocessWith(es, name, Options{})
+}
+
+// PreprocessWith preprocesses es into a compilation unit. A unit
+// declaring a module is named after it instead of name, and
+// only exports the procedures listed in its declaration.
+func PreprocessWith(es []expr.E, name string, opts Options) (expr.E, error) {
+	module, isModule, err := ParseModule(es)
+	if err != nil {
+		return expr.Nil(), fmt.Errorf("preprocess: %w", err)
+	}
+	if isModule {
+		name = module.Name
+		es = es[1:]
+	}
+
+	if err := CheckLets(es); err != nil {
+		return expr.Nil(), fmt.Errorf("preprocess: %w", err)
+	}
+
+	es, err = defineProcedures(es)
+	if err != nil {
+		return expr.Nil(), fmt.Errorf("preprocess: %w", err)
+	}
+
 	for i, e := range es {
-		e, err := annotateFreeVariables(e)
+		e, err := expandBodies(e)
 		if err != nil {
-			return expr.Nil(), fmt.Errorf("preprocess: error annotating lambdas at index %d: %w", i, err)
+			return expr.Nil(), fmt.Errorf("preprocess: error expanding bodies at index %d: %w", i, err)
 		}
 		es[i] = e
 	}
 
+	var imported map[string]struct{}
+	if isModule {
+		es, imported, err = qualifyModule(es, module, opts.Resolve)
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("preprocess: %w", err)
+		}
+	}
+
+	es, globals, err := gatherGlobals(es, imported)
+	if err != nil {
+		return expr.Nil(), fmt.Errorf("preprocess: error gathering globals: %w", err)
+	}
+
+	size := opts.InlineSize
+	if size == 0 {
+		size = DefaultInlineSize
+	}
+	es, err = inline(es, size)
+	if err != nil {
+		return expr.Nil(), fmt.Errorf("preprocess: error inlining: %w", err)
+	}
+
+	for i, e := range es {
+		es[i] = simplify(e)
+	}
+
 	counter := 0
+	es, lifted := lift(es, &counter)
+
+	for i, e := range es {
+		e, err := annotateFreeVariables(e, nil)
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("preprocess: error annotating lambdas at index %d: %w", i, err)
+		}
+		es[i] = e
+	}
+
 	lambdas := make(map[string]expr.E)
 
-	var err error
+	// lifted lambdas capture no variables, and are compiled as local labels
+	for _, k := range sortedKeys(lifted) {
+		e, err := annotateFreeVariables(lifted[k], nil)
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("preprocess: error annotating lambdas in %s: %w", k, err)
+		}
+		e, err = gatherLambdas(e, &counter, lambdas)
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("preprocess: error gathering lambdas: %w", err)
+		}
+		code := []expr.E{expr.Id("code"), e.List[2], expr.L()}
+		lambdas[k] = expr.L(append(code, e.List[3:]...)...)
+	}
+
 	for i, e := range es {
 		e, err = gatherLambdas(e, &counter, lambdas)
 
@@ -41,35 +127,78 @@ func Preprocess(es []expr.E, name string) (expr.E, error) {
 		es[i] = e
 	}
 
+	// lambda bodies have already been lifted out of the expressions
+	for _, k := range sortedKeys(lambdas) {
+		lambdas[k], err = gatherStrings(lambdas[k], &counter, strings)
+
+		if err != nil {
+			return expr.Nil(), fmt.Errorf("preprocess: error gathering strings in lambda %s: %w", k, err)
+		}
+	}
+
 	defuns := make(map[string]expr.E)
 	es, err = gatherDefuns(es, defuns)
+	if err != nil {
+		return expr.Nil(), fmt.Errorf("preprocess: error gathering defuns: %w", err)
+	}
 
 	constants := []expr.E{}
 
-	for k, v := range strings {
+	for _, k := range sortedKeys(strings) {
 		l := expr.L(
 			expr.Id(k),
-			v,
+			strings[k],
 		)
 		constants = append(constants, l)
 	}
 
 	labels := []expr.E{}
 
-	for k, v := range lambdas {
+	for _, k := range sortedKeys(lambdas) {
 		labels = append(labels, expr.L(
 			expr.Id(k),
-			v,
+			lambdas[k],
 		))
 	}
 
+	exported := func(string) bool { return true }
+	if isModule {
+		names := make(map[string]struct{}, len(module.Exports))
+		for _, k := range module.Exports {
+			names[Qualify(module.Name, k)] = struct{}{}
+		}
+		exported = func(k string) bool {
+			_, ok := names[k]
+			return ok
+		}
+	}
+
 	exports := []expr.E{}
 
-	for k, v := range defuns {
-		exports = append(exports, expr.L(
+	// procedures private to a module are compiled as local labels
+	for _, k := range sortedKeys(defuns) {
+		l := expr.L(
 			expr.Id(k),
-			v,
-		))
+			defuns[k],
+		)
+		if exported(k) {
+			exports = append(exports, l)
+		} else {
+			labels = append(labels, l)
+		}
+	}
+
+	// and its private global variables as local data
+	for _, k := range globals {
+		l := expr.L(
+			expr.Id(k),
+			expr.L(expr.Id("global")),
+		)
+		if exported(k) {
+			exports = append(exports, l)
+		} else {
+			constants = append(constants, l)
+		}
 	}
 
 	result := expr.L(
@@ -86,8 +215,12 @@ func Preprocess(es []expr.E, name string) (expr.E, error) {
 	return result, nil
 }
 
+// annotateFreeVariables adds to every lambda in e the list of its
+// free variables. Only variables bound by enclosing forms, or in scope,
+// are captured: other identifiers refer to procedures and global variables.
 func annotateFreeVariables(
 	e expr.E,
+	scope map[string]struct{},
 ) (expr.E, error) {
 	switch e.Typ {
 	case expr.ExprList:
@@ -98,34 +231,35 @@ func annotateFreeVariables(
 
 		head := elems[0]
 
+		annotateAll := func(es []expr.E, scope map[string]struct{}) ([]expr.E, error) {
+			result := make([]expr.E, 0, len(es))
+			for _, elem := range es {
+				elem, err := annotateFreeVariables(elem, scope)
+				if err != nil {
+					return nil, fmt.Errorf("error annotating free variables in sub expression: %w", err)
+				}
+				result = append(result, elem)
+			}
+			return result, nil
+		}
+
 		if expr.IsIdent(head, "lambda") {
-			if len(elems) != 3 {
-				return expr.Nil(), fmt.Errorf("lambda form must contain 3 elements")
+			if len(elems) < 3 {
+				return expr.Nil(), fmt.Errorf("lambda form must contain at least 3 elements")
 			}
 
 			args := elems[1]
-			if (args.Typ != expr.ExprList) && (args.Typ != expr.ExprNil) {
+			if _, _, err := expr.SplitParams(args); err != nil {
 				return expr.Nil(), fmt.Errorf(
-					"malformed lambda expression: args is not list %+v",
-					args,
+					"malformed lambda expression: %w",
+					err,
 				)
 			}
 
-			body := elems[2]
-
 			freeVars := make(map[string]struct{})
-			argMap := make(map[string]struct{})
-			for i, arg := range args.List {
-				if arg.Typ != expr.ExprIdent {
-					return expr.Nil(), fmt.Errorf(
-						"malformed lambda expression: arg at index %d is not identifier",
-						i,
-					)
-				}
-				argMap[arg.Ident] = struct{}{}
-			}
+			argMap := with(nil, expr.Params(args))
 
-			err := gatherFreeVariables(body, argMap, freeVars)
+			err := gatherFreeVariables(expr.L(elems[2:]...), argMap, freeVars)
 
 			if err != nil {
 				return expr.Nil(), fmt.Errorf("error annotating lambda expression: %w", err)
@@ -133,12 +267,13 @@ func annotateFreeVariables(
 
 			freeVarList := make([]expr.E, 0, len(freeVars))
 
-			for k := range freeVars {
-				freeVarList = append(freeVarList, expr.Id(k))
+			for _, k := range sortedKeys(freeVars) {
+				if _, ok := scope[k]; ok {
+					freeVarList = append(freeVarList, expr.Id(k))
+				}
 			}
 
-			body, err = annotateFreeVariables(body)
-
+			body, err := annotateAll(elems[2:], with(scope, expr.Params(args)))
 			if err != nil {
 				return expr.Nil(), fmt.Errorf(
 					"error lifting free variables from lambda body: %w",
@@ -146,24 +281,51 @@ func annotateFreeVariables(
 				)
 			}
 
-			newExpr := expr.L(
+			newExpr := []expr.E{
 				expr.Id("lambda"),
 				args,
 				expr.L(freeVarList...),
-				body,
-			)
+			}
 
-			return newExpr, nil
+			return expr.L(append(newExpr, body...)...), nil
 		}
 
-		newExpr := make([]expr.E, 0, len(elems))
+		if expr.IsIdent(head, "defun") && len(elems) >= 3 {
+			body, err := annotateAll(elems[3:], with(scope, expr.Params(elems[2])))
+			if err != nil {
+				return expr.Nil(), err
+			}
+			return expr.L(append([]expr.E{head, elems[1], elems[2]}, body...)...), nil
+		}
 
-		for _, elem := range elems {
-			elem, err := annotateFreeVariables(elem)
+		if expr.IsLet(head) && !expr.IsNamedLet(elems) {
+			bindings, body, sequential := expr.SplitLet(elems)
+			inner := scope
+			newBindings := []expr.E{}
+			for _, binding := range bindings {
+				v := binding.List[0]
+				value, err := annotateFreeVariables(binding.List[1], inner)
+				if err != nil {
+					return expr.Nil(), err
+				}
+				newBindings = append(newBindings, expr.L(v, value))
+				if sequential {
+					inner = with(inner, []expr.E{v})
+				}
+			}
+			newBody, err := annotateAll(body, with(inner, firsts(bindings)))
 			if err != nil {
-				return expr.Nil(), fmt.Errorf("error annotating free variables in sub expression: %w", err)
+				return expr.Nil(), err
 			}
-			newExpr = append(newExpr, elem)
+			if sequential && expr.IsIdent(head, "let") {
+				return expr.L(append(append([]expr.E{head}, newBindings...), newBody...)...), nil
+			}
+			return expr.L(append([]expr.E{head, expr.L(newBindings...)}, newBody...)...), nil
+		}
+
+		newExpr, err := annotateAll(elems, scope)
+		if err != nil {
+			return expr.Nil(), err
 		}
 
 		return expr.L(newExpr...), nil
@@ -197,6 +359,52 @@ func gatherFreeVariables(
 			return nil
 		}
 
+		head := elems[0]
+
+		// global variables are not captured
+		if expr.IsIdent(head, "global-ref") {
+			return nil
+		}
+		if expr.IsIdent(head, "global-set!") && len(elems) == 3 {
+			return gatherFreeVariables(elems[2], args, freeVars)
+		}
+
+		if expr.IsIdent(head, "lambda") && len(elems) >= 3 {
+			// variables bound by a nested lambda are not free
+			inner := with(args, expr.Params(elems[1]))
+			for _, elem := range elems[2:] {
+				err := gatherFreeVariables(elem, inner, freeVars)
+				if err != nil {
+					return fmt.Errorf("error gathering free vars from lambda body: %w", err)
+				}
+			}
+			return nil
+		}
+
+		if expr.IsLet(head) {
+			bindings, body, sequential := expr.SplitLet(elems)
+			inner := args
+			for _, binding := range bindings {
+				err := gatherFreeVariables(binding.List[1], inner, freeVars)
+				if err != nil {
+					return fmt.Errorf("error gathering free vars from let binding: %w", err)
+				}
+				if sequential {
+					inner = with(inner, binding.List[:1])
+				}
+			}
+			for _, binding := range bindings {
+				inner = with(inner, binding.List[:1])
+			}
+			for _, elem := range body {
+				err := gatherFreeVariables(elem, inner, freeVars)
+				if err != nil {
+					return fmt.Errorf("error gathering free vars from let body: %w", err)
+				}
+			}
+			return nil
+		}
+
 		for _, elem := range elems {
 			err := gatherFreeVariables(elem, args, freeVars)
 			if err != nil {
@@ -221,16 +429,18 @@ func gatherLambdas(
 		if expr.IsIdent(elems[0], "lambda") {
 			args := elems[1]
 			freeVars := elems[2]
-			body := elems[3]
 
 			if freeVars.Typ != expr.ExprList && freeVars.Typ != expr.ExprNil {
 				return expr.Nil(), fmt.Errorf("malformed lambda form")
 			}
 
-			var err error
-			body, err = gatherLambdas(body, counter, lambdas)
-			if err != nil {
-				return expr.Nil(), fmt.Errorf("error gathering lambdas recursively: %w", err)
+			body := make([]expr.E, 0, len(elems)-3)
+			for _, elem := range elems[3:] {
+				elem, err := gatherLambdas(elem, counter, lambdas)
+				if err != nil {
+					return expr.Nil(), fmt.Errorf("error gathering lambdas recursively: %w", err)
+				}
+				body = append(body, elem)
 			}
 
 			k := *counter
@@ -246,14 +456,13 @@ func gatherLambdas(
 				newExpr = append(newExpr, freeVar)
 			}
 
-			code := expr.L(
+			code := []expr.E{
 				expr.Id("code"),
 				args,
 				freeVars,
-				body,
-			)
+			}
 
-			lambdas[label] = code
+			lambdas[label] = expr.L(append(code, body...)...)
 			return expr.L(newExpr...), nil
 		}
 
@@ -326,24 +535,23 @@ func gatherDefuns(
 			if expr.IsIdent(elems[0], "defun") {
 				name := elems[1]
 				args := elems[2]
-				body := elems[3]
+				body := elems[3:]
 
 				if name.Typ != expr.ExprIdent {
 					return nil, fmt.Errorf("malformed defun form")
 				}
 
-				if args.Typ != expr.ExprList && args.Typ != expr.ExprNil {
-					return nil, fmt.Errorf("malformed defun form")
+				if _, _, err := expr.SplitParams(args); err != nil {
+					return nil, fmt.Errorf("malformed defun form: %w", err)
 				}
 
-				code := expr.L(
+				code := []expr.E{
 					expr.Id("code"),
 					args,
 					expr.L(),
-					body,
-				)
+				}
 
-				defuns[name.Ident] = code
+				defuns[name.Ident] = expr.L(append(code, body...)...)
 
 				es[i] = expr.Nil()
 				continue
@@ -356,3 +564,14 @@ func gatherDefuns(
 	}
 	return es, nil
 }
+
+// sortedKeys returns the keys of m in order,
+// so that the preprocessor output is deterministic
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -66,7 +66,9 @@ func TestGatherFreeVariables(t *testing.T) {
 
 func TestAnnotateFreeVariables(t *testing.T) {
 	tests := []struct {
-		code     string
+		code string
+		// variables bound by enclosing forms
+		bound    []string
 		expected expr.E
 	}{
 		{
@@ -86,7 +88,8 @@ func TestAnnotateFreeVariables(t *testing.T) {
 			expected: expr.L(expr.Id("+"), expr.N(1), expr.N(2)),
 		},
 		{
-			code: "(lambda (x) (f x 1))",
+			code:  "(lambda (x) (f x 1))",
+			bound: []string{"f"},
 			expected: expr.L(
 				expr.Id("lambda"),
 				expr.L(expr.Id("x")),
@@ -104,7 +107,59 @@ func TestAnnotateFreeVariables(t *testing.T) {
 			),
 		},
 		{
-			code: "(lambda (y) (lambda () (+ x y)))",
+			code:  "(lambda (x) (let (y 1) (+ x y z)))",
+			bound: []string{"z"},
+			expected: expr.L(
+				expr.Id("lambda"),
+				expr.L(expr.Id("x")),
+				expr.L(expr.Id("z")),
+				expr.L(
+					expr.Id("let"),
+					expr.L(expr.Id("y"), expr.N(1)),
+					expr.L(expr.Id("+"), expr.Id("x"), expr.Id("y"), expr.Id("z")),
+				),
+			),
+		},
+		{
+			code:  "(lambda (x . rest) (f x rest))",
+			bound: []string{"f"},
+			expected: expr.L(
+				expr.Id("lambda"),
+				expr.L(expr.Id("x"), expr.Id("."), expr.Id("rest")),
+				expr.L(expr.Id("f")),
+				expr.L(expr.Id("f"), expr.Id("x"), expr.Id("rest")),
+			),
+		},
+		{
+			code:  "(lambda args (f args))",
+			bound: []string{"f"},
+			expected: expr.L(
+				expr.Id("lambda"),
+				expr.Id("args"),
+				expr.L(expr.Id("f")),
+				expr.L(expr.Id("f"), expr.Id("args")),
+			),
+		},
+		{
+			code:  "(lambda () (let ((x 1) (y x)) y))",
+			bound: []string{"x"},
+			expected: expr.L(
+				expr.Id("lambda"),
+				expr.L(),
+				expr.L(expr.Id("x")),
+				expr.L(
+					expr.Id("let"),
+					expr.L(
+						expr.L(expr.Id("x"), expr.N(1)),
+						expr.L(expr.Id("y"), expr.Id("x")),
+					),
+					expr.Id("y"),
+				),
+			),
+		},
+		{
+			code:  "(lambda (y) (lambda () (+ x y)))",
+			bound: []string{"x"},
 			expected: expr.L(
 				expr.Id("lambda"),
 				expr.L(expr.Id("y")),
@@ -117,6 +172,43 @@ func TestAnnotateFreeVariables(t *testing.T) {
 				),
 			),
 		},
+		{
+			// procedures and global variables are not captured
+			code: "(lambda (x) (f x 1))",
+			expected: expr.L(
+				expr.Id("lambda"),
+				expr.L(expr.Id("x")),
+				expr.L(),
+				expr.L(expr.Id("f"), expr.Id("x"), expr.N(1)),
+			),
+		},
+		{
+			code: "(let ((f 1)) (lambda () (g f)))",
+			expected: expr.L(
+				expr.Id("let"),
+				expr.L(expr.L(expr.Id("f"), expr.N(1))),
+				expr.L(
+					expr.Id("lambda"),
+					expr.L(),
+					expr.L(expr.Id("f")),
+					expr.L(expr.Id("g"), expr.Id("f")),
+				),
+			),
+		},
+		{
+			code: "(defun f (x) (lambda () (g x)))",
+			expected: expr.L(
+				expr.Id("defun"),
+				expr.Id("f"),
+				expr.L(expr.Id("x")),
+				expr.L(
+					expr.Id("lambda"),
+					expr.L(),
+					expr.L(expr.Id("x")),
+					expr.L(expr.Id("g"), expr.Id("x")),
+				),
+			),
+		},
 	}
 
 	for _, tt := range tests {
@@ -128,7 +220,12 @@ func TestAnnotateFreeVariables(t *testing.T) {
 			require.Len(t, exprs, 1)
 			expr := exprs[0]
 
-			result, err := annotateFreeVariables(expr)
+			bound := make(map[string]struct{})
+			for _, v := range tt.bound {
+				bound[v] = struct{}{}
+			}
+
+			result, err := annotateFreeVariables(expr, bound)
 			require.NoError(t, err)
 
 			fmt.Printf("%v\n", result)
@@ -295,13 +392,14 @@ func TestPreprocess(t *testing.T) {
 			),
 		},
 		{
+			// constants are folded
 			code: "(+ 1 2)",
 			expected: expr.L(
 				expr.Id("test"),
 				expr.L(),
 				expr.L(),
 				expr.L(),
-				expr.L(expr.Id("+"), expr.N(1), expr.N(2)),
+				expr.N(3),
 			),
 		},
 		{
@@ -325,29 +423,62 @@ func TestPreprocess(t *testing.T) {
 			),
 		},
 		{
+			// applied lambdas are inlined
 			code: "((lambda (x) (+ x 1)) 1)",
 			expected: expr.L(
 				expr.Id("test"),
 				expr.L(),
 				expr.L(),
+				expr.L(),
+				expr.L(
+					expr.Id("let"),
+					expr.L(expr.L(expr.Id("x"), expr.N(1))),
+					expr.L(expr.Id("+"), expr.Id("x"), expr.N(1)),
+				),
+			),
+		},
+		{
+			// lambdas which are only called are lifted out without closures
+			code: "(defun count (n) (let loop ((i n)) (if (zero? i) n (loop (- i 1)))))",
+			expected: expr.L(
+				expr.Id("test"),
 				expr.L(
 					expr.L(
-						expr.Id("f0"),
+						expr.Id("count"),
 						expr.L(
 							expr.Id("code"),
-							expr.L(expr.Id("x")), // args
-							expr.L(),             // free vars
-							expr.L(expr.Id("+"), expr.Id("x"), expr.N(1)), // body
+							expr.L(expr.Id("n")),
+							expr.L(),
+							expr.L(expr.Id("f0"), expr.Id("n"), expr.Id("n")),
 						),
 					),
 				),
+				expr.L(),
 				expr.L(
-					expr.L(expr.Id("closure"), expr.Id("f0")),
-					expr.N(1),
+					expr.L(
+						expr.Id("f0"),
+						expr.L(
+							expr.Id("code"),
+							expr.L(expr.Id("i"), expr.Id("n")),
+							expr.L(),
+							expr.L(
+								expr.Id("if"),
+								expr.L(expr.Id("zero?"), expr.Id("i")),
+								expr.Id("n"),
+								expr.L(
+									expr.Id("f0"),
+									expr.L(expr.Id("-"), expr.Id("i"), expr.N(1)),
+									expr.Id("n"),
+								),
+							),
+						),
+					),
 				),
+				expr.Nil(),
 			),
 		},
 		{
+			// x is not bound, so it names a global and is not captured
 			code: "(lambda (y) (lambda () (+ x y)))",
 			expected: expr.L(
 				expr.Id("test"),
@@ -358,8 +489,8 @@ func TestPreprocess(t *testing.T) {
 						expr.Id("f0"),
 						expr.L(
 							expr.Id("code"),
-							expr.L(),                           // args
-							expr.L(expr.Id("x"), expr.Id("y")), // free vars
+							expr.L(),             // args
+							expr.L(expr.Id("y")), // free vars
 							expr.L(expr.Id("+"), expr.Id("x"), expr.Id("y")), // body
 						),
 					),
@@ -368,12 +499,37 @@ func TestPreprocess(t *testing.T) {
 						expr.L(
 							expr.Id("code"),
 							expr.L(expr.Id("y")), // args
-							expr.L(expr.Id("x")), // free vars
-							expr.L(expr.Id("closure"), expr.Id("f0"), expr.Id("x"), expr.Id("y")), // body
+							expr.L(),             // free vars
+							expr.L(expr.Id("closure"), expr.Id("f0"), expr.Id("y")), // body
+						),
+					),
+				),
+				expr.L(expr.Id("closure"), expr.Id("f1")),
+			),
+		},
+		{
+			code: `(lambda () "hi")`,
+			expected: expr.L(
+				expr.Id("test"),
+				expr.L(),
+				expr.L(
+					expr.L(
+						expr.Id("s0"),
+						expr.L(expr.Id("string-init"), expr.S("hi")),
+					),
+				),
+				expr.L(
+					expr.L(
+						expr.Id("f0"),
+						expr.L(
+							expr.Id("code"),
+							expr.L(), // args
+							expr.L(), // free vars
+							expr.L(expr.Id("string-ref"), expr.Id("s0")), // body
 						),
 					),
 				),
-				expr.L(expr.Id("closure"), expr.Id("f1"), expr.Id("x")),
+				expr.L(expr.Id("closure"), expr.Id("f0")),
 			),
 		},
 		{
@@ -414,3 +570,754 @@ func TestPreprocess(t *testing.T) {
 		})
 	}
 }
+
+func TestExpandBodies(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected expr.E
+	}{
+		{
+			code:     "(+ 1 2)",
+			expected: expr.L(expr.Id("+"), expr.N(1), expr.N(2)),
+		},
+		{
+			code: "(lambda (x) (f x) x)",
+			expected: expr.L(
+				expr.Id("lambda"),
+				expr.L(expr.Id("x")),
+				expr.L(expr.Id("f"), expr.Id("x")),
+				expr.Id("x"),
+			),
+		},
+		{
+			code: "(let (x 1) (+ x 1) x)",
+			expected: expr.L(
+				expr.Id("let"),
+				expr.L(expr.Id("x"), expr.N(1)),
+				expr.L(
+					expr.Id("progn"),
+					expr.L(expr.Id("+"), expr.Id("x"), expr.N(1)),
+					expr.Id("x"),
+				),
+			),
+		},
+		{
+			code: "(lambda () (define x 1) x)",
+			expected: expr.L(
+				expr.Id("lambda"),
+				expr.Nil(),
+				expr.L(
+					expr.Id("let"),
+					expr.L(expr.L(expr.Id("x"), expr.L(expr.Id("box"), expr.Nil()))),
+					expr.L(expr.Id("set-box!"), expr.Id("x"), expr.N(1)),
+					expr.L(expr.Id("unbox"), expr.Id("x")),
+				),
+			),
+		},
+		{
+			code: "(defun f (n) (define (g x) (g x)) (g n))",
+			expected: expr.L(
+				expr.Id("defun"),
+				expr.Id("f"),
+				expr.L(expr.Id("n")),
+				expr.L(
+					expr.Id("let"),
+					expr.L(expr.L(expr.Id("g"), expr.L(expr.Id("box"), expr.Nil()))),
+					expr.L(
+						expr.Id("set-box!"),
+						expr.Id("g"),
+						expr.L(
+							expr.Id("lambda"),
+							expr.L(expr.Id("x")),
+							expr.L(
+								expr.L(expr.Id("unbox"), expr.Id("g")),
+								expr.Id("x"),
+							),
+						),
+					),
+					expr.L(
+						expr.L(expr.Id("unbox"), expr.Id("g")),
+						expr.Id("n"),
+					),
+				),
+			),
+		},
+		{
+			code: "(letrec* ((x 1)) (lambda (x) x))",
+			expected: expr.L(
+				expr.Id("let"),
+				expr.L(expr.L(expr.Id("x"), expr.L(expr.Id("box"), expr.Nil()))),
+				expr.L(expr.Id("set-box!"), expr.Id("x"), expr.N(1)),
+				expr.L(
+					expr.Id("lambda"),
+					expr.L(expr.Id("x")),
+					expr.Id("x"),
+				),
+			),
+		},
+		{
+			code: "(let ((x 1) (y x)) (f x) y)",
+			expected: expr.L(
+				expr.Id("let"),
+				expr.L(
+					expr.L(expr.Id("x"), expr.N(1)),
+					expr.L(expr.Id("y"), expr.Id("x")),
+				),
+				expr.L(expr.Id("f"), expr.Id("x")),
+				expr.Id("y"),
+			),
+		},
+		{
+			code: "(let loop ((i 0)) (loop i))",
+			expected: expr.L(
+				expr.L(
+					expr.Id("let"),
+					expr.L(expr.L(expr.Id("loop"), expr.L(expr.Id("box"), expr.Nil()))),
+					expr.L(
+						expr.Id("set-box!"),
+						expr.Id("loop"),
+						expr.L(
+							expr.Id("lambda"),
+							expr.L(expr.Id("i")),
+							expr.L(
+								expr.L(expr.Id("unbox"), expr.Id("loop")),
+								expr.Id("i"),
+							),
+						),
+					),
+					expr.L(expr.Id("unbox"), expr.Id("loop")),
+				),
+				expr.N(0),
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+			require.Len(t, exprs, 1)
+
+			result, err := expandBodies(exprs[0])
+			require.NoError(t, err)
+
+			require.Equal(t, tt.expected, result)
+		})
+	}
+}
+
+func TestExpandBodiesErrors(t *testing.T) {
+	tests := []string{
+		"(lambda (x) x (define y 1) y)",
+		"(lambda (x) (define y 1))",
+		"(let (x 1) (define y 1))",
+	}
+
+	for _, code := range tests {
+		t.Run(code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+			require.Len(t, exprs, 1)
+
+			_, err = expandBodies(exprs[0])
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestMigrateLet(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{
+			code:     "(let (x 1) x)",
+			expected: "(let ((x 1)) x)",
+		},
+		{
+			code:     "(let (x 1) (y 2) (+ x y))",
+			expected: "(let ((x 1) (y 2)) (+ x y))",
+		},
+		{
+			code:     "(let (x 1) (y (+ x 1)) (progn (f x) y))",
+			expected: "(let* ((x 1) (y (+ x 1))) (f x) y)",
+		},
+		{
+			code:     "(let (f (lambda (x) (let (y 2) (+ x y)))) (f 1))",
+			expected: "(let ((f (lambda (x) (let ((y 2)) (+ x y))))) (f 1))",
+		},
+		{
+			code:     "(let ((x 1)) x)",
+			expected: "(let ((x 1)) x)",
+		},
+		{
+			code:     "(let loop ((i 0)) (loop i))",
+			expected: "(let loop ((i 0)) (loop i))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			es, err := parser.Parse(tokens)
+			require.NoError(t, err)
+			require.Len(t, es, 1)
+
+			tokens, err = parser.Tokenize(tt.expected)
+			require.NoError(t, err)
+			expected, err := parser.Parse(tokens)
+			require.NoError(t, err)
+			require.Len(t, expected, 1)
+
+			require.Equal(t, expected[0], MigrateLet(es[0]))
+		})
+	}
+}
+
+func TestMigrateLetSource(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{
+			code:     "(defun f (n)\n  (let (x 1)\n       (y 2)\n    (+ x y)))\n\n(f   1)\n",
+			expected: "(defun f (n)\n  (let ((x 1)\n       (y 2))\n    (+ x y)))\n\n(f   1)\n",
+		},
+		{
+			code:     "(let (x 1) (y (+ x 1))\n  (progn (f x)\n         y))",
+			expected: "(let* ((x 1) (y (+ x 1)))\n  (f x)\n         y)",
+		},
+		{
+			code:     "(let (f (lambda (x) (let (y \"é\") (+ x y))))(progn (f 1)))",
+			expected: "(let ((f (lambda (x) (let ((y \"é\")) (+ x y)))))(f 1))",
+		},
+		{
+			code:     "(let x)",
+			expected: "(let () x)",
+		},
+		{
+			code:     "(let ((x 1))\n  x)  (let loop ((i 0)) (loop i))",
+			expected: "(let ((x 1))\n  x)  (let loop ((i 0)) (loop i))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			result, err := MigrateLetSource(tt.code)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, result)
+
+			// the result reads as the one of MigrateLet
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			es, err := parser.Parse(tokens)
+			require.NoError(t, err)
+			tokens, err = parser.Tokenize(result)
+			require.NoError(t, err)
+			migrated, err := parser.Parse(tokens)
+			require.NoError(t, err)
+			for i, e := range es {
+				require.Equal(t, MigrateLet(e), migrated[i])
+			}
+		})
+	}
+}
+
+func TestCheckLets(t *testing.T) {
+	tests := []struct {
+		code string
+		err  string
+	}{
+		{code: "(let (x 1) (y 2) (+ x y))"},
+		{code: "(let (x 1) (progn (display x) (newline)))"},
+		{code: "(let ((x 1)) (display x) (newline))"},
+		{code: "(let* ((x 1)) (display x) (newline))"},
+		{
+			code: "(let (x 1) (display x) (newline))",
+			err:  "let binds 'display', which names a procedure",
+		},
+		{
+			code: "(defun show (x) x) (let (x 1) (show x) x)",
+			err:  "let binds 'show', which names a procedure",
+		},
+		{
+			code: "(define (show x) x) (lambda () (let* (x 1) (show x) x))",
+			err:  "let binds 'show', which names a procedure",
+		},
+		{
+			code: "(let (x 1) (display x 1) (newline))",
+			err:  "let has 2 expressions after its bindings",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			es, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			err = CheckLets(es)
+			if tt.err == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.err)
+
+			_, err = Preprocess(es, "test")
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestModules(t *testing.T) {
+	resolve := func(name string) (Module, error) {
+		switch name {
+		case "util":
+			return Module{Name: name, Exports: []string{"inc", "dec"}}, nil
+		case "math":
+			return Module{Name: name, Exports: []string{"inc", "square"}}, nil
+		}
+		return Module{}, fmt.Errorf("module %s not found", name)
+	}
+
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{
+			code:     "(module lib (export next)) (defun step () 1) (defun next (x) (+ x (step)))",
+			expected: "(lib ((lib:next (code (x) () (+ x (lib:step))))) () ((lib:step (code () () 1))) () ())",
+		},
+		{
+			code:     "(module main (import util)) (inc (dec 1))",
+			expected: "(main () () () (util:inc (util:dec 1)))",
+		},
+		{
+			code:     "(module main (import util math)) (square (util:inc 1))",
+			expected: "(main () () () (math:square (util:inc 1)))",
+		},
+		{
+			// definitions hide imported procedures, and variables hide both
+			code:     "(module main (import util)) (defun inc (x) x) (let ((dec inc)) (inc (dec 1)))",
+			expected: "(main () () ((main:inc (code (x) () x))) () (let ((dec main:inc)) (main:inc (dec 1))))",
+		},
+		{
+			code:     "(defun inc (x) x) (inc 1)",
+			expected: "(test ((inc (code (x) () x))) () () () (inc 1))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			result, err := PreprocessWith(exprs, "test", Options{Resolve: resolve, InlineSize: -1})
+			require.NoError(t, err)
+
+			tokens, err = parser.Tokenize(tt.expected)
+			require.NoError(t, err)
+			expected, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			require.Equal(t, expected[0].String(), result.String())
+		})
+	}
+}
+
+func TestModuleErrors(t *testing.T) {
+	resolve := func(name string) (Module, error) {
+		switch name {
+		case "util", "math":
+			return Module{Name: name, Exports: []string{"inc"}}, nil
+		}
+		return Module{}, fmt.Errorf("module %s not found", name)
+	}
+
+	tests := []struct {
+		code string
+		err  string
+	}{
+		{code: "(module)", err: "missing name"},
+		{code: "(module a (export f) (export g))", err: "more than one export clause"},
+		{code: "(module a (require b))", err: "unknown clause 'require'"},
+		{code: "(module a (export f))", err: "module a exports undefined name 'f'"},
+		{code: "(module a (import a))", err: "module a imports itself"},
+		{code: "(module a (import b))", err: "module b not found"},
+		{code: "(module a (import util math)) (inc 1)", err: "reference to 'inc' is ambiguous, it is exported by math and util"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			_, err = PreprocessWith(exprs, "test", Options{Resolve: resolve, InlineSize: -1})
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestGlobals(t *testing.T) {
+	resolve := func(name string) (Module, error) {
+		return Module{Name: name, Exports: []string{"count", "tick"}, Globals: []string{"count", "hidden"}}, nil
+	}
+
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{
+			code:     "(define x 1) (set! x (+ x 1)) x",
+			expected: "(test ((x (global))) () () (global-set! x 1) (global-set! x (+ (global-ref x) 1)) (global-ref x))",
+		},
+		{
+			// globals are not captured, but variables hide them
+			code:     "(define x 1) (lambda (y) (+ x y)) (lambda (x) x)",
+			expected: "(test ((x (global))) () ((f0 (code (y) () (+ (global-ref x) y))) (f1 (code (x) () x))) (global-set! x 1) (closure f0) (closure f1))",
+		},
+		{
+			code:     "(define (inc x) (+ x 1)) (define one (inc 0))",
+			expected: "(test ((inc (code (x) () (+ x 1))) (one (global))) () () () (global-set! one (inc 0)))",
+		},
+		{
+			code:     "(module lib (export x)) (define x 1) (define y x)",
+			expected: "(lib ((lib:x (global))) ((lib:y (global))) () (global-set! lib:x 1) (global-set! lib:y (global-ref lib:x)))",
+		},
+		{
+			// only exported globals of imported modules are visible
+			code:     "(module main (import counter)) (tick) (set! count hidden)",
+			expected: "(main () () () (counter:tick) (global-set! counter:count hidden))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			result, err := PreprocessWith(exprs, "test", Options{Resolve: resolve, InlineSize: -1})
+			require.NoError(t, err)
+
+			tokens, err = parser.Tokenize(tt.expected)
+			require.NoError(t, err)
+			expected, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			require.Equal(t, expected[0].String(), result.String())
+		})
+	}
+}
+
+func TestGlobalsErrors(t *testing.T) {
+	tests := []struct {
+		code string
+		err  string
+	}{
+		{code: "(define x 1) (define x 2)", err: "global variable 'x' is defined more than once"},
+		{code: "(define x 1) (defun x () 1)", err: "'x' is defined both as a procedure and as a global variable"},
+		{code: "(let ((x 1)) (set! x 2))", err: "cannot assign 'x', which is not a global variable"},
+		{code: "(define x 1) (lambda (x) (set! x 2))", err: "cannot assign 'x', which is not a global variable"},
+		{code: "(define x)", err: "define form must contain at least 3 elements"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			_, err = Preprocess(exprs, "test")
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestDefunErrors(t *testing.T) {
+	tests := []struct {
+		code string
+		err  string
+	}{
+		{code: "(defun f 5 1)", err: "malformed defun form: parameter list is not list"},
+		{code: "(defun f (x 1) x)", err: "malformed defun form: parameter at index 1 is not identifier"},
+		{code: "(defun f (x . y z) x)", err: "malformed defun form: malformed rest parameter"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			_, err = Preprocess(exprs, "test")
+			require.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected string
+	}{
+		{code: "(+ 1 (- 5 2))", expected: "4"},
+		{code: "(add1 41)", expected: "42"},
+		// fixnums wrap around like the generated code
+		{code: "(+ 536870911 1)", expected: "-536870912"},
+		{code: "(- (- 0 536870912) 1)", expected: "536870911"},
+		// constants are gathered in sums, which still check x
+		{code: "(+ (+ x 1) 2)", expected: "(+ x 3)"},
+		{code: "(- (+ 1 x) 3)", expected: "(+ -2 x)"},
+		{code: "(add1 (- x 1))", expected: "(- x 0)"},
+		{code: "(+ 1 (car x))", expected: "(+ 1 (car x))"},
+		{code: "(zero? (- 2 2))", expected: "#t"},
+		{code: "(zero? ())", expected: "#f"},
+		{code: "(null? ())", expected: "#t"},
+		{code: "(eq? 1 (add1 0))", expected: "#t"},
+		{code: "(eq? () #f)", expected: "#f"},
+		{code: "(eof-object? 1)", expected: "#f"},
+		{code: "(car 1 2)", expected: "(car 1 2)"},
+		{code: "(zero? 1 2)", expected: "(zero? 1 2)"},
+		{code: "(if (zero? 0) a b)", expected: "a"},
+		{code: "(if (null? 1) a (+ 1 1))", expected: "2"},
+		{code: "(if () a b)", expected: "a"},
+		{code: "(if x (+ 1 1) b)", expected: "(if x 2 b)"},
+		{code: "(let ((x 1) (y 2)) (+ x 1))", expected: "(let ((x 1)) (+ x 1))"},
+		{code: "(let ((x (display 1)) (y (cons 1 2))) 3)", expected: "(let ((x (display 1))) 3)"},
+		{code: "(let ((f (lambda (x) x))) (if #f (f 1) 2))", expected: "2"},
+		{code: "(let* ((x 1) (y x)) (display 1) 2)", expected: "(progn (display 1) 2)"},
+		{code: "(let* ((x 1) (y x)) y)", expected: "(let* ((x 1) (y x)) y)"},
+		{code: "(let (x 1) (y 2) x)", expected: "(let* ((x 1)) x)"},
+		{code: "(lambda (x) (+ 1 2))", expected: "(lambda (x) 3)"},
+		{code: "(defun f (x) (if #t x 0))", expected: "(defun f (x) x)"},
+		{code: "(global-set! x (add1 1))", expected: "(global-set! x 2)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+			require.Len(t, exprs, 1)
+
+			result := simplify(exprs[0])
+
+			tokens, err = parser.Tokenize(tt.expected)
+			require.NoError(t, err)
+			expected, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			require.Equal(t, expected[0].String(), result.String())
+		})
+	}
+}
+
+func TestInline(t *testing.T) {
+	tests := []struct {
+		code     string
+		size     int
+		expected string
+	}{
+		{
+			code:     "(defun next (x) (+ x 1)) (next 41)",
+			expected: "(defun next (x) (+ x 1)) (let ((x 41)) (+ x 1))",
+		},
+		{
+			code:     "(defun one () 1) (+ (one) 1)",
+			expected: "(defun one () 1) (+ 1 1)",
+		},
+		{
+			// calls in the bodies of procedures are inlined first
+			code: "(defun a (x) (+ x 1)) (defun b (x) (a (a x))) (b 1)",
+			size: 32,
+			expected: `(defun a (x) (+ x 1))
+			  (defun b (x) (let ((x (let ((x x)) (+ x 1)))) (+ x 1)))
+			  (let ((x 1)) (let ((x (let ((x x)) (+ x 1)))) (+ x 1)))`,
+		},
+		{
+			code:     "((lambda (x y) (+ x y)) 1 2)",
+			expected: "(let ((x 1) (y 2)) (+ x y))",
+		},
+		{
+			code:     "((lambda xs xs) 1)",
+			expected: "((lambda xs xs) 1)",
+		},
+		{
+			code:     "(defun f (n) (if (zero? n) 0 (f (- n 1)))) (f 3)",
+			expected: "(defun f (n) (if (zero? n) 0 (f (- n 1)))) (f 3)",
+		},
+		{
+			code:     "(defun even (n) (if (zero? n) #t (odd (- n 1)))) (defun odd (n) (if (zero? n) #f (even (- n 1)))) (even 3)",
+			expected: "(defun even (n) (if (zero? n) #t (odd (- n 1)))) (defun odd (n) (if (zero? n) #f (even (- n 1)))) (even 3)",
+		},
+		{
+			code:     "(defun f (x) (declare noinline) x) (f 1)",
+			expected: "(defun f (x) x) (f 1)",
+		},
+		{
+			code:     "(defun f (x) (+ x 1)) (f 1)",
+			size:     2,
+			expected: "(defun f (x) (+ x 1)) (f 1)",
+		},
+		{
+			code:     "(defun f (x) (+ x 1)) (f 1)",
+			size:     -1,
+			expected: "(defun f (x) (+ x 1)) (f 1)",
+		},
+		{
+			// the wrong number of arguments is reported by the compiler
+			code:     "(defun f (x) x) (f 1 2)",
+			expected: "(defun f (x) x) (f 1 2)",
+		},
+		{
+			code:     "(defun f (x) x) (let ((f 1)) (f 2))",
+			expected: "(defun f (x) x) (let ((f 1)) (f 2))",
+		},
+		{
+			// g would refer to the variable
+			code:     "(defun g (x) (declare noinline) x) (defun h (x) (g x)) (let ((g 1)) (h g))",
+			expected: "(defun g (x) x) (defun h (x) (g x)) (let ((g 1)) (h g))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			size := tt.size
+			if size == 0 {
+				size = DefaultInlineSize
+			}
+			result, err := inline(exprs, size)
+			require.NoError(t, err)
+
+			tokens, err = parser.Tokenize(tt.expected)
+			require.NoError(t, err)
+			expected, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			want, got := expr.L(expected...), expr.L(result...)
+			require.Equal(t, want.String(), got.String())
+		})
+	}
+
+	tokens, err := parser.Tokenize("(defun f (x) (declare inline) x)")
+	require.NoError(t, err)
+	exprs, err := parser.Parse(tokens)
+	require.NoError(t, err)
+	_, err = inline(exprs, DefaultInlineSize)
+	require.ErrorContains(t, err, "unknown declaration in procedure 'f'")
+
+	// declarations may precede internal definitions
+	tokens, err = parser.Tokenize("(defun f (x) (declare noinline) (define y (+ x 1)) (+ y y)) (f 1)")
+	require.NoError(t, err)
+	exprs, err = parser.Parse(tokens)
+	require.NoError(t, err)
+	result, err := Preprocess(exprs, "test")
+	require.NoError(t, err)
+	require.Equal(t, expr.L(expr.Id("f"), expr.N(1)), result.List[len(result.List)-1])
+}
+
+func TestLift(t *testing.T) {
+	tests := []struct {
+		code string
+		// the rewritten expressions followed by the lifted procedures
+		expected string
+	}{
+		{
+			code:     "(let ((f (lambda (x) (+ x 1)))) (f 1))",
+			expected: "(f0 1) (defun f0 (x) (+ x 1))",
+		},
+		{
+			code:     "(defun g (k) (let ((f (lambda (x) (+ x k)))) (f 1)))",
+			expected: "(defun g (k) (f0 1 k)) (defun f0 (x k) (+ x k))",
+		},
+		{
+			// letrec* binds lambdas through boxes
+			code:     "(let ((loop (box ()))) (set-box! loop (lambda (i) (if (zero? i) 0 ((unbox loop) (- i 1))))) ((unbox loop) 3))",
+			expected: "(f0 3) (defun f0 (i) (if (zero? i) 0 (f0 (- i 1))))",
+		},
+		{
+			// as do named lets, whose value is called
+			code:     "((let ((loop (box ()))) (set-box! loop (lambda (i) i)) (unbox loop)) 1)",
+			expected: "(f0 1) (defun f0 (i) i)",
+		},
+		{
+			// calls pass on the variables captured by the lambdas called
+			code:     "(defun g (k) (let ((f (lambda (x) (+ x k)))) (let ((h (lambda (y) (f y)))) (h 1))))",
+			expected: "(defun g (k) (f1 1 k)) (defun f0 (x k) (+ x k)) (defun f1 (y k) (f0 y k))",
+		},
+		{
+			code:     "(defun g (k) (let ((f (lambda (x) (+ x k)))) (lambda (y) (f y))))",
+			expected: "(defun g (k) (lambda (y) (f0 y k))) (defun f0 (x k) (+ x k))",
+		},
+		{
+			// labels avoid the identifiers in use
+			code:     "(defun f0 (x) x) (let ((f (lambda (x) x))) (f (f0 1)))",
+			expected: "(defun f0 (x) x) (f1 (f0 1)) (defun f1 (x) x)",
+		},
+		{
+			code:     "(let ((f (lambda (x) x))) f)",
+			expected: "(let ((f (lambda (x) x))) f)",
+		},
+		{
+			// k is not the variable f captures where f is called
+			code:     "(defun g (k) (let ((f (lambda (x) (+ x k)))) (let ((k 1)) (f k))))",
+			expected: "(defun g (k) (let ((f (lambda (x) (+ x k)))) (let ((k 1)) (f k))))",
+		},
+		{
+			code:     "(let ((f (lambda xs xs))) (f 1))",
+			expected: "(let ((f (lambda xs xs))) (f 1))",
+		},
+		{
+			// the wrong number of arguments is reported when f is called
+			code:     "(let ((f (lambda (x) x))) (f 1 2))",
+			expected: "(let ((f (lambda (x) x))) (f 1 2))",
+		},
+		{
+			code:     "(let ((loop (box ()))) (set-box! loop (lambda (i) i)) (unbox loop))",
+			expected: "(let ((loop (box ()))) (set-box! loop (lambda (i) i)) (unbox loop))",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			tokens, err := parser.Tokenize(tt.code)
+			require.NoError(t, err)
+			exprs, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			counter := 0
+			result, lifted := lift(exprs, &counter)
+			for _, k := range sortedKeys(lifted) {
+				result = append(result, lifted[k])
+			}
+
+			tokens, err = parser.Tokenize(tt.expected)
+			require.NoError(t, err)
+			expected, err := parser.Parse(tokens)
+			require.NoError(t, err)
+
+			want, got := expr.L(expected...), expr.L(result...)
+			require.Equal(t, want.String(), got.String())
+		})
+	}
+}
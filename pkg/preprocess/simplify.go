@@ -0,0 +1,260 @@
+package preprocess
+
+import (
+	"github.com/brenoafb/tinycompiler/pkg/expr"
+)
+
+// simplify folds the applications of primitives to literals in e,
+// removes the branches of conditionals whose test is a literal,
+// and the let bindings of pure expressions which are never used.
+// Malformed forms are left for the compiler to report.
+func simplify(e expr.E) expr.E {
+	if e.Typ != expr.ExprList {
+		return e
+	}
+
+	elems := e.List
+	head := elems[0]
+
+	switch {
+	case expr.IsIdent(head, "global-ref"):
+		return e
+	case expr.IsIdent(head, "lambda") && len(elems) >= 3:
+		// (lambda <args> <body...>)
+		return expr.L(append([]expr.E{head, elems[1]}, simplifyAll(elems[2:])...)...)
+	case expr.IsIdent(head, "defun") && len(elems) >= 4:
+		// (defun <name> <args> <body...>)
+		return expr.L(append([]expr.E{head, elems[1], elems[2]}, simplifyAll(elems[3:])...)...)
+	case expr.IsLet(head) && len(elems) >= 3 && !expr.IsNamedLet(elems):
+		return simplifyLet(elems)
+	case expr.IsIdent(head, "if") && len(elems) == 4:
+		test := simplify(elems[1])
+		if truth, ok := literalTruth(test); ok {
+			if truth {
+				return simplify(elems[2])
+			}
+			return simplify(elems[3])
+		}
+		return expr.L(head, test, simplify(elems[2]), simplify(elems[3]))
+	case head.Typ == expr.ExprIdent:
+		args := simplifyAll(elems[1:])
+		if folded, ok := fold(head.Ident, args); ok {
+			return folded
+		}
+		return expr.L(append([]expr.E{head}, args...)...)
+	default:
+		return expr.L(simplifyAll(elems)...)
+	}
+}
+
+func simplifyAll(es []expr.E) []expr.E {
+	result := make([]expr.E, 0, len(es))
+	for _, e := range es {
+		result = append(result, simplify(e))
+	}
+	return result
+}
+
+// simplifyLet simplifies a let or let* form, removing the bindings
+// of pure values to variables which are not mentioned in their scope
+func simplifyLet(elems []expr.E) expr.E {
+	bindings, body, sequential := expr.SplitLet(elems)
+	body = simplifyAll(body)
+
+	values := make([]expr.E, 0, len(bindings))
+	for _, binding := range bindings {
+		values = append(values, simplify(binding.List[1]))
+	}
+
+	// the bindings are visited from the last, so that those
+	// only used by removed bindings are removed as well
+	kept := []expr.E{}
+	later := []expr.E{}
+	for i := len(bindings) - 1; i >= 0; i-- {
+		v := bindings[i].List[0]
+		used := mentions(expr.L(body...), map[string]struct{}{v.Ident: {}})
+		if sequential {
+			used = used || mentions(expr.L(later...), map[string]struct{}{v.Ident: {}})
+		}
+		if used || !pure(values[i]) {
+			kept = append([]expr.E{expr.L(v, values[i])}, kept...)
+			later = append(later, values[i])
+		}
+	}
+
+	if len(kept) == 0 {
+		if len(body) == 1 {
+			return body[0]
+		}
+		return expr.L(append([]expr.E{expr.Id("progn")}, body...)...)
+	}
+
+	// bindings written in the original syntax are sequential
+	head := elems[0]
+	if sequential {
+		head = expr.Id("let*")
+	}
+	return expr.L(append([]expr.E{head, expr.L(kept...)}, body...)...)
+}
+
+// literalTruth returns whether the literal e is true,
+// i.e. anything but #f, and whether e is a literal
+func literalTruth(e expr.E) (bool, bool) {
+	switch e.Typ {
+	case expr.ExprBool:
+		return e.Bool, true
+	case expr.ExprNumber, expr.ExprNil, expr.ExprString:
+		return true, true
+	}
+	return false, false
+}
+
+// isLiteral reports whether e is a literal value other than a string,
+// which are allocated objects
+func isLiteral(e expr.E) bool {
+	return e.Typ == expr.ExprNumber || e.Typ == expr.ExprBool || e.Typ == expr.ExprNil
+}
+
+// fixnum returns n wrapped around to the range of fixnums, as the
+// generated code computes with 32 bit words holding 2 tag bits
+func fixnum(n int) int {
+	return int(int32(n<<2) >> 2)
+}
+
+// fold returns the value of the primitive op applied to args,
+// if they are literals it can be computed from
+func fold(op string, args []expr.E) (expr.E, bool) {
+	if n, ok := foldable[op]; !ok || len(args) != n {
+		return expr.Nil(), false
+	}
+
+	switch op {
+	case "add1":
+		return foldSum(args[0], 1)
+	case "+", "-":
+		x, y := args[0], args[1]
+		if x.Typ == expr.ExprNumber && y.Typ == expr.ExprNumber {
+			if op == "+" {
+				return expr.N(fixnum(x.Number + y.Number)), true
+			}
+			return expr.N(fixnum(x.Number - y.Number)), true
+		}
+		switch {
+		case y.Typ == expr.ExprNumber && op == "+":
+			return foldSum(x, y.Number)
+		case y.Typ == expr.ExprNumber:
+			return foldSum(x, -y.Number)
+		case x.Typ == expr.ExprNumber && op == "+":
+			return foldSum(y, x.Number)
+		}
+	case "zero?":
+		if isLiteral(args[0]) {
+			return expr.B(args[0].Typ == expr.ExprNumber && fixnum(args[0].Number) == 0), true
+		}
+	case "null?":
+		if isLiteral(args[0]) {
+			return expr.B(args[0].Typ == expr.ExprNil), true
+		}
+	case "eq?":
+		if isLiteral(args[0]) && isLiteral(args[1]) {
+			return expr.B(sameLiteral(args[0], args[1])), true
+		}
+	case "eof-object?", "port?", "error-object?":
+		// no literal denotes such objects
+		if isLiteral(args[0]) {
+			return expr.B(false), true
+		}
+	}
+	return expr.Nil(), false
+}
+
+// foldable holds the arity of the primitives fold computes
+var foldable = map[string]int{
+	"add1":          1,
+	"+":             2,
+	"-":             2,
+	"zero?":         1,
+	"null?":         1,
+	"eq?":           2,
+	"eof-object?":   1,
+	"port?":         1,
+	"error-object?": 1,
+}
+
+// foldSum returns the sum of e and the constant n, when e is
+// a sum of the same form with a constant which both can be added to.
+// The operation of e is kept, so that its operand is still checked.
+func foldSum(e expr.E, n int) (expr.E, bool) {
+	if e.Typ == expr.ExprNumber {
+		return expr.N(fixnum(e.Number + n)), true
+	}
+	if e.Typ != expr.ExprList || len(e.List) != 3 {
+		return expr.Nil(), false
+	}
+
+	inner, x, y := e.List[0], e.List[1], e.List[2]
+	switch {
+	case expr.IsIdent(inner, "+") && y.Typ == expr.ExprNumber:
+		return expr.L(inner, x, expr.N(fixnum(y.Number+n))), true
+	case expr.IsIdent(inner, "+") && x.Typ == expr.ExprNumber:
+		return expr.L(inner, expr.N(fixnum(x.Number+n)), y), true
+	case expr.IsIdent(inner, "-") && y.Typ == expr.ExprNumber:
+		return expr.L(inner, x, expr.N(fixnum(y.Number-n))), true
+	}
+	return expr.Nil(), false
+}
+
+// sameLiteral reports whether two literals denote the same value
+func sameLiteral(x, y expr.E) bool {
+	if x.Typ != y.Typ {
+		return false
+	}
+	switch x.Typ {
+	case expr.ExprNumber:
+		return fixnum(x.Number) == fixnum(y.Number)
+	case expr.ExprBool:
+		return x.Bool == y.Bool
+	}
+	return true
+}
+
+// pureOps holds the arity of the primitives which neither have side
+// effects nor check the types of their operands, -1 if they are variadic
+var pureOps = map[string]int{
+	"cons":          2,
+	"box":           1,
+	"vector":        -1,
+	"null?":         1,
+	"eq?":           2,
+	"zero?":         1,
+	"eof-object?":   1,
+	"port?":         1,
+	"error-object?": 1,
+}
+
+// pure reports whether evaluating e has no effect besides
+// allocating its value, so that it can be left out if unused
+func pure(e expr.E) bool {
+	if e.Typ != expr.ExprList {
+		return true
+	}
+
+	head := e.List[0]
+	switch {
+	case expr.IsIdent(head, "lambda"), expr.IsIdent(head, "global-ref"):
+		return true
+	case head.Typ != expr.ExprIdent:
+		return false
+	}
+
+	n, ok := pureOps[head.Ident]
+	if !ok || (n >= 0 && len(e.List)-1 != n) {
+		return false
+	}
+	for _, arg := range e.List[1:] {
+		if !pure(arg) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,7 +1,10 @@
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
+#include <errno.h>
 
 #define empty_list      0x2f
+#define eof_object      0x3f
 
 #define fixnum_mask     3
 #define fixnum_tag      0
@@ -15,6 +18,14 @@
 #define bool_tag		0x1f
 #define bool_shift		7
 
+#define port_mask       0xff
+#define port_tag        0x4f
+#define port_shift      8
+
+#define error_mask      0xff
+#define error_tag       0x5f
+#define error_shift     8
+
 #define ptr_mask        7
 #define pair_tag        1
 #define vector_tag      2
@@ -23,34 +34,406 @@
 #define closure_tag     6
 
 #define HEAPSIZE        1024 * 1024
+#define MAX_PORTS       64
 
-int lisp_entry(void *heap);
+/* missing from programs whose units only define global variables */
+int lisp_entry(void) __attribute__((weak));
 
-int main(int argc, char *argv[]) {
-	void *heap = malloc(HEAPSIZE);
-	int val = lisp_entry(heap);
+/* the heap pointer of compiled code, exchanged around runtime calls
+   and entry points */
+char *lisp_heap;
+static char *heap_end;
+
+const char *type_name(int val) {
 	if ((val & fixnum_mask) == fixnum_tag) {
-		printf("%d\n", val >> fixnum_shift);
+		return "fixnum";
 	} else if ((val & char_mask) == char_tag) {
-		printf("%c\n", (char) (val >> char_shift));
+		return "char";
 	} else if (val == empty_list) {
-		printf("()\n");
+		return "empty list";
+	} else if (val == eof_object) {
+		return "eof object";
+	} else if ((val & port_mask) == port_tag) {
+		return "port";
+	} else if ((val & error_mask) == error_tag) {
+		return "error object";
 	} else if ((val & bool_mask) == bool_tag) {
-		int shifted = val >> bool_shift;
-		printf("#%c\n", (val >> bool_shift) ? 't' : 'f');
+		return "boolean";
 	} else if ((val & ptr_mask) == pair_tag) {
-		printf("#<pair 0x%x>\n", val);
+		return "pair";
 	} else if ((val & ptr_mask) == vector_tag) {
-		printf("#<vector 0x%x>\n", val);
+		return "vector";
 	} else if ((val & ptr_mask) == string_tag) {
-		printf("#<string 0x%x>\n", val);
+		return "string";
 	} else if ((val & ptr_mask) == symbol_tag) {
-		printf("#<symbol 0x%x>\n", val);
+		return "symbol";
 	} else if ((val & ptr_mask) == closure_tag) {
-		printf("#<closure 0x%x>\n", val);
+		return "closure";
+	}
+	return "unknown";
+}
+
+/* called by compiled code when an operation receives a value of the wrong type */
+void lisp_type_error(const char *op, const char *expected, int val) {
+	fflush(stdout);
+	fprintf(stderr, "%s: expected %s, got %s\n", op, expected, type_name(val));
+	exit(EXIT_FAILURE);
+}
+
+/* called by compiled code when a vector index is out of bounds */
+void lisp_range_error(const char *op, int index, int vector) {
+	int length = *(int *) (vector - vector_tag);
+	fflush(stdout);
+	if ((index & fixnum_mask) == fixnum_tag) {
+		fprintf(stderr, "%s: index %d out of range for vector of length %d\n",
+				op, index >> fixnum_shift, length >> fixnum_shift);
 	} else {
-		printf("#<unknown 0x%x>\n", val);
+		fprintf(stderr, "%s: index out of range for vector of length %d\n",
+				op, length >> fixnum_shift);
+	}
+	exit(EXIT_FAILURE);
+}
+
+/* called by compiled code when a procedure receives the wrong number of arguments */
+void lisp_arity_error(int expected, int actual, int variadic) {
+	fflush(stdout);
+	fprintf(stderr, "arity mismatch: expected %s%d argument%s, got %d\n",
+			variadic ? "at least " : "", expected, expected == 1 ? "" : "s", actual);
+	exit(EXIT_FAILURE);
+}
+
+/*
+ * Console I/O.
+ * These are called by compiled code with tagged values as arguments
+ * and return a tagged value. The output procedures return the empty list.
+ */
+
+static void print(FILE *out, int val, int write);
+
+static void print_char(FILE *out, char c, int write) {
+	if (!write) {
+		putc(c, out);
+		return;
+	}
+	switch (c) {
+	case ' ':
+		fprintf(out, "#\\space");
+		break;
+	case '\n':
+		fprintf(out, "#\\newline");
+		break;
+	case '\t':
+		fprintf(out, "#\\tab");
+		break;
+	default:
+		fprintf(out, "#\\%c", c);
+	}
+}
+
+static void print_string(FILE *out, int val, int write) {
+	int length = *(int *) (val - string_tag) >> fixnum_shift;
+	char *s = (char *) (val - string_tag) + sizeof(int);
+	if (write) {
+		putc('"', out);
+	}
+	for (int i = 0; i < length; i++) {
+		if (write && (s[i] == '"' || s[i] == '\\')) {
+			putc('\\', out);
+		}
+		putc(s[i], out);
 	}
+	if (write) {
+		putc('"', out);
+	}
+}
+
+static void print_pair(FILE *out, int val, int write) {
+	putc('(', out);
+	print(out, *(int *) (val - pair_tag), write);
+	val = *(int *) (val - pair_tag + sizeof(int));
+	while ((val & ptr_mask) == pair_tag) {
+		putc(' ', out);
+		print(out, *(int *) (val - pair_tag), write);
+		val = *(int *) (val - pair_tag + sizeof(int));
+	}
+	if (val != empty_list) {
+		fprintf(out, " . ");
+		print(out, val, write);
+	}
+	putc(')', out);
+}
+
+static void print_vector(FILE *out, int val, int write) {
+	int *v = (int *) (val - vector_tag);
+	int length = v[0] >> fixnum_shift;
+	fprintf(out, "#(");
+	for (int i = 0; i < length; i++) {
+		if (i > 0) {
+			putc(' ', out);
+		}
+		print(out, v[i + 1], write);
+	}
+	putc(')', out);
+}
+
+static void print(FILE *out, int val, int write) {
+	if ((val & fixnum_mask) == fixnum_tag) {
+		fprintf(out, "%d", val >> fixnum_shift);
+	} else if ((val & char_mask) == char_tag) {
+		print_char(out, (char) (val >> char_shift), write);
+	} else if (val == empty_list) {
+		fprintf(out, "()");
+	} else if (val == eof_object) {
+		fprintf(out, "#<eof>");
+	} else if ((val & port_mask) == port_tag) {
+		fprintf(out, "#<port %d>", val >> port_shift);
+	} else if ((val & error_mask) == error_tag) {
+		fprintf(out, "#<error %s>", strerror(val >> error_shift));
+	} else if ((val & bool_mask) == bool_tag) {
+		fprintf(out, "#%c", (val >> bool_shift) ? 't' : 'f');
+	} else if ((val & ptr_mask) == pair_tag) {
+		print_pair(out, val, write);
+	} else if ((val & ptr_mask) == vector_tag) {
+		print_vector(out, val, write);
+	} else if ((val & ptr_mask) == string_tag) {
+		print_string(out, val, write);
+	} else if ((val & ptr_mask) == symbol_tag) {
+		fprintf(out, "#<symbol 0x%x>", val);
+	} else if ((val & ptr_mask) == closure_tag) {
+		fprintf(out, "#<closure 0x%x>", val);
+	} else {
+		fprintf(out, "#<unknown 0x%x>", val);
+	}
+}
+
+int lisp_write_char(int c) {
+	putchar(c >> char_shift);
+	return empty_list;
+}
+
+int lisp_display(int val) {
+	print(stdout, val, 0);
+	return empty_list;
+}
+
+int lisp_write(int val) {
+	print(stdout, val, 1);
+	return empty_list;
+}
+
+int lisp_newline(void) {
+	putchar('\n');
+	return empty_list;
+}
+
+int lisp_read_char(void) {
+	int c = getchar();
+	if (c == EOF) {
+		return eof_object;
+	}
+	return (c << char_shift) | char_tag;
+}
+
+int lisp_peek_char(void) {
+	int c = getchar();
+	if (c == EOF) {
+		return eof_object;
+	}
+	ungetc(c, stdin);
+	return (c << char_shift) | char_tag;
+}
+
+/*
+ * File ports.
+ * A port is the index of its stream in the port table.
+ * Failures are reported by returning an error object holding errno.
+ */
+
+static FILE *ports[MAX_PORTS];
+
+static int make_error(int err) {
+	return (err << error_shift) | error_tag;
+}
+
+static int make_string(const char *s, int length) {
+	char *p = lisp_heap;
+	*(int *) p = length << fixnum_shift;
+	memmove(p + sizeof(int), s, length);
+	p[sizeof(int) + length] = '\0';
+	/* keep the heap pointer aligned to the next object boundary */
+	lisp_heap += (sizeof(int) + length + 1 + 7) & -8;
+	return (int) p | string_tag;
+}
+
+static char *string_chars(int val) {
+	return (char *) (val - string_tag) + sizeof(int);
+}
+
+static FILE *port_stream(int port) {
+	int i = port >> port_shift;
+	if (i < 0 || i >= MAX_PORTS) {
+		return NULL;
+	}
+	return ports[i];
+}
+
+static int open_port(int path, const char *mode) {
+	int i;
+	for (i = 0; i < MAX_PORTS && ports[i] != NULL; i++)
+		;
+	if (i == MAX_PORTS) {
+		return make_error(EMFILE);
+	}
+	ports[i] = fopen(string_chars(path), mode);
+	if (ports[i] == NULL) {
+		return make_error(errno);
+	}
+	return (i << port_shift) | port_tag;
+}
+
+int lisp_open_input_file(int path) {
+	return open_port(path, "r");
+}
+
+int lisp_open_output_file(int path) {
+	return open_port(path, "w");
+}
+
+int lisp_close_port(int port) {
+	FILE *f = port_stream(port);
+	if (f == NULL) {
+		return make_error(EBADF);
+	}
+	ports[port >> port_shift] = NULL;
+	if (f == stdin || f == stdout || f == stderr) {
+		return empty_list;
+	}
+	if (fclose(f) != 0) {
+		return make_error(errno);
+	}
+	return empty_list;
+}
+
+int lisp_read_line(int port) {
+	FILE *f = port_stream(port);
+	if (f == NULL) {
+		return make_error(EBADF);
+	}
+	/* read the line directly into the heap, past the length word,
+	   leaving room for the terminating NUL */
+	char *s = lisp_heap + sizeof(int);
+	int room = heap_end - s - 1;
+	int length = 0;
+	int c;
+	while ((c = getc(f)) != EOF && c != '\n') {
+		if (length == room) {
+			/* the rest of the line is discarded */
+			while ((c = getc(f)) != EOF && c != '\n') {
+			}
+			return make_error(ENOMEM);
+		}
+		s[length++] = c;
+	}
+	if (c == EOF && length == 0) {
+		return ferror(f) ? make_error(errno) : eof_object;
+	}
+	return make_string(s, length);
+}
+
+int lisp_write_string(int str, int port) {
+	FILE *f = port_stream(port);
+	if (f == NULL) {
+		return make_error(EBADF);
+	}
+	int length = *(int *) (str - string_tag) >> fixnum_shift;
+	if (fwrite(string_chars(str), 1, length, f) != (size_t) length) {
+		return make_error(errno);
+	}
+	return empty_list;
+}
+
+int lisp_error_object_message(int err) {
+	const char *message = strerror(err >> error_shift);
+	return make_string(message, strlen(message));
+}
+
+/*
+ * Process interface.
+ */
+
+static int command_line_argc;
+static char **command_line_argv;
+
+static int make_pair(int car, int cdr) {
+	int *p = (int *) lisp_heap;
+	p[0] = car;
+	p[1] = cdr;
+	lisp_heap += 2 * sizeof(int);
+	return (int) p | pair_tag;
+}
+
+int lisp_command_line(void) {
+	int list = empty_list;
+	for (int i = command_line_argc - 1; i >= 0; i--) {
+		int arg = make_string(command_line_argv[i], strlen(command_line_argv[i]));
+		list = make_pair(arg, list);
+	}
+	return list;
+}
+
+/* exits with a fixnum status, or with success or failure for a boolean */
+int lisp_exit(int val) {
+	int status = EXIT_FAILURE;
+	if ((val & fixnum_mask) == fixnum_tag) {
+		status = val >> fixnum_shift;
+	} else if ((val & bool_mask) == bool_tag) {
+		status = (val >> bool_shift) ? EXIT_SUCCESS : EXIT_FAILURE;
+	} else {
+		lisp_type_error("exit", "fixnum or boolean", val);
+	}
+	exit(status);
+}
+
+/*
+ * Units defining global variables register their initialisation code
+ * in the lisp_init section, whose bounds the linker provides. The code
+ * exchanges the heap pointer through lisp_heap.
+ */
+typedef void (*lisp_initialiser)(void);
+extern lisp_initialiser __start_lisp_init[] __attribute__((weak));
+extern lisp_initialiser __stop_lisp_init[] __attribute__((weak));
+
+void run_initialisers(void) {
+	for (lisp_initialiser *init = __start_lisp_init; init < __stop_lisp_init; init++) {
+		(*init)();
+	}
+}
+
+int main(int argc, char *argv[]) {
+	command_line_argc = argc;
+	command_line_argv = argv;
+
+	ports[0] = stdin;
+	ports[1] = stdout;
+	ports[2] = stderr;
+
+	lisp_heap = malloc(HEAPSIZE);
+	heap_end = lisp_heap + HEAPSIZE;
+	run_initialisers();
+	if (!lisp_entry) {
+		return EXIT_SUCCESS;
+	}
+	int val = lisp_entry();
+
+	/* an unhandled error object is reported as a failure */
+	if ((val & error_mask) == error_tag) {
+		fflush(stdout);
+		fprintf(stderr, "error: %s\n", strerror(val >> error_shift));
+		return EXIT_FAILURE;
+	}
+
+	lisp_display(val);
+	lisp_newline();
 
-	return 0;
+	return EXIT_SUCCESS;
 }
@@ -0,0 +1,34 @@
+(defun list xs xs)
+
+(defun length (l)
+  (let loop ((l l) (n 0))
+    (if (null? l) n (loop (cdr l) (+ n 1)))))
+
+(defun append (l m)
+  (if (null? l)
+      m
+      (cons (car l) (append (cdr l) m))))
+
+(defun reverse (l)
+  (let loop ((l l) (acc ()))
+    (if (null? l) acc (loop (cdr l) (cons (car l) acc)))))
+
+(defun list-ref (l k)
+  (if (zero? k)
+      (car l)
+      (list-ref (cdr l) (- k 1))))
+
+(defun memq (x l)
+  (if (null? l)
+      #f
+      (if (eq? x (car l)) l (memq x (cdr l)))))
+
+(defun assq (x l)
+  (if (null? l)
+      #f
+      (if (eq? x (car (car l))) (car l) (assq x (cdr l)))))
+
+(defun map (f l)
+  (if (null? l)
+      ()
+      (cons (f (car l)) (map f (cdr l)))))
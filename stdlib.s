@@ -0,0 +1,552 @@
+	.data
+	.align	8
+	.global	append.closure
+	.align	8
+append.closure:
+	.long	append
+	.global	assq.closure
+	.align	8
+assq.closure:
+	.long	assq
+	.global	length.closure
+	.align	8
+length.closure:
+	.long	length
+	.global	list.closure
+	.align	8
+list.closure:
+	.long	list
+	.global	list_2d_ref.closure
+	.align	8
+list_2d_ref.closure:
+	.long	list_2d_ref
+	.global	map.closure
+	.align	8
+map.closure:
+	.long	map
+	.global	memq.closure
+	.align	8
+memq.closure:
+	.long	memq
+	.global	reverse.closure
+	.align	8
+reverse.closure:
+	.long	reverse
+	.align	8
+f0.closure:
+	.long	f0
+	.align	8
+f1.closure:
+	.long	f1
+	.text
+	.p2align	2
+	.global	stdlib.init
+	.global	append
+	.global	assq
+	.global	length
+	.global	list
+	.global	list_2d_ref
+	.global	map
+	.global	memq
+	.global	reverse
+append:
+cmpl $2, %ecx
+je L0
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $2
+call lisp_arity_error
+L0:
+movl -4(%esp), %ecx
+movl -8(%esp), %edx
+movl %ecx, %eax
+cmpl $0x2f, %eax
+jne L1
+movl %edx, -16(%esp)
+jmp L2
+L1:
+movl %ecx, %eax
+movl %ecx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L3
+movl -1(%eax), %eax
+movl %eax, -20(%esp)
+movl %ecx, %eax
+movl %ecx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L4
+movl 3(%eax), %eax
+movl %eax, %ecx
+movl %ecx, -40(%esp)
+movl %edx, -44(%esp)
+movl $2, %ecx
+addl $-32, %esp
+call append
+addl $32, %esp
+movl %eax, %ecx
+movl -20(%esp), %eax
+movl %eax, (%esi)
+movl %ecx, 4(%esi)
+movl %esi, %eax
+orl $1, %eax
+addl $8, %esi
+movl %eax, %ecx
+movl %ecx, -16(%esp)
+L2:
+movl -16(%esp), %eax
+ret
+assq:
+cmpl $2, %ecx
+je L5
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $2
+call lisp_arity_error
+L5:
+movl -4(%esp), %ecx
+movl -8(%esp), %edx
+movl %edx, %eax
+cmpl $0x2f, %eax
+jne L6
+movl $0x1f, -16(%esp)
+jmp L7
+L6:
+movl %edx, %eax
+movl %edx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L3
+movl -1(%eax), %eax
+movl %eax, %ebp
+movl %eax, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L3
+movl -1(%eax), %eax
+movl %eax, %ebx
+movl %ecx, %eax
+cmpl %ebx, %eax
+jne L8
+movl %edx, %eax
+movl %edx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L3
+movl -1(%eax), %eax
+movl %eax, %ebx
+movl %ebx, -32(%esp)
+jmp L9
+L8:
+movl %edx, %eax
+movl %edx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L4
+movl 3(%eax), %eax
+movl %eax, %edx
+movl %ecx, -52(%esp)
+movl %edx, -56(%esp)
+movl $2, %ecx
+addl $-44, %esp
+call assq
+addl $44, %esp
+movl %eax, %ecx
+movl %ecx, -32(%esp)
+L9:
+movl -32(%esp), %eax
+movl %eax, -16(%esp)
+L7:
+movl -16(%esp), %eax
+ret
+length:
+cmpl $1, %ecx
+je L10
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $1
+call lisp_arity_error
+L10:
+movl -4(%esp), %ecx
+movl %ecx, -16(%esp)
+movl $0, -20(%esp)
+movl $2, %ecx
+addl $-8, %esp
+call f0
+addl $8, %esp
+ret
+list:
+cmpl $0, %ecx
+jge L11
+andl $-16, %esp
+subl $4, %esp
+pushl $1
+pushl %ecx
+pushl $0
+call lisp_arity_error
+L11:
+movl $0x2f, %eax
+L12:
+cmpl $0, %ecx
+jle L13
+movl %ecx, %edx
+negl %edx
+movl (%esp,%edx,4), %ebx
+movl %ebx, (%esi)
+movl %eax, 4(%esi)
+movl %esi, %eax
+orl $1, %eax
+addl $8, %esi
+decl %ecx
+jmp L12
+L13:
+movl %eax, -4(%esp)
+movl %eax, %ecx
+ret
+list_2d_ref:
+cmpl $2, %ecx
+je L14
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $2
+call lisp_arity_error
+L14:
+movl -4(%esp), %ecx
+movl -8(%esp), %edx
+movl %edx, %eax
+cmpl $0, %eax
+jne L15
+movl %ecx, %eax
+movl %ecx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L3
+movl -1(%eax), %eax
+movl %eax, %ebx
+movl %ebx, -16(%esp)
+jmp L16
+L15:
+movl %ecx, %eax
+movl %ecx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L4
+movl 3(%eax), %eax
+movl %eax, %ecx
+movl %edx, %eax
+testl $3, %eax
+jne L17
+movl %edx, %eax
+subl $4, %eax
+movl %eax, %edx
+movl %ecx, -40(%esp)
+movl %edx, -44(%esp)
+movl $2, %ecx
+addl $-32, %esp
+call list_2d_ref
+addl $32, %esp
+movl %eax, %ecx
+movl %ecx, -16(%esp)
+L16:
+movl -16(%esp), %eax
+ret
+map:
+cmpl $2, %ecx
+je L18
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $2
+call lisp_arity_error
+L18:
+movl -8(%esp), %eax
+cmpl $0x2f, %eax
+jne L19
+movl $0x2f, -16(%esp)
+jmp L20
+L19:
+movl -8(%esp), %eax
+movl %eax, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L3
+movl -1(%eax), %eax
+movl %eax, %ecx
+movl %ecx, -48(%esp)
+movl -4(%esp), %eax
+movl %eax, %ebx
+andl $0x7, %ebx
+cmpl $0x6, %ebx
+jne L21
+movl %edi, -40(%esp)
+movl %eax, %edi
+andl $-8, %edi
+movl (%edi), %ebx
+movl $1, %ecx
+addl $-40, %esp
+call *%ebx
+addl $40, %esp
+movl -40(%esp), %edi
+movl %eax, -24(%esp)
+movl -8(%esp), %eax
+movl %eax, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L4
+movl 3(%eax), %eax
+movl %eax, %ecx
+movl -4(%esp), %eax
+movl %eax, -44(%esp)
+movl %ecx, -48(%esp)
+movl $2, %ecx
+addl $-36, %esp
+call map
+addl $36, %esp
+movl %eax, %ecx
+movl -24(%esp), %eax
+movl %eax, (%esi)
+movl %ecx, 4(%esi)
+movl %esi, %eax
+orl $1, %eax
+addl $8, %esi
+movl %eax, %ecx
+movl %ecx, -16(%esp)
+L20:
+movl -16(%esp), %eax
+ret
+memq:
+cmpl $2, %ecx
+je L22
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $2
+call lisp_arity_error
+L22:
+movl -4(%esp), %ecx
+movl -8(%esp), %edx
+movl %edx, %eax
+cmpl $0x2f, %eax
+jne L23
+movl $0x1f, -16(%esp)
+jmp L24
+L23:
+movl %edx, %eax
+movl %edx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L3
+movl -1(%eax), %eax
+movl %eax, %ebx
+movl %ecx, %eax
+cmpl %ebx, %eax
+jne L25
+movl %edx, -28(%esp)
+jmp L26
+L25:
+movl %edx, %eax
+movl %edx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L4
+movl 3(%eax), %eax
+movl %eax, %edx
+movl %ecx, -44(%esp)
+movl %edx, -48(%esp)
+movl $2, %ecx
+addl $-36, %esp
+call memq
+addl $36, %esp
+movl %eax, %ecx
+movl %ecx, -28(%esp)
+L26:
+movl -28(%esp), %eax
+movl %eax, -16(%esp)
+L24:
+movl -16(%esp), %eax
+ret
+reverse:
+cmpl $1, %ecx
+je L27
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $1
+call lisp_arity_error
+L27:
+movl -4(%esp), %ecx
+movl %ecx, -16(%esp)
+movl $0x2f, -20(%esp)
+movl $2, %ecx
+addl $-8, %esp
+call f1
+addl $8, %esp
+ret
+f0:
+cmpl $2, %ecx
+je L28
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $2
+call lisp_arity_error
+L28:
+movl -4(%esp), %ecx
+movl -8(%esp), %edx
+movl %ecx, %eax
+cmpl $0x2f, %eax
+jne L29
+movl %edx, -16(%esp)
+jmp L30
+L29:
+movl %ecx, %eax
+movl %ecx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L4
+movl 3(%eax), %eax
+movl %eax, %ecx
+movl %edx, %eax
+testl $3, %eax
+jne L31
+movl %edx, %eax
+addl $4, %eax
+movl %eax, %edx
+movl %ecx, -36(%esp)
+movl %edx, -40(%esp)
+movl $2, %ecx
+addl $-28, %esp
+call f0
+addl $28, %esp
+movl %eax, %ecx
+movl %ecx, -16(%esp)
+L30:
+movl -16(%esp), %eax
+ret
+f1:
+cmpl $2, %ecx
+je L32
+andl $-16, %esp
+subl $4, %esp
+pushl $0
+pushl %ecx
+pushl $2
+call lisp_arity_error
+L32:
+movl -4(%esp), %ecx
+movl -8(%esp), %edx
+movl %ecx, %eax
+cmpl $0x2f, %eax
+jne L33
+movl %edx, -16(%esp)
+jmp L34
+L33:
+movl %ecx, %eax
+movl %ecx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L4
+movl 3(%eax), %eax
+movl %eax, %ebp
+movl %ecx, %eax
+movl %ecx, %ebx
+andl $0x7, %ebx
+cmpl $0x1, %ebx
+jne L3
+movl -1(%eax), %eax
+movl %eax, %ecx
+movl %ecx, (%esi)
+movl %edx, 4(%esi)
+movl %esi, %eax
+orl $1, %eax
+addl $8, %esi
+movl %eax, %ecx
+movl %ebp, -40(%esp)
+movl %ecx, -44(%esp)
+movl $2, %ecx
+addl $-32, %esp
+call f1
+addl $32, %esp
+movl %eax, %ecx
+movl %ecx, -16(%esp)
+L34:
+movl -16(%esp), %eax
+ret
+stdlib.init:
+movl %ebx, -4(%esp)
+movl %esi, -8(%esp)
+movl %edi, -12(%esp)
+movl %ebp, -16(%esp)
+movl lisp_heap, %esi
+movl $0x2f, %eax
+movl %esi, lisp_heap
+movl -4(%esp), %ebx
+movl -8(%esp), %esi
+movl -12(%esp), %edi
+movl -16(%esp), %ebp
+ret
+L3:
+andl $-16, %esp
+subl $4, %esp
+pushl %eax
+pushl $L36
+pushl $L35
+call lisp_type_error
+L4:
+andl $-16, %esp
+subl $4, %esp
+pushl %eax
+pushl $L36
+pushl $L37
+call lisp_type_error
+L17:
+andl $-16, %esp
+subl $4, %esp
+pushl %eax
+pushl $L39
+pushl $L38
+call lisp_type_error
+L21:
+andl $-16, %esp
+subl $4, %esp
+pushl %eax
+pushl $L41
+pushl $L40
+call lisp_type_error
+L31:
+andl $-16, %esp
+subl $4, %esp
+pushl %eax
+pushl $L39
+pushl $L42
+call lisp_type_error
+	.section	.rodata
+L35:
+	.asciz	"car"
+L36:
+	.asciz	"pair"
+L37:
+	.asciz	"cdr"
+L38:
+	.asciz	"-"
+L39:
+	.asciz	"fixnum"
+L40:
+	.asciz	"funcall"
+L41:
+	.asciz	"closure"
+L42:
+	.asciz	"+"